@@ -15,17 +15,22 @@
 package api
 
 import (
+	"bytes"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/opennota/widdly/filter"
 	"github.com/opennota/widdly/store"
 )
 
@@ -39,6 +44,21 @@ var (
 	// may not access the endpoint.
 	Authenticate func(http.ResponseWriter, *http.Request)
 
+	// CurrentUser is a hook that lets the client of the package tell
+	// the name of the authenticated user making the request.
+	// If it is nil, the username of HTTP basic authentication is used.
+	CurrentUser func(*http.Request) string
+
+	// SharedUser tells that all the users sign in under the same name
+	// (as with the password, where everybody is widdly). As they can't be
+	// told apart, tiddlers can't be locked then.
+	SharedUser bool
+
+	// Host is the host (and port) the wiki is served at. It is used to
+	// check the Origin and Referer of state-changing requests.
+	// If Host is empty, the Host header of the request is used.
+	Host string
+
 	// ServeIndex is a callback that should serve the index page.
 	ServeIndex = func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
@@ -49,8 +69,8 @@ func init() {
 	http.HandleFunc("/", withLoggingAndAuth(index))
 	http.HandleFunc("/status", withLoggingAndAuth(status))
 	http.HandleFunc("/recipes/all/tiddlers.json", withLoggingAndAuth(list))
-	http.HandleFunc("/recipes/all/tiddlers/", withLoggingAndAuth(tiddler))
-	http.HandleFunc("/bags/bag/tiddlers/", withLoggingAndAuth(remove))
+	http.HandleFunc("/recipes/all/tiddlers/", withLoggingAndAuth(withCSRF(tiddler)))
+	http.HandleFunc("/bags/bag/tiddlers/", withLoggingAndAuth(withCSRF(remove)))
 }
 
 // internalError logs err to the standard error and returns HTTP 500 Internal Server Error.
@@ -61,11 +81,7 @@ func internalError(w http.ResponseWriter, err error) {
 
 // logRequest logs the incoming request.
 func logRequest(r *http.Request) {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		host = r.RemoteAddr
-	}
-	log.Println(host, r.Method, r.URL, r.Referer(), r.UserAgent())
+	log.Println(ClientIP(r), r.Method, r.URL, r.Referer(), r.UserAgent())
 }
 
 // withLogging is a logging middleware.
@@ -136,16 +152,284 @@ func status(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"username":"me","space":{"recipe":"all"}}`))
 }
 
+// username returns the name of the user making the request, or an empty string.
+func username(r *http.Request) string {
+	if CurrentUser != nil {
+		return CurrentUser(r)
+	}
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
 // list serves a JSON list of (mostly) skinny tiddlers.
+// If the since parameter is given, only the changes made after the change
+// with that sequence number are listed (see listChanges).
+// If the filter parameter is given, only the tiddlers selected by the
+// filter are listed (see listFiltered).
+//
+// The sort (a field, prefixed with - for the descending order), limit,
+// offset and cursor parameters select a page of the tiddlers. If the page is
+// full, the Link header points at the next one. The fields parameter lists
+// the fields to serve (e.g. title,tags,modified).
 func list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if since := q.Get("since"); since != "" {
+		listChanges(w, r, since)
+		return
+	}
+	if expr := q.Get("filter"); expr != "" {
+		listFiltered(w, r, expr)
+		return
+	}
+
+	opts, err := listOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := splitFields(q.Get("fields"))
+	if opts == (store.ListOptions{}) {
+		// Stream the tiddlers to the client as they are read from the store.
+		l := &tiddlerList{w: w, fields: fields}
+		err := Store.Walk(r.Context(), l.add)
+		if err != nil && l.n == 0 && r.Context().Err() == nil {
+			internalError(w, err)
+		} else if err != nil {
+			log.Println("ERR", err) // Too late to tell the client; the list is left unfinished.
+		} else {
+			l.close()
+		}
+		return
+	}
+
+	tiddlers, err := store.List(r.Context(), Store, opts)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if opts.Limit > 0 && len(tiddlers) == opts.Limit {
+		field, _ := opts.Field()
+		next := *r.URL
+		nq := next.Query()
+		nq.Del("offset")
+		nq.Set("cursor", encodeCursor(opts.Sort, store.CursorOf(tiddlers[len(tiddlers)-1], field)))
+		next.RawQuery = nq.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+	writeTiddlers(w, tiddlers, fields)
+}
+
+// listOptions parses the paging parameters of list.
+func listOptions(q url.Values) (store.ListOptions, error) {
+	opts := store.ListOptions{Sort: q.Get("sort")}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"limit", &opts.Limit}, {"offset", &opts.Offset}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("bad %s", p.name)
+			}
+			*p.n = n
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(opts.Sort, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.After = c
+	}
+	return opts, nil
+}
+
+// encodeCursor encodes a cursor of a list sorted by sort as an opaque string.
+func encodeCursor(sort string, c *store.Cursor) string {
+	data, _ := json.Marshal([]string{sort, c.Value, c.Title})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes a cursor encoded by encodeCursor,
+// checking that it is for a list sorted by sort.
+func decodeCursor(sort, s string) (*store.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	var v []string
+	if err == nil {
+		err = json.Unmarshal(data, &v)
+	}
+	if err != nil || len(v) != 3 {
+		return nil, errors.New("bad cursor")
+	}
+	if v[0] != sort {
+		return nil, errors.New("the cursor is for another sort order")
+	}
+	return &store.Cursor{Value: v[1], Title: v[2]}, nil
+}
+
+// splitFields splits a comma-separated list of fields.
+func splitFields(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// encodeTiddler encodes a tiddler as JSON. If fields is not nil,
+// only the given fields of the tiddler are encoded.
+func encodeTiddler(t store.Tiddler, fields []string) ([]byte, error) {
+	data, err := t.MarshalJSON()
+	if err != nil || fields == nil {
+		return data, err
+	}
+	var js map[string]json.RawMessage
+	err = json.Unmarshal(data, &js)
+	if err != nil {
+		return nil, err
+	}
+	projected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := js[f]; ok {
+			projected[f] = v
+		}
+	}
+	return json.Marshal(projected)
+}
+
+// tiddlerList writes a JSON list of tiddlers to the client tiddler by tiddler.
+type tiddlerList struct {
+	w      http.ResponseWriter
+	fields []string
+	n      int // The number of tiddlers written
+}
+
+// add writes a tiddler.
+func (l *tiddlerList) add(t store.Tiddler) error {
+	data, err := encodeTiddler(t, l.fields)
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if l.n == 0 {
+		l.w.Header().Set("Content-Type", "application/json")
+		sep = "["
+	}
+	l.n++
+	_, err = io.WriteString(l.w, sep)
+	if err == nil {
+		_, err = l.w.Write(data)
+	}
+	return err
+}
+
+// close finishes the list.
+func (l *tiddlerList) close() {
+	end := "]\n"
+	if l.n == 0 {
+		l.w.Header().Set("Content-Type", "application/json")
+		end = "[]\n"
+	}
+	_, err := io.WriteString(l.w, end)
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
+
+// writeTiddlers serves a JSON list of tiddlers. If fields is not nil,
+// only the given fields of the tiddlers are served.
+func writeTiddlers(w http.ResponseWriter, tiddlers []store.Tiddler, fields []string) {
+	l := &tiddlerList{w: w, fields: fields}
+	for _, t := range tiddlers {
+		if err := l.add(t); err != nil {
+			log.Println("ERR", err)
+			return
+		}
+	}
+	l.close()
+}
+
+// listFiltered serves the tiddlers selected by a TiddlyWiki filter, in the
+// order the filter gives. The text of the tiddlers is only loaded if the
+// filter needs it.
+func listFiltered(w http.ResponseWriter, r *http.Request, expr string) {
+	f, err := filter.Parse(expr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	tiddlers, err := Store.All(r.Context())
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	fields := make([]filter.Tiddler, len(tiddlers))
+	for i, t := range tiddlers {
+		var js filter.Tiddler
+		err := json.Unmarshal(t.Meta, &js)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if f.NeedsText() {
+			if !t.WithText {
+				title, _ := js["title"].(string)
+				t, err = Store.Get(r.Context(), title)
+				if err != nil && err != store.ErrNotFound {
+					internalError(w, err)
+					return
+				}
+			}
+			js["text"] = t.Text
+		}
+		fields[i] = js
+	}
+
+	selected := []store.Tiddler{}
+	for _, i := range f.Run(fields, time.Now()) {
+		selected = append(selected, tiddlers[i])
+	}
+	writeTiddlers(w, selected, splitFields(r.URL.Query().Get("fields")))
+}
+
+// listChanges serves the tiddlers changed and the titles of the tiddlers deleted
+// after the change with the sequence number since, along with the sequence number
+// of the latest change, which the client should pass as since the next time:
+//
+//	{"seq":42,"changed":[...skinny tiddlers...],"deleted":["title",...]}
+func listChanges(w http.ResponseWriter, r *http.Request, since string) {
+	seq, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || seq < 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	changes, last, err := Store.Since(r.Context(), seq)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	resp := struct {
+		Seq     int64           `json:"seq"`
+		Changed []store.Tiddler `json:"changed"`
+		Deleted []string        `json:"deleted"`
+	}{
+		Seq:     last,
+		Changed: []store.Tiddler{},
+		Deleted: []string{},
+	}
+	for _, c := range changes {
+		if c.Deleted {
+			resp.Deleted = append(resp.Deleted, c.Tiddler.Key)
+		} else {
+			resp.Changed = append(resp.Changed, c.Tiddler)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(tiddlers)
+	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
 		log.Println("ERR", err)
 	}
@@ -183,32 +467,76 @@ func putTiddler(w http.ResponseWriter, r *http.Request) {
 	}
 	io.Copy(ioutil.Discard, r.Body)
 
-	js["bag"] = "bag"
+	defer holdLocks()()
+	if holder := lockedBy(key, nil, username(r)); holder != "" {
+		http.Error(w, "locked by "+holder, http.StatusLocked)
+		return
+	}
 
-	text, _ := js["text"].(string)
-	delete(js, "text")
+	defer holdTitles(key)()
+	js, c, err := resolveEdit(r.Context(), key, baseRevision(r, js), js)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if c != nil {
+		writeConflict(w, c)
+		return
+	}
 
-	meta, err := json.Marshal(js)
+	t, err := tiddlerFromJSON(key, js)
 	if err != nil {
 		internalError(w, err)
 		return
 	}
 
-	rev, err := Store.Put(r.Context(), store.Tiddler{
-		Key:  key,
-		Meta: meta,
-		Text: text,
-	})
+	oldRev := currentRevision(r.Context(), key)
+	rev, err := Store.Put(r.Context(), t)
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	record(r, "put", key, oldRev, rev)
 
-	etag := fmt.Sprintf(`"bag/%s/%d:%032x"`, url.QueryEscape(key), rev, md5.Sum(meta))
-	w.Header().Set("ETag", etag)
+	w.Header().Set("ETag", etag(key, rev, t.Meta))
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// tiddlerFromJSON turns a fat tiddler as sent by TiddlyWeb into a store.Tiddler,
+// moving the content of binary tiddlers to the attachments.
+func tiddlerFromJSON(key string, js map[string]interface{}) (store.Tiddler, error) {
+	t, content, err := stageTiddler(key, js)
+	if err == nil && content != nil {
+		_, err = Attachments.Put(bytes.NewReader(content))
+	}
+	return t, err
+}
+
+// stageTiddler is like tiddlerFromJSON, but leaves the content of a binary
+// tiddler, if any, to be stored in the attachments by the caller.
+func stageTiddler(key string, js map[string]interface{}) (store.Tiddler, []byte, error) {
+	js["bag"] = "bag"
+	content := externalize(js)
+
+	text, _ := js["text"].(string)
+	delete(js, "text")
+
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return store.Tiddler{}, nil, err
+	}
+	return store.Tiddler{
+		Key:  key,
+		Meta: meta,
+		Text: text,
+	}, content, nil
+}
+
+// etag returns the ETag of a revision of a tiddler; TiddlyWeb extracts the revision from it.
+func etag(key string, rev int, meta []byte) string {
+	return fmt.Sprintf(`"bag/%s/%d:%032x"`, url.QueryEscape(key), rev, md5.Sum(meta))
+}
+
 func tiddler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
@@ -227,10 +555,18 @@ func remove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	key := strings.TrimPrefix(r.URL.Path, "/bags/bag/tiddlers/")
+	defer holdLocks()()
+	if holder := lockedBy(key, nil, username(r)); holder != "" {
+		http.Error(w, "locked by "+holder, http.StatusLocked)
+		return
+	}
+	defer holdTitles(key)()
+	oldRev := currentRevision(r.Context(), key)
 	err := Store.Delete(r.Context(), key)
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	record(r, "delete", key, oldRev, 0)
 	w.WriteHeader(http.StatusNoContent)
 }
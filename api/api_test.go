@@ -14,13 +14,29 @@
 package api
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/audit"
+	"github.com/opennota/widdly/replicate"
 	"github.com/opennota/widdly/store"
 )
 
@@ -29,6 +45,10 @@ type testStore struct {
 	all func(context.Context) ([]store.Tiddler, error)
 	put func(context.Context, store.Tiddler) (int, error)
 	del func(context.Context, string) error
+	chg func(context.Context, int64) ([]store.Change, int64, error)
+	rev func(context.Context, string, int) (store.Tiddler, error)
+	bat func(context.Context, []store.Op) ([]int, error)
+	lnk func(context.Context, store.LinkQuery) ([]store.Link, error)
 }
 
 func (ts *testStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
@@ -45,6 +65,19 @@ func (ts *testStore) All(ctx context.Context) ([]store.Tiddler, error) {
 	return ts.all(ctx)
 }
 
+func (ts *testStore) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
+	tiddlers, err := ts.All(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tiddlers {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ts *testStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
 	if ts.put == nil {
 		return 0, nil
@@ -59,6 +92,34 @@ func (ts *testStore) Delete(ctx context.Context, key string) error {
 	return ts.del(ctx, key)
 }
 
+func (ts *testStore) Since(ctx context.Context, seq int64) ([]store.Change, int64, error) {
+	if ts.chg == nil {
+		return nil, 0, nil
+	}
+	return ts.chg(ctx, seq)
+}
+
+func (ts *testStore) Revision(ctx context.Context, key string, rev int) (store.Tiddler, error) {
+	if ts.rev == nil {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return ts.rev(ctx, key, rev)
+}
+
+func (ts *testStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	if ts.bat == nil {
+		return make([]int, len(ops)), nil
+	}
+	return ts.bat(ctx, ops)
+}
+
+func (ts *testStore) Links(ctx context.Context, q store.LinkQuery) ([]store.Link, error) {
+	if ts.lnk == nil {
+		return nil, nil
+	}
+	return ts.lnk(ctx, q)
+}
+
 func TestIndex(t *testing.T) {
 	ServeIndex = func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/html")
@@ -101,8 +162,8 @@ func TestList(t *testing.T) {
 	Store = &testStore{
 		all: func(context.Context) ([]store.Tiddler, error) {
 			return []store.Tiddler{
-				{"tiddler1", []byte(`{"author":"robpike"}`), "", false},
-				{"tiddler2", []byte(`{"author":"bradfitz"}`), "text", false},
+				{Key: "tiddler1", Meta: []byte(`{"author":"robpike"}`)},
+				{Key: "tiddler2", Meta: []byte(`{"author":"bradfitz"}`), Text: "text"},
 			}, nil
 		},
 	}
@@ -122,6 +183,145 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListError(t *testing.T) {
+	Store = &testStore{
+		all: func(context.Context) ([]store.Tiddler, error) {
+			return nil, errors.New("disk on fire")
+		},
+	}
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+	w := httptest.NewRecorder()
+	list(w, r)
+	if w.Code != 500 {
+		t.Errorf("want 500 Internal Server Error, got %d", w.Code)
+	}
+
+	Store = &testStore{}
+	r = httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+	w = httptest.NewRecorder()
+	list(w, r)
+	if body := w.Body.String(); w.Code != 200 || body != "[]\n" {
+		t.Errorf("want an empty list, got %d %q", w.Code, body)
+	}
+}
+
+func TestListSince(t *testing.T) {
+	Store = &testStore{
+		chg: func(_ context.Context, seq int64) ([]store.Change, int64, error) {
+			if seq != 5 {
+				return nil, 0, errors.New("expected seq to be 5")
+			}
+			return []store.Change{
+				{Seq: 6, Tiddler: store.Tiddler{Key: "tiddler1"}, Deleted: true},
+				{Seq: 8, Tiddler: store.Tiddler{Key: "tiddler2", Meta: []byte(`{"title":"tiddler2"}`)}},
+			}, 8, nil
+		},
+	}
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json?since=5", nil)
+	w := httptest.NewRecorder()
+	list(w, r)
+	if w.Code != 200 {
+		t.Errorf("want 200 OK, got %d", w.Code)
+	}
+	body := strings.TrimRight(w.Body.String(), "\n")
+	if want := `{"seq":8,"changed":[{"title":"tiddler2"}],"deleted":["tiddler1"]}`; body != want {
+		t.Errorf("want %q, got %q", want, body)
+	}
+
+	r = httptest.NewRequest("GET", "/recipes/all/tiddlers.json?since=x", nil)
+	w = httptest.NewRecorder()
+	list(w, r)
+	if w.Code != 400 {
+		t.Errorf("want 400 Bad Request, got %d", w.Code)
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	Store = &testStore{
+		all: func(context.Context) ([]store.Tiddler, error) {
+			return []store.Tiddler{
+				{Meta: []byte(`{"title":"b","tags":["Project"],"modified":"20200102000000000"}`)},
+				{Meta: []byte(`{"title":"a","tags":["Project"],"modified":"20200101000000000"}`)},
+				{Meta: []byte(`{"title":"$:/c","tags":["Project"]}`)},
+				{Meta: []byte(`{"title":"d"}`)},
+			}, nil
+		},
+		get: func(_ context.Context, key string) (store.Tiddler, error) {
+			return store.Tiddler{Key: key, Text: "text of " + key, WithText: true}, nil
+		},
+	}
+	for _, tc := range []struct{ filter, want string }{
+		{"[tag[Project]!is[system]sort[modified]limit[20]]", `[{"title":"a","tags":["Project"],"modified":"20200101000000000"},{"title":"b","tags":["Project"],"modified":"20200102000000000"}]`},
+		{"[search[of d]]", `[{"title":"d"}]`},
+	} {
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json?filter="+url.QueryEscape(tc.filter), nil)
+		w := httptest.NewRecorder()
+		list(w, r)
+		if body := strings.TrimRight(w.Body.String(), "\n"); w.Code != 200 || body != tc.want {
+			t.Errorf("%s: want 200 %s, got %d %s", tc.filter, tc.want, w.Code, body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json?filter="+url.QueryEscape("[tag{x}]"), nil)
+	w := httptest.NewRecorder()
+	list(w, r)
+	if w.Code != 400 {
+		t.Errorf("want 400 Bad Request, got %d", w.Code)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	Store = &testStore{
+		all: func(context.Context) ([]store.Tiddler, error) {
+			return []store.Tiddler{
+				{Meta: []byte(`{"title":"c","modified":"2"}`)},
+				{Meta: []byte(`{"title":"a","modified":"3"}`)},
+				{Meta: []byte(`{"title":"d","modified":"1"}`)},
+				{Meta: []byte(`{"title":"b","modified":"2"}`)},
+			}, nil
+		},
+	}
+	get := func(target string) (string, string) {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		list(w, r)
+		if w.Code != 200 {
+			t.Fatalf("%s: want 200 OK, got %d", target, w.Code)
+		}
+		link := w.Header().Get("Link")
+		if link != "" {
+			link = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+		return strings.TrimRight(w.Body.String(), "\n"), link
+	}
+
+	body, next := get("/recipes/all/tiddlers.json?sort=-modified&limit=3&fields=title")
+	if want := `[{"title":"a"},{"title":"c"},{"title":"b"}]`; body != want {
+		t.Errorf("want %s, got %s", want, body)
+	}
+	if next == "" {
+		t.Fatal("want a link to the next page")
+	}
+	body, next = get(next)
+	if want := `[{"title":"d"}]`; body != want || next != "" {
+		t.Errorf("want %s and no next page, got %s %q", want, body, next)
+	}
+
+	body, _ = get("/recipes/all/tiddlers.json?offset=1&limit=2&fields=title,modified")
+	if want := `[{"modified":"2","title":"b"},{"modified":"2","title":"c"}]`; body != want {
+		t.Errorf("want %s, got %s", want, body)
+	}
+
+	for _, target := range []string{"?limit=-1", "?offset=x", "?cursor=x", "?sort=modified&cursor=" + encodeCursor("title", &store.Cursor{})} {
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json"+target, nil)
+		w := httptest.NewRecorder()
+		list(w, r)
+		if w.Code != 400 {
+			t.Errorf("%s: want 400 Bad Request, got %d", target, w.Code)
+		}
+	}
+}
+
 func TestGetTiddler(t *testing.T) {
 	Store = &testStore{
 		get: func(_ context.Context, key string) (store.Tiddler, error) {
@@ -129,7 +329,10 @@ func TestGetTiddler(t *testing.T) {
 				return store.Tiddler{}, nil
 			}
 			return store.Tiddler{
-				"tiddler2", []byte(`{"author":"bradfitz"}`), "text of the second tiddler", true,
+				Key:      "tiddler2",
+				Meta:     []byte(`{"author":"bradfitz"}`),
+				Text:     "text of the second tiddler",
+				WithText: true,
 			}, nil
 		},
 	}
@@ -186,6 +389,160 @@ func TestPutTiddler(t *testing.T) {
 	}
 }
 
+func TestPutStaleTiddler(t *testing.T) {
+	var saved store.Tiddler
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			return store.Tiddler{
+				Meta: []byte(`{"title":"tiddler2","tags":"a","revision":3}`),
+				Text: "one\nTWO\nthree\n",
+			}, nil
+		},
+		rev: func(_ context.Context, key string, rev int) (store.Tiddler, error) {
+			if rev != 2 {
+				return store.Tiddler{}, store.ErrNotFound
+			}
+			return store.Tiddler{
+				Meta: []byte(`{"title":"tiddler2","revision":2}`),
+				Text: "one\ntwo\nthree\n",
+			}, nil
+		},
+		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+			saved = tiddler
+			return 4, nil
+		},
+	}
+
+	// A non-conflicting edit based on revision 2 is merged with revision 3.
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{"title":"tiddler2","_base_revision":"2","text":"one\ntwo\nthree\nfour\n"}`))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != 204 {
+		t.Fatalf("want 204 No Content, got %d", w.Code)
+	}
+	if want := "one\nTWO\nthree\nfour\n"; saved.Text != want {
+		t.Errorf("want merged text %q, got %q", want, saved.Text)
+	}
+	if !strings.Contains(string(saved.Meta), `"tags":"a"`) {
+		t.Errorf("want the tags of revision 3 to be kept, got %s", saved.Meta)
+	}
+	if strings.Contains(string(saved.Meta), "_base_revision") {
+		t.Errorf("want the base revision not to be saved, got %s", saved.Meta)
+	}
+
+	// A conflicting edit is refused.
+	saved = store.Tiddler{}
+	r = httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{"title":"tiddler2","text":"one\nZWEI\nthree\n"}`))
+	r.Header.Set("If-Match", `"bag/tiddler2/2:0123456789abcdef0123456789abcdef"`)
+	w = httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != 409 {
+		t.Fatalf("want 409 Conflict, got %d", w.Code)
+	}
+	if saved.Key != "" {
+		t.Errorf("want nothing to be saved")
+	}
+	var c conflict
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	want := "one\n<<<<<<< revision 3\nTWO\n=======\nZWEI\n>>>>>>> your edit\nthree\n"
+	if c.Base != 2 || c.Revision != 3 || c.Tiddler["text"] != want || len(c.Conflicts) != 1 {
+		t.Errorf("unexpected conflict %+v", c)
+	}
+}
+
+func TestPutConsecutiveEdits(t *testing.T) {
+	// TiddlyWiki keeps sending the revision it loaded the tiddler at.
+	var history []store.Tiddler
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			if len(history) == 0 {
+				return store.Tiddler{}, store.ErrNotFound
+			}
+			return history[len(history)-1], nil
+		},
+		rev: func(_ context.Context, _ string, rev int) (store.Tiddler, error) {
+			if rev < 1 || rev > len(history) {
+				return store.Tiddler{}, store.ErrNotFound
+			}
+			return history[rev-1], nil
+		},
+		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+			rev := len(history) + 1
+			tiddler.Meta = []byte(fmt.Sprintf(`{"title":"T","revision":%d}`, rev))
+			history = append(history, tiddler)
+			return rev, nil
+		},
+	}
+	for i, body := range []string{
+		`{"title":"T","text":"x"}`,
+		`{"title":"T","revision":"1","text":"y"}`,
+		`{"title":"T","revision":"1","text":"z"}`,
+	} {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/T", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		if w.Code != 204 {
+			t.Fatalf("edit %d: want 204 No Content, got %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	if len(history) != 3 || history[2].Text != "z" {
+		t.Errorf("want the last edit saved as revision 3, got %d revisions", len(history))
+	}
+}
+
+func TestPutConcurrentStaleEdits(t *testing.T) {
+	// Edits based on the same revision, changing the same line.
+	var mu sync.Mutex
+	history := []store.Tiddler{{Meta: []byte(`{"title":"T","revision":1}`), Text: "one\n"}}
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return history[len(history)-1], nil
+		},
+		rev: func(_ context.Context, _ string, rev int) (store.Tiddler, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return history[rev-1], nil
+		},
+		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			rev := len(history) + 1
+			tiddler.Meta = []byte(fmt.Sprintf(`{"title":"T","revision":%d}`, rev))
+			history = append(history, tiddler)
+			return rev, nil
+		},
+	}
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/T", strings.NewReader(fmt.Sprintf(`{"title":"T","text":"%d\n"}`, i)))
+			r.Header.Set("If-Match", `"bag/T/1:0123456789abcdef0123456789abcdef"`)
+			w := httptest.NewRecorder()
+			tiddler(w, r)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	saved := 0
+	for _, code := range codes {
+		if code == 204 {
+			saved++
+		}
+	}
+	if saved != 1 || len(history) != 2 {
+		t.Errorf("want one edit saved and the others refused as conflicts, got %v and %d revisions", codes, len(history))
+	}
+}
+
 func TestDeleteTiddler(t *testing.T) {
 	delCalled := false
 	Store = &testStore{
@@ -207,3 +564,845 @@ func TestDeleteTiddler(t *testing.T) {
 		t.Errorf("expected Store.Delete to be called")
 	}
 }
+
+func TestCSRF(t *testing.T) {
+	Store = &testStore{}
+	h := withCSRF(remove)
+	for _, tc := range []struct {
+		header  bool
+		origin  string
+		referer string
+		want    int
+	}{
+		{false, "", "", 403},
+		{true, "", "", 204},
+		{true, "http://example.com", "", 204},
+		{true, "http://evil.com", "", 403},
+		{true, "null", "", 403},
+		{true, "", "http://example.com/#Tiddler", 204},
+		{true, "", "http://evil.com/", 403},
+		// The bundled TiddlyWiki does not send X-Requested-With.
+		{false, "http://example.com", "", 204},
+		{false, "", "http://example.com/", 204},
+		{false, "http://evil.com", "", 403},
+		{false, "", "http://evil.com/", 403},
+	} {
+		r := httptest.NewRequest("DELETE", "http://example.com/bags/bag/tiddlers/tiddler2", nil)
+		if tc.header {
+			r.Header.Set("X-Requested-With", "TiddlyWiki")
+		}
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.referer != "" {
+			r.Header.Set("Referer", tc.referer)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tc.want {
+			t.Errorf("header=%v origin=%q referer=%q: want %d, got %d", tc.header, tc.origin, tc.referer, tc.want, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/recipes/all/tiddlers/tiddler2", nil)
+	r.Header.Set("Origin", "http://evil.com")
+	w := httptest.NewRecorder()
+	withCSRF(tiddler)(w, r)
+	if w.Code != 200 {
+		t.Errorf("want GET to be allowed, got %d", w.Code)
+	}
+
+	for origin, want := range map[string]int{"http://example.com": 204, "http://evil.com": 403} {
+		r = httptest.NewRequest("PUT", "http://example.com/recipes/all/tiddlers/Saved", strings.NewReader(`{"title":"Saved","text":"x"}`))
+		r.Header.Set("Origin", origin)
+		w = httptest.NewRecorder()
+		withCSRF(tiddler)(w, r)
+		if w.Code != want {
+			t.Errorf("PUT without X-Requested-With from %s: want %d, got %d", origin, want, w.Code)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Audit, err = audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Audit.Close(); Audit = nil }()
+
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			return store.Tiddler{Meta: []byte(`{"revision":3}`)}, nil
+		},
+		put: func(context.Context, store.Tiddler) (int, error) {
+			return 4, nil
+		},
+	}
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{"text":"text"}`))
+	r.SetBasicAuth("alice", "")
+	tiddler(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("DELETE", "/bags/bag/tiddlers/tiddler2", nil)
+	r.SetBasicAuth("bob", "")
+	remove(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest("GET", "/admin/audit?user=alice&since=2000-01-01T00:00:00Z", nil)
+	r.SetBasicAuth("bob", "")
+	w := httptest.NewRecorder()
+	auditLog(w, r)
+	if w.Code != 403 {
+		t.Errorf("want 403 Forbidden without admins, got %d", w.Code)
+	}
+
+	Admins = []string{"bob"}
+	defer func() { Admins = nil }()
+	w = httptest.NewRecorder()
+	auditLog(w, r)
+	if w.Code != 200 {
+		t.Fatalf("want 200 OK, got %d", w.Code)
+	}
+	var entries []audit.Entry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("want 1 entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.User != "alice" || e.Action != "put" || e.Title != "tiddler2" || e.OldRevision != 3 || e.NewRevision != 4 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	r.SetBasicAuth("alice", "")
+	w = httptest.NewRecorder()
+	auditLog(w, r)
+	if w.Code != 403 {
+		t.Errorf("want 403 Forbidden for a non-admin, got %d", w.Code)
+	}
+}
+
+func TestAuditConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Audit, err = audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Audit.Close(); Audit = nil }()
+
+	var mu sync.Mutex
+	rev := 0
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return store.Tiddler{Meta: []byte(fmt.Sprintf(`{"revision":%d}`, rev))}, nil
+		},
+		put: func(context.Context, store.Tiddler) (int, error) {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			rev++
+			return rev, nil
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{"text":"text"}`))
+			tiddler(httptest.NewRecorder(), r)
+		}()
+	}
+	wg.Wait()
+
+	entries, err := Audit.Query(audit.Filter{})
+	if err != nil || len(entries) != 10 {
+		t.Fatalf("want 10 entries, got %d %v", len(entries), err)
+	}
+	for _, e := range entries {
+		if e.NewRevision != e.OldRevision+1 {
+			t.Errorf("want every write to replace the revision before it, got %d -> %d", e.OldRevision, e.NewRevision)
+		}
+	}
+}
+
+func TestReplicationWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Audit, err = audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Audit.Close(); Audit = nil }()
+
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			return store.Tiddler{Meta: []byte(`{"revision":3}`)}, nil
+		},
+		put: func(context.Context, store.Tiddler) (int, error) {
+			return 4, nil
+		},
+	}
+	hub.mu.Lock()
+	hub.locks["Locked"] = draftLock{client: &wsClient{}, user: "alice"}
+	hub.mu.Unlock()
+	defer func() {
+		hub.mu.Lock()
+		delete(hub.locks, "Locked")
+		hub.mu.Unlock()
+	}()
+
+	body := `{"changes":[{"title":"Locked","base":3,"tiddler":{"text":"x"}},{"title":"Free","base":3,"tiddler":{"text":"y"}}]}`
+	r := httptest.NewRequest("POST", "/replicate", strings.NewReader(body))
+	r.SetBasicAuth("bob", "")
+	w := httptest.NewRecorder()
+	replication(w, r)
+	var results []replicate.Result
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != "locked" || results[1].Status != "ok" {
+		t.Fatalf("want the locked tiddler refused and the other saved, got %+v", results)
+	}
+	entries, err := Audit.Query(audit.Filter{})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("want 1 entry, got %d %v", len(entries), err)
+	}
+	if e := entries[0]; e.Title != "Free" || e.User != "bob" || e.OldRevision != 3 || e.NewRevision != 4 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+type testCollector struct{ store.GCStats }
+
+func (c testCollector) GC(context.Context) (store.GCStats, error) {
+	return c.GCStats, nil
+}
+
+func TestCollectGarbage(t *testing.T) {
+	post := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/gc", nil)
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		r.SetBasicAuth(user, "")
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return w
+	}
+	Admins = []string{"alice"}
+	defer func() { Admins = nil }()
+	if w := post("alice"); w.Code != 404 {
+		t.Errorf("want 404 Not Found for a store without blobs, got %d", w.Code)
+	}
+
+	Collector = testCollector{store.GCStats{Blobs: 2, Removed: 1, Freed: 10}}
+	defer func() { Collector = nil }()
+	if w := post("bob"); w.Code != 403 {
+		t.Errorf("want 403 Forbidden for a non-admin, got %d", w.Code)
+	}
+	w := post("alice")
+	if want := `{"migrated":0,"blobs":2,"removed":1,"freed":10}`; w.Code != 200 || strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("want %s, got %d %s", want, w.Code, w.Body)
+	}
+}
+
+func TestTakeBackup(t *testing.T) {
+	post := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/backup", nil)
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		r.SetBasicAuth(user, "")
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return w
+	}
+	Admins = []string{"alice"}
+	defer func() { Admins = nil }()
+	if w := post("alice"); w.Code != 404 {
+		t.Errorf("want 404 Not Found without -backup-dir, got %d", w.Code)
+	}
+
+	Backup = func(context.Context) (string, error) {
+		return "/var/backups/widdly-2026-10-16T120000Z.tar.gz", nil
+	}
+	defer func() { Backup = nil }()
+	if w := post("bob"); w.Code != 403 {
+		t.Errorf("want 403 Forbidden for a non-admin, got %d", w.Code)
+	}
+	w := post("alice")
+	if want := `{"backup":"widdly-2026-10-16T120000Z.tar.gz"}`; w.Code != 200 || strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("want %s, got %d %s", want, w.Code, w.Body)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	Events = store.NewBroadcaster(&testStore{
+		put: func(context.Context, store.Tiddler) (int, error) {
+			return 7, nil
+		},
+	})
+	defer func() { Events = nil }()
+	srv := httptest.NewServer(http.HandlerFunc(events))
+	defer srv.Close()
+
+	readEvent := func(sc *bufio.Scanner) (lines []string) {
+		for sc.Scan() && sc.Text() != "" {
+			lines = append(lines, sc.Text())
+		}
+		return lines
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("want text/event-stream, got %v", ct)
+	}
+
+	Events.Put(context.Background(), store.Tiddler{Key: "tiddler2", Meta: []byte(`{"modifier":"bradfitz"}`)})
+	Events.Delete(context.Background(), "tiddler1")
+
+	sc := bufio.NewScanner(resp.Body)
+	put := readEvent(sc)
+	if len(put) != 3 || put[1] != "event: put" || !strings.Contains(put[2], `"title":"tiddler2","revision":7,"modifier":"bradfitz"`) {
+		t.Errorf("unexpected put event %q", put)
+	}
+	del := readEvent(sc)
+	if len(del) != 3 || del[1] != "event: delete" {
+		t.Errorf("unexpected delete event %q", del)
+	}
+
+	// Resume after the put event.
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Last-Event-ID", strings.TrimPrefix(put[0], "id: "))
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if missed := readEvent(bufio.NewScanner(resp2.Body)); len(missed) != 3 || missed[0] != del[0] {
+		t.Errorf("want the delete event to be replayed, got %q", missed)
+	}
+
+	// Resume from an unknown event.
+	req.Header.Set("Last-Event-ID", "1")
+	resp3, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp3.Body.Close()
+	if resync := readEvent(bufio.NewScanner(resp3.Body)); len(resync) == 0 || resync[0] != "event: resync" {
+		t.Errorf("want a resync event, got %q", resync)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	Events = store.NewBroadcaster(&testStore{
+		put: func(context.Context, store.Tiddler) (int, error) {
+			return 2, nil
+		},
+	})
+	Store = Events
+	defer func() { Events = nil }()
+	srv := httptest.NewServer(http.HandlerFunc(ws))
+	defer srv.Close()
+
+	dial := func(user string) *websocket.Conn {
+		h := make(http.Header)
+		if user != "" {
+			h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":pass")))
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var m wsMessage
+		if err := conn.ReadJSON(&m); err != nil || m.Type != "presence" {
+			t.Fatalf("want initial presence, got %+v (%v)", m, err)
+		}
+		return conn
+	}
+	// next returns the next message of the given type, skipping the others.
+	next := func(conn *websocket.Conn, typ string) wsMessage {
+		for {
+			var m wsMessage
+			if err := conn.ReadJSON(&m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Type == typ {
+				return m
+			}
+		}
+	}
+	alice, bob, anon := dial("alice"), dial("bob"), dial("")
+	defer alice.Close()
+	defer bob.Close()
+	defer anon.Close()
+
+	bob.WriteJSON(wsMessage{Type: "editing", Title: "tiddler2"})
+	if m := next(alice, "presence"); len(m.Editors["tiddler2"]) != 1 {
+		t.Errorf("want one editor of tiddler2, got %v", m.Editors)
+	}
+
+	alice.WriteJSON(wsMessage{Type: "lock", ID: "1", Title: "tiddler2"})
+	if m := next(alice, "ok"); m.ID != "1" {
+		t.Errorf("want the lock to be granted, got %+v", m)
+	}
+	next(bob, "lock")
+
+	bob.WriteJSON(wsMessage{Type: "put", ID: "2", Title: "tiddler2", Tiddler: map[string]interface{}{"text": "clobber"}})
+	if m := next(bob, "error"); m.ID != "2" || m.Error != "locked by alice" {
+		t.Errorf("want the save to be refused, got %+v", m)
+	}
+	anon.WriteJSON(wsMessage{Type: "delete", ID: "2", Title: "tiddler2"})
+	if m := next(anon, "error"); m.ID != "2" || m.Error != "locked by alice" {
+		t.Errorf("want the anonymous delete to be refused, got %+v", m)
+	}
+	anon.WriteJSON(wsMessage{Type: "lock", ID: "2", Title: "tiddler3"})
+	if m := next(anon, "error"); m.ID != "2" {
+		t.Errorf("want anonymous locking to be refused, got %+v", m)
+	}
+	SharedUser = true
+	bob.WriteJSON(wsMessage{Type: "lock", ID: "3", Title: "tiddler3"})
+	if m := next(bob, "error"); m.ID != "3" {
+		t.Errorf("want locking to be refused when the users share a name, got %+v", m)
+	}
+	SharedUser = false
+
+	alice.WriteJSON(wsMessage{Type: "put", ID: "3", Title: "tiddler2", Tiddler: map[string]interface{}{"text": "text"}})
+	if m := next(alice, "ok"); m.ID != "3" || m.Revision != 2 {
+		t.Errorf("want the save to succeed, got %+v", m)
+	}
+	if m := next(bob, "put"); m.Title != "tiddler2" || m.Revision != 2 {
+		t.Errorf("want a change notification, got %+v", m)
+	}
+
+	alice.Close()
+	if m := next(bob, "unlock"); m.Title != "tiddler2" {
+		t.Errorf("want the lock to be released on disconnect, got %+v", m)
+	}
+}
+
+func TestWebSocketSlowClient(t *testing.T) {
+	c := &wsClient{send: make(chan wsMessage), gone: make(chan struct{})}
+	hub.mu.Lock()
+	hub.clients[c] = struct{}{}
+	broadcast(wsMessage{Type: "unlock", Title: "x"})
+	_, ok := hub.clients[c]
+	hub.mu.Unlock()
+	if ok {
+		t.Error("want a client which can't keep up to be dropped")
+	}
+	select {
+	case <-c.gone:
+	default:
+		t.Error("want a client which can't keep up to be disconnected")
+	}
+}
+
+func TestBulk(t *testing.T) {
+	var applied []store.Op
+	Store = &testStore{
+		bat: func(_ context.Context, ops []store.Op) ([]int, error) {
+			for i, op := range ops {
+				if op.Delete && op.Tiddler.Key == "Missing" {
+					return nil, &store.BatchError{Index: i, Err: store.ErrNotFound}
+				}
+			}
+			applied = ops
+			return []int{3, 0}, nil
+		},
+	}
+	post := func(body string) (int, []bulkResult) {
+		r := httptest.NewRequest("POST", "/bulk", strings.NewReader(body))
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		var results []bulkResult
+		json.Unmarshal(w.Body.Bytes(), &results)
+		return w.Code, results
+	}
+
+	code, results := post(`[{"op":"put","tiddler":{"title":"New","text":"hi","revision":"7"}},{"op":"delete","title":"Old"}]`)
+	if code != 200 || len(results) != 2 || results[0].Status != "ok" || results[0].Revision != 3 || results[1].Status != "ok" {
+		t.Fatalf("want both applied, got %d %+v", code, results)
+	}
+	if len(applied) != 2 || applied[0].Tiddler.Key != "New" || applied[0].Tiddler.Text != "hi" ||
+		strings.Contains(string(applied[0].Tiddler.Meta), "revision") || !applied[1].Delete || applied[1].Tiddler.Key != "Old" {
+		t.Errorf("wrong operations: %+v", applied)
+	}
+
+	applied = nil
+	code, results = post(`[{"op":"put","tiddler":{"title":"New"}},{"op":"rename","title":"X"}]`)
+	if code != http.StatusUnprocessableEntity || results[0].Status != "skipped" || results[1].Status != "failed" || applied != nil {
+		t.Errorf("want an invalid operation to fail the batch, got %d %+v", code, results)
+	}
+
+	code, results = post(`[{"op":"put","tiddler":{"title":"New"}},{"op":"delete","title":"Missing"}]`)
+	if code != http.StatusUnprocessableEntity || results[0].Status != "skipped" || results[1].Status != "failed" || results[1].Error != "not found" {
+		t.Errorf("want a failed operation to fail the batch, got %d %+v", code, results)
+	}
+
+	dir, err := ioutil.TempDir("", "widdly-bulk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Attachments = attach.Dir(dir)
+	defer func() { Attachments = "" }()
+	image := `{"op":"put","tiddler":{"title":"Image","type":"image/png","text":"iVBORw0KGgo="}}`
+	hash := attach.Hash([]byte("\x89PNG\r\n\x1a\n"))
+	if code, _ := post(`[` + image + `,{"op":"delete","title":"Missing"}]`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("want the batch to fail, got %d", code)
+	}
+	if _, err := Attachments.Open(hash); !os.IsNotExist(err) {
+		t.Errorf("want no attachment stored for a failed batch, got %v", err)
+	}
+	if code, _ := post(`[` + image + `,{"op":"delete","title":"Old"}]`); code != 200 {
+		t.Fatalf("want the batch to be applied, got %d", code)
+	}
+	if f, err := Attachments.Open(hash); err != nil {
+		t.Errorf("want the attachment stored, got %v", err)
+	} else {
+		f.Close()
+	}
+	if !strings.Contains(string(applied[0].Tiddler.Meta), hash) {
+		t.Errorf("want the tiddler to point to the attachment, got %s", applied[0].Tiddler.Meta)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	links := []store.Link{
+		{From: "a", To: "b", Kind: "link"},
+		{From: "a", To: "x", Kind: "transclusion"},
+		{From: "b", To: "b", Kind: "link"},
+		{From: "b", To: "Tag", Kind: "tag"},
+	}
+	Store = &testStore{
+		all: func(context.Context) ([]store.Tiddler, error) {
+			return []store.Tiddler{
+				{Meta: []byte(`{"title":"b"}`)},
+				{Meta: []byte(`{"title":"a"}`)},
+				{Meta: []byte(`{"title":"$:/s"}`)},
+			}, nil
+		},
+		lnk: func(_ context.Context, q store.LinkQuery) ([]store.Link, error) {
+			var out []store.Link
+			for _, l := range links {
+				if q.Match(l) {
+					out = append(out, l)
+				}
+			}
+			return out, nil
+		},
+	}
+	get := func(target string) (int, string) {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return w.Code, strings.TrimRight(w.Body.String(), "\n")
+	}
+
+	code, body := get("/tiddlers/b/backlinks")
+	if want := `[{"from":"a","to":"b","kind":"link"},{"from":"b","to":"b","kind":"link"}]`; code != 200 || body != want {
+		t.Errorf("backlinks: want %s, got %d %s", want, code, body)
+	}
+	code, body = get("/tiddlers/a/links")
+	if want := `[{"from":"a","to":"b","kind":"link"},{"from":"a","to":"x","kind":"transclusion"}]`; code != 200 || body != want {
+		t.Errorf("links: want %s, got %d %s", want, code, body)
+	}
+	if code, _ = get("/tiddlers/a"); code != 404 {
+		t.Errorf("want 404 Not Found, got %d", code)
+	}
+
+	code, body = get("/links")
+	var graph struct {
+		Tiddlers, Missing, Orphans []string
+	}
+	json.Unmarshal([]byte(body), &graph)
+	if code != 200 || strings.Join(graph.Tiddlers, ",") != "$:/s,a,b" ||
+		strings.Join(graph.Missing, ",") != "x" || strings.Join(graph.Orphans, ",") != "a" {
+		t.Errorf("unexpected graph: %d %s", code, body)
+	}
+}
+
+func TestTags(t *testing.T) {
+	links := []store.Link{
+		{From: "a", To: "b", Kind: "link"},
+		{From: "a", To: "Project", Kind: "tag"},
+		{From: "c", To: "Project", Kind: "tag"},
+		{From: "c", To: "To do", Kind: "tag"},
+	}
+	Store = &testStore{
+		lnk: func(_ context.Context, q store.LinkQuery) ([]store.Link, error) {
+			var out []store.Link
+			for _, l := range links {
+				if q.Match(l) {
+					out = append(out, l)
+				}
+			}
+			return out, nil
+		},
+	}
+	get := func(target string) (int, string) {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return w.Code, strings.TrimRight(w.Body.String(), "\n")
+	}
+
+	code, body := get("/tags")
+	if want := `[{"tag":"Project","count":2},{"tag":"To do","count":1}]`; code != 200 || body != want {
+		t.Errorf("tags: want %s, got %d %s", want, code, body)
+	}
+	code, body = get("/tags/Project/tiddlers")
+	if want := `["a","c"]`; code != 200 || body != want {
+		t.Errorf("tagged: want %s, got %d %s", want, code, body)
+	}
+	code, body = get("/tags/b/tiddlers")
+	if code != 200 || body != `[]` {
+		t.Errorf("want no tiddlers tagged with a link target, got %d %s", code, body)
+	}
+	if code, _ = get("/tags/Project"); code != 404 {
+		t.Errorf("want 404 Not Found, got %d", code)
+	}
+}
+
+func TestRender(t *testing.T) {
+	Store = &testStore{
+		get: func(_ context.Context, key string) (store.Tiddler, error) {
+			switch key {
+			case "a/b":
+				return store.Tiddler{Meta: []byte(`{"title":"a/b"}`), Text: "See [[c d]] and {{e}}", WithText: true}, nil
+			case "e":
+				return store.Tiddler{Meta: []byte(`{"title":"e"}`), Text: "''E''", WithText: true}, nil
+			}
+			return store.Tiddler{}, store.ErrNotFound
+		},
+	}
+	r := httptest.NewRequest("GET", "/render/a%2Fb", nil)
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	want := `<p>See <a class="tc-tiddlylink tc-tiddlylink-missing" href="/render/c%20d">c d</a> and <strong>E</strong></p>`
+	if w.Code != 200 || !strings.Contains(w.Body.String(), want) || !strings.Contains(w.Body.String(), "<h1>a/b</h1>") {
+		t.Errorf("want a page with %s, got %d %s", want, w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest("GET", "/render/missing", nil)
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Errorf("want 404 Not Found, got %d", w.Code)
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	tiddlers := map[string]store.Tiddler{
+		"Old":      {Meta: []byte(`{"title":"Old","modified":"20200101000000000","tags":"News"}`), Text: "old\n\n{{Pic}}"},
+		"Pic":      {Meta: []byte(`{"title":"Pic","type":"image/png","_canonical_uri":"/files/0123.png"}`)},
+		"New":      {Meta: []byte(`{"title":"New","modified":"20201010120000000","modifier":"bob","tags":"News"}`), Text: "''new''"},
+		"Other":    {Meta: []byte(`{"title":"Other","modified":"20200505000000000","creator":"ann"}`), Text: "other"},
+		"$:/s":     {Meta: []byte(`{"title":"$:/s","modified":"20211010120000000"}`)},
+		"No dates": {Meta: []byte(`{"title":"No dates"}`)},
+	}
+	Store = &testStore{
+		all: func(context.Context) ([]store.Tiddler, error) {
+			var all []store.Tiddler
+			for _, t := range tiddlers {
+				all = append(all, t)
+			}
+			return all, nil
+		},
+		get: func(_ context.Context, key string) (store.Tiddler, error) {
+			t, ok := tiddlers[key]
+			if !ok {
+				return store.Tiddler{}, store.ErrNotFound
+			}
+			t.WithText = true
+			return t, nil
+		},
+		lnk: func(_ context.Context, q store.LinkQuery) ([]store.Link, error) {
+			var out []store.Link
+			for _, t := range tiddlers {
+				for _, l := range store.ParseLinks(t) {
+					if q.Match(l) {
+						out = append(out, l)
+					}
+				}
+			}
+			return out, nil
+		},
+	}
+	get := func(target string) (int, string) {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	var feed struct {
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Entries []struct {
+			Title   string `xml:"title"`
+			ID      string `xml:"id"`
+			Updated string `xml:"updated"`
+			Author  string `xml:"author>name"`
+			Summary string `xml:"summary"`
+		} `xml:"entry"`
+	}
+	code, body := get("/feeds/recent.atom")
+	if err := xml.Unmarshal([]byte(body), &feed); code != 200 || err != nil {
+		t.Fatalf("want a feed, got %d %v %s", code, err, body)
+	}
+	if len(feed.Entries) != 3 || feed.Entries[0].Title != "New" || feed.Entries[1].Title != "Other" || feed.Entries[2].Title != "Old" {
+		t.Fatalf("want New, Other and Old, got %s", body)
+	}
+	e := feed.Entries[0]
+	if feed.Updated != "2020-10-10T12:00:00Z" || e.Updated != feed.Updated || e.Author != "bob" ||
+		e.ID != "http://example.com/render/New" || e.Summary != "<p><strong>new</strong></p>\n" {
+		t.Errorf("unexpected entry: %s", body)
+	}
+	if feed.Entries[1].Author != "ann" || feed.Entries[2].Author != "widdly" {
+		t.Errorf("want the creator, or else widdly, as the author, got %s", body)
+	}
+	if want := `<img src="http://example.com/files/0123.png">`; !strings.Contains(feed.Entries[2].Summary, want) {
+		t.Errorf("want the attachment at an absolute URL, got %s", feed.Entries[2].Summary)
+	}
+
+	feed.Entries = nil
+	code, body = get("/feeds/tag/News.atom")
+	if err := xml.Unmarshal([]byte(body), &feed); code != 200 || err != nil {
+		t.Fatalf("want a feed, got %d %v %s", code, err, body)
+	}
+	if feed.Title != "Tagged News" || len(feed.Entries) != 2 || feed.Entries[0].Title != "New" || feed.Entries[1].Title != "Old" {
+		t.Errorf("want New and Old, got %s", body)
+	}
+
+	if code, _ = get("/feeds/tag/.atom"); code != 404 {
+		t.Errorf("want 404 Not Found, got %d", code)
+	}
+}
+
+func TestPutBulkTitle(t *testing.T) {
+	var saved string
+	Store = &testStore{
+		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+			saved = tiddler.Key
+			return 1, nil
+		},
+	}
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/_bulk", strings.NewReader(`{"text":"a tiddler"}`))
+	r.Header.Set("X-Requested-With", "TiddlyWiki")
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	if w.Code != 204 || saved != "_bulk" {
+		t.Errorf("want a tiddler titled _bulk to be saved, got %d %q", w.Code, saved)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Attachments = attach.Dir(dir)
+	defer func() { Attachments = "" }()
+
+	var saved store.Tiddler
+	Store = &testStore{
+		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+			saved = tiddler
+			return 1, nil
+		},
+	}
+	const hash = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // of "hello"
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/image", strings.NewReader(`{"title":"image","type":"image/png","text":"aGVsbG8="}`))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if want := `{"_canonical_uri":"/files/` + hash + `.png","bag":"bag","title":"image","type":"image/png"}`; w.Code != 204 || string(saved.Meta) != want || saved.Text != "" {
+		t.Errorf("want %s with no text, got %d %s %q", want, w.Code, saved.Meta, saved.Text)
+	}
+
+	r = httptest.NewRequest("GET", "/files/"+hash+".png", nil)
+	r.Header.Set("Range", "bytes=1-3")
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	if w.Code != 206 || w.Body.String() != "ell" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("want 206 Partial Content with ell as image/png, got %d %q %s", w.Code, w.Body, w.Header().Get("Content-Type"))
+	}
+
+	r = httptest.NewRequest("POST", "/files/", strings.NewReader("%PDF-"))
+	r.Header.Set("Content-Type", "application/pdf")
+	r.Header.Set("X-Requested-With", "TiddlyWiki")
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	var resp struct{ Hash, URI, Type string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 201 || resp.URI != "/files/"+resp.Hash+".pdf" || w.Header().Get("Location") != resp.URI {
+		t.Errorf("want 201 Created with the URI, got %d %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/files/" + strings.Repeat("0", 64), "/files/../etc/passwd", "/files/x"} {
+		r = httptest.NewRequest("GET", path, nil)
+		w = httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		if w.Code != 404 && w.Code != 301 {
+			t.Errorf("%s: want 404 Not Found, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "a.svg"), []byte("<svg></svg>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".secret"), []byte("secret"), 0644)
+	Files = http.Dir(dir)
+	defer func() { Files = nil }()
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/files/sub/a.svg")
+	if w.Code != 200 || w.Body.String() != "<svg></svg>" || w.Header().Get("Content-Type") != "image/svg+xml" ||
+		w.Header().Get("Cache-Control") != "private, no-cache" || w.Header().Get("Last-Modified") == "" {
+		t.Errorf("unexpected response: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	if w = get("/files/sub/a.svg", "Range", "bytes=0-3"); w.Code != 206 || w.Body.String() != "<svg" {
+		t.Errorf("want 206 Partial Content with <svg, got %d %s", w.Code, w.Body)
+	}
+	if w = get("/files/sub/a.svg", "If-Modified-Since", w.Header().Get("Last-Modified")); w.Code != 304 {
+		t.Errorf("want 304 Not Modified, got %d", w.Code)
+	}
+	for _, path := range []string{"/files/sub/", "/files/sub", "/files/.secret", "/files/missing"} {
+		if w = get(path); w.Code != 404 {
+			t.Errorf("%s: want 404 Not Found, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/opennota/widdly/audit"
+)
+
+var (
+	// Audit, if not nil, records every change made to the wiki.
+	Audit *audit.Log
+
+	// Admins lists the users allowed to query the audit log.
+	// If it is empty, nobody is allowed.
+	Admins []string
+)
+
+func init() {
+	http.HandleFunc("/admin/audit", withLoggingAndAuth(auditLog))
+}
+
+// currentRevision returns the current revision of the tiddler, or 0 if
+// there is no such tiddler or the audit log is disabled. It must be called
+// under holdTitles, so that the revision is the one the write replaces.
+func currentRevision(ctx context.Context, key string) int {
+	if Audit == nil {
+		return 0
+	}
+	t, err := Store.Get(ctx, key)
+	if err != nil {
+		return 0
+	}
+	return t.Revision()
+}
+
+// record writes an entry to the audit log, if it is enabled.
+func record(r *http.Request, action, title string, oldRev, newRev int) {
+	if Audit == nil {
+		return
+	}
+	err := Audit.Record(audit.Entry{
+		Time:        time.Now().UTC(),
+		User:        username(r),
+		IP:          ClientIP(r),
+		Action:      action,
+		Title:       title,
+		OldRevision: oldRev,
+		NewRevision: newRev,
+	})
+	if err != nil {
+		log.Println("ERR audit:", err)
+	}
+}
+
+// isAdmin returns true iff the user making the request may access the admin endpoints.
+func isAdmin(r *http.Request) bool {
+	user := username(r)
+	if user == "" {
+		return false
+	}
+	for _, a := range Admins {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+// auditLog serves the entries of the audit log as JSON.
+// The entries can be filtered by the since, until (both RFC 3339) and user parameters.
+func auditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if Audit == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	f := audit.Filter{User: q.Get("user")}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+
+	entries, err := Audit.Query(f)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
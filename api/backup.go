@@ -0,0 +1,61 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// Backup, if not nil, takes a backup of the wiki through the running store
+// on POST /admin/backup and returns the path to the backup.
+var Backup func(ctx context.Context) (string, error)
+
+func init() {
+	http.HandleFunc("/admin/backup", withLoggingAndAuth(withCSRF(takeBackup)))
+}
+
+// takeBackup takes a backup while the store is in use, which the backup
+// command can do only for SQLite, and responds with the name of the backup:
+//
+//	{"backup":"widdly-2026-10-16T120000Z.tar.gz"}
+func takeBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if Backup == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	name, err := Backup(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{"backup": filepath.Base(name)})
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
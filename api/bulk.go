@@ -0,0 +1,157 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/opennota/widdly/store"
+)
+
+func init() {
+	http.HandleFunc("/bulk", withLoggingAndAuth(withCSRF(bulk)))
+}
+
+// bulkOp is an operation of a bulk request.
+type bulkOp struct {
+	Op      string                 `json:"op"`              // "put" or "delete"
+	Title   string                 `json:"title,omitempty"` // The title of the tiddler to delete; taken from the tiddler for puts
+	Tiddler map[string]interface{} `json:"tiddler,omitempty"`
+}
+
+// bulkResult is the outcome of an operation of a bulk request.
+type bulkResult struct {
+	Title    string `json:"title"`
+	Status   string `json:"status"` // "ok", "failed", or "skipped" if another operation failed
+	Revision int    `json:"revision,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// bulk applies an array of puts and deletes atomically: either all of them
+// are applied, or none is. It responds with a result for every operation,
+// with 200 OK if the operations have been applied, or 422 Unprocessable Entity
+// if any of them has failed, in which case nothing has been changed. The
+// attachments of binary tiddlers are stored only once the batch is applied.
+func bulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req []bulkOp
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	defer holdLocks()()
+	user := username(r)
+	ops := make([]store.Op, len(req))
+	var contents [][]byte // The attachments, stored once the batch is applied
+	results := make([]bulkResult, len(req))
+	failed := false
+	for i, op := range req {
+		res := &results[i]
+		res.Status = "skipped"
+		if op.Op == "put" {
+			res.Title, _ = op.Tiddler["title"].(string)
+		} else {
+			res.Title = op.Title
+		}
+		switch {
+		case op.Op != "put" && op.Op != "delete":
+			res.Error = "unknown operation"
+		case res.Title == "":
+			res.Error = "no title"
+		default:
+			if holder := lockedBy(res.Title, nil, user); holder != "" {
+				res.Error = "locked by " + holder
+			}
+		}
+		if res.Error != "" {
+			res.Status = "failed"
+			failed = true
+			continue
+		}
+
+		if op.Op == "delete" {
+			ops[i] = store.Op{Tiddler: store.Tiddler{Key: res.Title}, Delete: true}
+			continue
+		}
+		delete(op.Tiddler, "revision")
+		t, content, err := stageTiddler(res.Title, op.Tiddler)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if content != nil {
+			contents = append(contents, content)
+		}
+		ops[i] = store.Op{Tiddler: t}
+	}
+
+	var revs []int
+	if !failed {
+		keys := make([]string, len(ops))
+		for i, op := range ops {
+			keys[i] = op.Tiddler.Key
+		}
+		defer holdTitles(keys...)()
+		revisions := make(map[string]int) // The revisions before the batch, then as the batch goes
+		for _, op := range ops {
+			if _, ok := revisions[op.Tiddler.Key]; !ok {
+				revisions[op.Tiddler.Key] = currentRevision(r.Context(), op.Tiddler.Key)
+			}
+		}
+		revs, err = Store.Batch(r.Context(), ops)
+		if be, ok := err.(*store.BatchError); ok {
+			results[be.Index].Status = "failed"
+			results[be.Index].Error = be.Err.Error()
+			failed = true
+		} else if err != nil {
+			internalError(w, err)
+			return
+		} else {
+			for i, op := range ops {
+				key := op.Tiddler.Key
+				results[i].Status = "ok"
+				results[i].Revision = revs[i]
+				if op.Delete {
+					record(r, "delete", key, revisions[key], 0)
+				} else {
+					record(r, "put", key, revisions[key], revs[i])
+				}
+				revisions[key] = revs[i]
+			}
+			for _, content := range contents {
+				if _, err := Attachments.Put(bytes.NewReader(content)); err != nil {
+					internalError(w, err)
+					return
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if failed {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
@@ -0,0 +1,245 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opennota/widdly/store"
+)
+
+// feedSize is the number of tiddlers in a feed.
+const feedSize = 20
+
+func init() {
+	http.HandleFunc("/feeds/", withLoggingAndAuth(feed))
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Link    atomLink   `xml:"link"`
+	Summary atomText   `xml:"summary"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedItem is a tiddler to be listed in a feed.
+type feedItem struct {
+	title    string
+	modifier string
+	modified time.Time
+}
+
+// parseFeedItem returns the feed item of the tiddler with the given meta,
+// or false if the tiddler is not to be listed: if it is a system tiddler or
+// a draft, or if it has neither the modified nor the created date.
+func parseFeedItem(meta []byte) (feedItem, bool) {
+	var js struct {
+		Title    string `json:"title"`
+		Modifier string `json:"modifier"`
+		Creator  string `json:"creator"`
+		Modified string `json:"modified"`
+		Created  string `json:"created"`
+		DraftOf  string `json:"draft.of"`
+	}
+	if json.Unmarshal(meta, &js) != nil || strings.HasPrefix(js.Title, "$:/") || js.DraftOf != "" {
+		return feedItem{}, false
+	}
+	item := feedItem{title: js.Title, modifier: js.Modifier}
+	if item.modifier == "" {
+		item.modifier = js.Creator
+	}
+	if item.modifier == "" {
+		item.modifier = "widdly" // An Atom author must have a name.
+	}
+	date := js.Modified
+	if date == "" {
+		date = js.Created
+	}
+	if len(date) < 14 {
+		return feedItem{}, false
+	}
+	t, err := time.Parse("20060102150405", date[:14])
+	if err != nil {
+		return feedItem{}, false
+	}
+	item.modified = t
+	return item, true
+}
+
+// recentItems returns the feedSize most recently modified tiddlers,
+// listing the store sorted by the modified field.
+func recentItems(ctx context.Context) ([]feedItem, error) {
+	var items []feedItem
+	opts := store.ListOptions{Sort: "-modified", Limit: feedSize}
+	for len(items) < feedSize {
+		page, err := store.List(ctx, Store, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page {
+			if item, ok := parseFeedItem(t.Meta); ok && len(items) < feedSize {
+				items = append(items, item)
+			}
+		}
+		if len(page) < opts.Limit {
+			break
+		}
+		opts.After = store.CursorOf(page[len(page)-1], "modified")
+	}
+	return items, nil
+}
+
+// taggedItems returns the feedSize most recently modified tiddlers tagged with tag.
+func taggedItems(ctx context.Context, tag string) ([]feedItem, error) {
+	titles, err := store.Tagged(ctx, Store, tag)
+	if err != nil {
+		return nil, err
+	}
+	var items []feedItem
+	for _, title := range titles {
+		t, err := Store.Get(ctx, title)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if item, ok := parseFeedItem(t.Meta); ok {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].modified.After(items[j].modified) })
+	if len(items) > feedSize {
+		items = items[:feedSize]
+	}
+	return items, nil
+}
+
+// baseURL returns the URL the wiki is served at, as seen by the client.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if peer, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && isTrustedProxy(peer) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	host := Host
+	if host == "" {
+		host = r.Host
+	}
+	return scheme + "://" + host
+}
+
+// feed serves an Atom feed of the recently modified tiddlers
+// (/feeds/recent.atom) or of those tagged with a tag (/feeds/tag/{tag}.atom),
+// newest first, with their text rendered to HTML.
+func feed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	var items []feedItem
+	var err error
+	var title string
+	switch {
+	case path == "recent.atom":
+		title = "Recent changes"
+		items, err = recentItems(r.Context())
+	case strings.HasPrefix(path, "tag/") && strings.HasSuffix(path, ".atom") && len(path) > len("tag/.atom"):
+		tag := strings.TrimSuffix(strings.TrimPrefix(path, "tag/"), ".atom")
+		title = "Tagged " + tag
+		items, err = taggedItems(r.Context(), tag)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	base := baseURL(r)
+	rr, lookupErr := newRenderer(r.Context(), base+"/render/")
+	f := atomFeed{
+		Title:   title,
+		ID:      base + (&url.URL{Path: r.URL.Path}).String(),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: base + "/"},
+	}
+	if len(items) > 0 {
+		f.Updated = items[0].modified.Format(time.RFC3339)
+	}
+	for _, item := range items {
+		body, _ := rr.Render(item.title)
+		if err := lookupErr(); err != nil {
+			internalError(w, err)
+			return
+		}
+		u := rr.URL(item.title)
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   item.title,
+			ID:      u,
+			Updated: item.modified.Format(time.RFC3339),
+			Author:  atomAuthor{Name: item.modifier},
+			Link:    atomLink{Href: u, Rel: "alternate"},
+			Summary: atomText{Type: "html", Body: body},
+		})
+	}
+
+	data, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := w.Write(append([]byte(xml.Header), data...)); err != nil {
+		log.Println("ERR", err)
+	}
+}
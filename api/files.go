@@ -0,0 +1,222 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/opennota/widdly/attach"
+)
+
+// maxUpload is the maximum size of an uploaded file.
+const maxUpload = 64 << 20
+
+var (
+	// Attachments is the store of the binary attachments of tiddlers.
+	// If it is set, the content of binary tiddlers (images and the like)
+	// is moved there on save, and the tiddlers get a _canonical_uri
+	// pointing at /files/{hash} instead.
+	Attachments attach.Dir
+
+	// Files, if set, is the directory of static files served under /files/,
+	// along with the attachments.
+	Files http.FileSystem
+)
+
+func init() {
+	http.HandleFunc("/files/", withLoggingAndAuth(withCSRF(files)))
+}
+
+// fileExts maps the content types of attachments to the extensions of their URIs.
+var fileExts = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/x-icon":    ".ico",
+	"image/svg+xml":   ".svg",
+	"audio/mpeg":      ".mp3",
+	"video/mp4":       ".mp4",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+}
+
+// fileURI returns the URI of the attachment with the given hash and content type.
+func fileURI(hash, typ string) string {
+	ext, ok := fileExts[typ]
+	if !ok {
+		if exts, _ := mime.ExtensionsByType(typ); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return "/files/" + hash + ext
+}
+
+// isBinary returns true iff the tiddlers of the content type are stored by
+// TiddlyWiki as base64.
+func isBinary(typ string) bool {
+	switch {
+	case typ == "image/svg+xml":
+		return false
+	case strings.HasPrefix(typ, "image/"), strings.HasPrefix(typ, "audio/"),
+		strings.HasPrefix(typ, "video/"), strings.HasPrefix(typ, "font/"):
+		return true
+	}
+	switch typ {
+	case "application/pdf", "application/zip", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+// externalize replaces the text of a binary tiddler with a _canonical_uri
+// pointing to its content in the attachments, and returns the content,
+// which the caller must store there. Tiddlers whose text is not valid
+// base64 are left as they are.
+func externalize(js map[string]interface{}) []byte {
+	typ, _ := js["type"].(string)
+	text, _ := js["text"].(string)
+	if Attachments == "" || text == "" || !isBinary(typ) {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil
+	}
+	js["_canonical_uri"] = fileURI(attach.Hash(data), typ)
+	delete(js, "text")
+	return data
+}
+
+// files serves the attachments (GET /files/{hash}, optionally followed by an
+// extension giving the content type) or else the static files, and stores
+// uploaded attachments (POST /files/ with the content as the body),
+// responding with their URI:
+//
+//	{"hash":"...","uri":"/files/....png","type":"image/png"}
+func files(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		if !serveAttachment(w, r) {
+			serveFile(w, r)
+		}
+	case "POST":
+		upload(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAttachment serves an attachment, which never changes.
+// It returns false if there is no such attachment.
+func serveAttachment(w http.ResponseWriter, r *http.Request) bool {
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	hash, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		hash, ext = name[:i], name[i:]
+	}
+	if Attachments == "" || !attach.ValidHash(hash) {
+		return false
+	}
+	f, err := Attachments.Open(hash)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		internalError(w, err)
+		return true
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		internalError(w, err)
+		return true
+	}
+
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		w.Header().Set("Content-Type", typ)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return true
+}
+
+// serveFile serves a static file. The files may change, so browsers have
+// to revalidate them, which Last-Modified makes cheap. Directories and
+// hidden files are not served.
+func serveFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files")
+	if Files == nil || strings.Contains(name, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := Files.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			http.NotFound(w, r)
+		} else {
+			internalError(w, err)
+		}
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// upload stores an uploaded attachment.
+func upload(w http.ResponseWriter, r *http.Request) {
+	if Attachments == "" || r.URL.Path != "/files/" {
+		http.NotFound(w, r)
+		return
+	}
+	typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	hash, err := Attachments.Put(http.MaxBytesReader(w, r.Body, maxUpload))
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		internalError(w, err)
+		return
+	}
+
+	uri := fileURI(hash, typ)
+	w.Header().Set("Location", uri)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, struct {
+		Hash string `json:"hash"`
+		URI  string `json:"uri"`
+		Type string `json:"type"`
+	}{hash, uri, typ})
+}
@@ -0,0 +1,64 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/opennota/widdly/store"
+)
+
+// Collector, if not nil, is the store whose garbage is collected on
+// POST /admin/gc. It is the store itself, unwrapped, as the gc command
+// would open it.
+var Collector store.Collector
+
+func init() {
+	http.HandleFunc("/admin/gc", withLoggingAndAuth(withCSRF(collectGarbage)))
+}
+
+// collectGarbage collects the garbage of the store while it is in use,
+// which the gc command can't do, and responds with what it has done:
+//
+//	{"migrated":0,"blobs":120,"removed":3,"freed":5120}
+func collectGarbage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if Collector == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	stats, err := Collector.GC(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	log.Printf("GC migrated %d revisions, kept %d blobs, removed %d (%d bytes)",
+		stats.Migrated, stats.Blobs, stats.Removed, stats.Freed)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
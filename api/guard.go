@@ -0,0 +1,269 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrustedProxies lists the networks of reverse proxies whose
+// X-Forwarded-For headers are honoured by ClientIP.
+// X-Forwarded-For is ignored for requests coming from anywhere else.
+var TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and
+// CIDR networks, as accepted by the -trusted-proxies flag.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: f}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy returns true iff host is an address of a trusted proxy.
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request.
+// If the request came through a trusted proxy, the X-Forwarded-For chain
+// is walked from the right, and the first address not belonging to
+// a trusted proxy is returned.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+		host = hops[i]
+	}
+	return host
+}
+
+// Guard tracks failed authentication attempts per client IP and per
+// username, slowing down and eventually locking out whoever keeps guessing.
+//
+// After n consecutive failures further attempts are refused for
+// Delay*2^(n-1), capped at MaxDelay. After MaxFailures consecutive failures
+// the client IP or username is locked out for Lockout; once the lockout
+// expires, the failures are counted anew.
+//
+// Attempts in flight count as failures until they are known not to be, so
+// that parallel requests do not get more guesses than sequential ones.
+type Guard struct {
+	Delay       time.Duration // The delay after the first failure
+	MaxDelay    time.Duration // The upper bound of the exponential backoff
+	MaxFailures int           // The number of failures that triggers a lockout
+	Lockout     time.Duration // The duration of a lockout
+
+	mu       sync.Mutex
+	failures map[string]*failure
+	now      func() time.Time
+}
+
+type failure struct {
+	count    int
+	inflight int       // Attempts allowed by Check but not yet decided
+	until    time.Time // Attempts are refused until then
+}
+
+// NewGuard returns a Guard with reasonable defaults.
+func NewGuard() *Guard {
+	return &Guard{
+		Delay:       time.Second,
+		MaxDelay:    time.Minute,
+		MaxFailures: 10,
+		Lockout:     15 * time.Minute,
+	}
+}
+
+func (g *Guard) clock() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
+
+func guardKeys(ip, user string) []string {
+	keys := []string{"ip:" + ip}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// Check returns how long the client must wait before it is allowed
+// to try to authenticate again, or zero if it may try now. In the latter
+// case the attempt is in flight until it is passed to Succeed or Fail,
+// which must follow.
+//
+// The failures and the attempts in flight together never exceed
+// MaxFailures, and after a failure only one attempt at a time is allowed.
+func (g *Guard) Check(ip, user string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock()
+	keys := guardKeys(ip, user)
+	var wait time.Duration
+	for _, k := range keys {
+		f := g.failures[k]
+		if f == nil {
+			continue
+		}
+		if f.count >= g.MaxFailures && !now.Before(f.until) {
+			f.count = 0 // The lockout has expired.
+		}
+		d := f.until.Sub(now)
+		if d <= 0 && (f.count+f.inflight >= g.MaxFailures || f.count > 0 && f.inflight > 0) {
+			d = g.Delay // Wait for the attempts in flight to be decided.
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	if g.failures == nil {
+		g.failures = make(map[string]*failure)
+	}
+	g.prune(now)
+	for _, k := range keys {
+		f := g.failures[k]
+		if f == nil {
+			f = &failure{}
+			g.failures[k] = f
+		}
+		f.inflight++
+	}
+	return 0
+}
+
+// Fail records that an attempt allowed by Check has failed.
+func (g *Guard) Fail(ip, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock()
+	if g.failures == nil {
+		g.failures = make(map[string]*failure)
+	}
+	for _, k := range guardKeys(ip, user) {
+		f := g.failures[k]
+		if f == nil {
+			f = &failure{}
+			g.failures[k] = f
+		}
+		if f.inflight > 0 {
+			f.inflight--
+		}
+		f.count++
+		if f.count >= g.MaxFailures {
+			f.until = now.Add(g.Lockout)
+			log.Printf("LOCKOUT %s after %d failed attempts until %s", k, f.count, f.until.Format(time.RFC3339))
+			continue
+		}
+		d := g.Delay << uint(f.count-1)
+		if d > g.MaxDelay || d <= 0 {
+			d = g.MaxDelay
+		}
+		f.until = now.Add(d)
+	}
+}
+
+// Succeed records that an attempt allowed by Check has succeeded and
+// forgets the failures of the client IP and the username.
+func (g *Guard) Succeed(ip, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, k := range guardKeys(ip, user) {
+		f := g.failures[k]
+		if f == nil {
+			continue
+		}
+		if f.inflight > 0 {
+			f.inflight--
+		}
+		f.count, f.until = 0, time.Time{}
+		if f.inflight == 0 {
+			delete(g.failures, k)
+		}
+	}
+}
+
+// prune forgets the failures which are not going to matter anymore,
+// so that the map does not grow without bound.
+func (g *Guard) prune(now time.Time) {
+	expiry := g.Lockout
+	if g.MaxDelay > expiry {
+		expiry = g.MaxDelay
+	}
+	for k, f := range g.failures {
+		if f.inflight == 0 && now.Sub(f.until) > expiry {
+			delete(g.failures, k)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGuardBackoff(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := NewGuard()
+	g.now = func() time.Time { return now }
+
+	if wait := g.Check("10.0.0.1", "widdly"); wait != 0 {
+		t.Fatalf("want no wait before any failures, got %v", wait)
+	}
+	g.Fail("10.0.0.1", "widdly")
+	if wait := g.Check("10.0.0.1", "widdly"); wait != time.Second {
+		t.Errorf("want 1s after the first failure, got %v", wait)
+	}
+	now = now.Add(time.Second)
+	if wait := g.Check("10.0.0.1", "widdly"); wait != 0 {
+		t.Fatalf("want no wait once the delay is over, got %v", wait)
+	}
+	g.Fail("10.0.0.1", "widdly")
+	if wait := g.Check("10.0.0.1", "widdly"); wait != 2*time.Second {
+		t.Errorf("want 2s after the second failure, got %v", wait)
+	}
+	// The username is tracked independently of the address.
+	if wait := g.Check("10.0.0.2", "widdly"); wait != 2*time.Second {
+		t.Errorf("want the username to be delayed from another address, got %v", wait)
+	}
+	if wait := g.Check("10.0.0.2", "other"); wait != 0 {
+		t.Errorf("want no wait for an unrelated client, got %v", wait)
+	}
+
+	g.Succeed("10.0.0.1", "widdly")
+	if wait := g.Check("10.0.0.1", "widdly"); wait != 0 {
+		t.Errorf("want no wait after a success, got %v", wait)
+	}
+}
+
+func TestGuardLockout(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := NewGuard()
+	g.now = func() time.Time { return now }
+
+	for i := 0; i < g.MaxFailures; i++ {
+		if wait := g.Check("10.0.0.1", ""); wait != 0 {
+			t.Fatalf("want no wait before failure %d, got %v", i+1, wait)
+		}
+		g.Fail("10.0.0.1", "")
+		now = now.Add(g.MaxDelay)
+	}
+	now = now.Add(-g.MaxDelay)
+	if wait := g.Check("10.0.0.1", ""); wait != g.Lockout {
+		t.Errorf("want %v lockout, got %v", g.Lockout, wait)
+	}
+	now = now.Add(g.Lockout)
+	if wait := g.Check("10.0.0.1", ""); wait != 0 {
+		t.Errorf("want the lockout to expire, got %v", wait)
+	}
+	g.Fail("10.0.0.1", "")
+	if wait := g.Check("10.0.0.1", ""); wait != g.Delay {
+		t.Errorf("want a failure after the lockout to count as the first one, got %v", wait)
+	}
+}
+
+func TestGuardInFlight(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := NewGuard()
+	g.now = func() time.Time { return now }
+
+	// Parallel attempts are allowed only as long as they could all fail
+	// without going past the lockout.
+	for i := 0; i < g.MaxFailures; i++ {
+		if wait := g.Check("10.0.0.1", "widdly"); wait != 0 {
+			t.Fatalf("want attempt %d allowed, got %v", i+1, wait)
+		}
+	}
+	if wait := g.Check("10.0.0.1", "widdly"); wait != g.Delay {
+		t.Errorf("want an attempt beyond the lockout refused for %v, got %v", g.Delay, wait)
+	}
+	if wait := g.Check("10.0.0.2", "widdly"); wait != g.Delay {
+		t.Errorf("want the username refused from another address, got %v", wait)
+	}
+	for i := 0; i < g.MaxFailures; i++ {
+		g.Fail("10.0.0.1", "widdly")
+	}
+	if wait := g.Check("10.0.0.1", "widdly"); wait != g.Lockout {
+		t.Errorf("want %v lockout, got %v", g.Lockout, wait)
+	}
+
+	// After a failure, only one attempt at a time is allowed.
+	g = NewGuard()
+	g.now = func() time.Time { return now }
+	g.Check("10.0.0.1", "widdly")
+	g.Fail("10.0.0.1", "widdly")
+	now = now.Add(g.Delay)
+	if wait := g.Check("10.0.0.1", "widdly"); wait != 0 {
+		t.Fatalf("want no wait once the delay is over, got %v", wait)
+	}
+	if wait := g.Check("10.0.0.1", "widdly"); wait != g.Delay {
+		t.Errorf("want a second attempt in flight refused, got %v", wait)
+	}
+	g.Succeed("10.0.0.1", "widdly")
+	for i := 0; i < 2; i++ {
+		if wait := g.Check("10.0.0.1", "widdly"); wait != 0 {
+			t.Errorf("want parallel attempts allowed after a success, got %v", wait)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	nets, err := ParseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TrustedProxies = nets
+	defer func() { TrustedProxies = nil }()
+
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+		{"127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:1234", "203.0.113.7, 198.51.100.1, 10.1.2.3", "198.51.100.1"},
+		{"127.0.0.1:1234", "10.1.2.3", "10.1.2.3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := ClientIP(r); got != tc.want {
+			t.Errorf("ClientIP(%s, X-Forwarded-For: %q) = %s, want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/opennota/widdly/store"
+)
+
+func init() {
+	http.HandleFunc("/tiddlers/", withLoggingAndAuth(tiddlerLinks))
+	http.HandleFunc("/links", withLoggingAndAuth(linkGraph))
+}
+
+// writeJSON serves v as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
+
+// tiddlerLinks serves the links from a tiddler (/tiddlers/{title}/links)
+// or to a tiddler (/tiddlers/{title}/backlinks).
+func tiddlerLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/tiddlers/")
+	var q store.LinkQuery
+	switch {
+	case strings.HasSuffix(path, "/backlinks"):
+		q.To = strings.TrimSuffix(path, "/backlinks")
+	case strings.HasSuffix(path, "/links"):
+		q.From = strings.TrimSuffix(path, "/links")
+	}
+	if q.From == "" && q.To == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	links, err := Store.Links(r.Context(), q)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, links)
+}
+
+// linkGraph serves the whole link graph: the titles of all the tiddlers,
+// all the links, the missing tiddlers (linked to or transcluded, but not
+// existing) and the orphans (non-system tiddlers nothing links to).
+func linkGraph(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	titles := []string{}
+	err := Store.Walk(r.Context(), func(t store.Tiddler) error {
+		titles = append(titles, store.SortValue(t.Meta, "title"))
+		return nil
+	})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	links, err := Store.Links(r.Context(), store.LinkQuery{})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	exists := make(map[string]bool, len(titles))
+	for _, title := range titles {
+		exists[title] = true
+	}
+	linked := make(map[string]bool)
+	missing := make(map[string]bool)
+	for _, l := range links {
+		if l.From != l.To {
+			linked[l.To] = true
+		}
+		if l.Kind != "tag" && !exists[l.To] {
+			missing[l.To] = true
+		}
+	}
+	graph := struct {
+		Tiddlers []string     `json:"tiddlers"`
+		Links    []store.Link `json:"links"`
+		Missing  []string     `json:"missing"`
+		Orphans  []string     `json:"orphans"`
+	}{
+		Tiddlers: titles,
+		Links:    links,
+		Missing:  []string{},
+		Orphans:  []string{},
+	}
+	sort.Strings(graph.Tiddlers)
+	for title := range missing {
+		graph.Missing = append(graph.Missing, title)
+	}
+	sort.Strings(graph.Missing)
+	for _, title := range graph.Tiddlers {
+		if !linked[title] && !strings.HasPrefix(title, "$:/") {
+			graph.Orphans = append(graph.Orphans, title)
+		}
+	}
+	writeJSON(w, graph)
+}
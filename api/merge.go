@@ -0,0 +1,221 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opennota/widdly/merge"
+	"github.com/opennota/widdly/store"
+)
+
+// conflict is the document served with 409 Conflict when an edit based on
+// an older revision conflicts with the changes made since.
+type conflict struct {
+	Title     string                 `json:"title"`
+	Base      int                    `json:"base"`      // The revision the edit was based on
+	Revision  int                    `json:"revision"`  // The current revision
+	Tiddler   map[string]interface{} `json:"tiddler"`   // The merge result, with conflict markers in the text
+	Conflicts []string               `json:"conflicts"` // The conflicting fields
+}
+
+// baseField is the field in which an edit may give the revision it is based
+// on, for the clients which cannot send If-Match. It is never saved.
+const baseField = "_base_revision"
+
+// baseRevision returns the revision an edit is based on, taken from
+// If-Match (an ETag as served by putTiddler) or from the baseField field,
+// or 0 if it is not given. The revision field is not used: TiddlyWeb
+// clients keep sending the revision they loaded after they have saved
+// a newer one, which would make the next edit look stale.
+func baseRevision(r *http.Request, js map[string]interface{}) int {
+	base := popBase(js)
+	if m := r.Header.Get("If-Match"); m != "" {
+		// "bag/<title>/<revision>:<hash>"
+		m = strings.Trim(m, `"`)
+		if i := strings.LastIndexByte(m, '/'); i >= 0 {
+			m = m[i+1:]
+		}
+		if i := strings.IndexByte(m, ':'); i >= 0 {
+			m = m[:i]
+		}
+		if rev, err := strconv.Atoi(m); err == nil {
+			return rev
+		}
+	}
+	return base
+}
+
+// popBase removes the baseField field from js and returns the revision
+// it gives, or 0.
+func popBase(js map[string]interface{}) int {
+	v := js[baseField]
+	delete(js, baseField)
+	switch rev := v.(type) {
+	case float64:
+		return int(rev)
+	case string:
+		n, _ := strconv.Atoi(rev)
+		return n
+	}
+	return 0
+}
+
+// titleLock serializes the writes of a tiddler.
+type titleLock struct {
+	sync.Mutex
+	refs int // The writes holding or waiting for the lock; guarded by titles.mu
+}
+
+// titles holds the locks of the tiddlers being written.
+var titles = struct {
+	mu    sync.Mutex
+	locks map[string]*titleLock
+}{locks: make(map[string]*titleLock)}
+
+// holdTitles keeps the other writes of the tiddlers keys from going on
+// until the returned function is called, so that nothing is saved between
+// an edit being checked against the current revision (see resolveEdit) and
+// the edit being saved, and the audit log records the revision a write
+// replaces. It must be called after holdLocks.
+func holdTitles(keys ...string) func() {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys) // Take the locks in order, so that bulk writes don't deadlock.
+	n := 0
+	for i, k := range keys {
+		if i == 0 || k != keys[n-1] {
+			keys[n] = k
+			n++
+		}
+	}
+	keys = keys[:n]
+
+	titles.mu.Lock()
+	locks := make([]*titleLock, len(keys))
+	for i, k := range keys {
+		l := titles.locks[k]
+		if l == nil {
+			l = &titleLock{}
+			titles.locks[k] = l
+		}
+		l.refs++
+		locks[i] = l
+	}
+	titles.mu.Unlock()
+	for _, l := range locks {
+		l.Lock()
+	}
+
+	return func() {
+		titles.mu.Lock()
+		defer titles.mu.Unlock()
+		for i, l := range locks {
+			l.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(titles.locks, keys[i])
+			}
+		}
+	}
+}
+
+// resolveEdit checks whether the edit js of the tiddler key, based on the
+// revision base, is stale, i.e. the tiddler has been changed since. If it is,
+// resolveEdit merges the edit with the changes made since, using the base
+// revision from the store's history: the text is merged line by line, the
+// other fields one by one. It returns the fields to save, or a conflict
+// if the changes can't be merged automatically.
+func resolveEdit(ctx context.Context, key string, base int, js map[string]interface{}) (map[string]interface{}, *conflict, error) {
+	if base <= 0 {
+		return js, nil, nil
+	}
+	current, err := Store.Get(ctx, key)
+	if err == store.ErrNotFound {
+		return js, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	rev := current.Revision()
+	if rev <= base {
+		return js, nil, nil
+	}
+
+	// If the base revision is gone from the history, everything that differs conflicts.
+	baseTiddler, err := Store.Revision(ctx, key, base)
+	if err != nil && err != store.ErrNotFound {
+		return nil, nil, err
+	}
+	baseFields, err := baseTiddler.Fields()
+	if err != nil {
+		return nil, nil, err
+	}
+	currentFields, err := current.Fields()
+	if err != nil {
+		return nil, nil, err
+	}
+	edit := make(map[string]interface{}, len(js))
+	for k, v := range js {
+		edit[k] = v
+	}
+	delete(edit, "revision")
+	delete(edit, "bag")
+	if _, ok := edit["text"]; !ok {
+		edit["text"] = ""
+	}
+
+	text, clean := merge.Text(
+		fmt.Sprint(baseFields["text"]),
+		fmt.Sprint(currentFields["text"]),
+		fmt.Sprint(edit["text"]),
+		fmt.Sprintf("revision %d", rev),
+		"your edit",
+	)
+	delete(baseFields, "text")
+	delete(currentFields, "text")
+	delete(edit, "text")
+
+	merged, conflicts := merge.Fields(baseFields, currentFields, edit, "modified", "modifier")
+	merged["text"] = text
+	if !clean {
+		conflicts = append([]string{"text"}, conflicts...)
+	}
+	if len(conflicts) > 0 {
+		return nil, &conflict{
+			Title:     key,
+			Base:      base,
+			Revision:  rev,
+			Tiddler:   merged,
+			Conflicts: conflicts,
+		}, nil
+	}
+	return merged, nil, nil
+}
+
+// writeConflict serves c with 409 Conflict.
+func writeConflict(w http.ResponseWriter, c *conflict) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(data)
+}
@@ -0,0 +1,94 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/opennota/widdly/render"
+	"github.com/opennota/widdly/store"
+)
+
+func init() {
+	http.HandleFunc("/render/", withLoggingAndAuth(renderTiddler))
+}
+
+// newRenderer returns a renderer of the tiddlers in the store, linking to
+// the tiddlers at prefix+title and to the attachments on the same host,
+// along with a function returning the first error of loading a tiddler,
+// if any.
+func newRenderer(ctx context.Context, prefix string) (*render.Renderer, func() error) {
+	var lookupErr error
+	rr := &render.Renderer{
+		Lookup: func(title string) (map[string]interface{}, bool) {
+			t, err := Store.Get(ctx, title)
+			if err == nil {
+				var fields map[string]interface{}
+				fields, err = t.Fields()
+				if err == nil {
+					return fields, true
+				}
+			}
+			if err != store.ErrNotFound && lookupErr == nil {
+				lookupErr = err
+			}
+			return nil, false
+		},
+		URL: func(title string) string {
+			return prefix + url.PathEscape(title)
+		},
+		File: func(uri string) string {
+			if strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") {
+				return strings.TrimSuffix(prefix, "/render/") + uri
+			}
+			return uri
+		},
+	}
+	return rr, func() error { return lookupErr }
+}
+
+// renderTiddler serves a tiddler rendered to an HTML page (/render/{title}).
+func renderTiddler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	title := strings.TrimPrefix(r.URL.Path, "/render/")
+
+	rr, lookupErr := newRenderer(r.Context(), "/render/")
+	body, ok := rr.Render(title)
+	if err := lookupErr(); err != nil {
+		internalError(w, err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := render.Page(&buf, title, body); err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("ERR", err)
+	}
+}
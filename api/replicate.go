@@ -0,0 +1,97 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/opennota/widdly/replicate"
+)
+
+func init() {
+	http.HandleFunc("/replicate", withLoggingAndAuth(withCSRF(replication)))
+}
+
+// replication is the server side of replication (see package replicate).
+// GET serves the changes made after the change ?since=<seq>;
+// POST applies a batch of changes and serves the result of every change.
+func replication(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	switch r.Method {
+	case "GET":
+		seq, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil || seq < 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		feed, err := replicate.FeedSince(r.Context(), Store, Attachments, seq)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		resp = feed
+
+	case "POST":
+		var batch replicate.Batch
+		err := json.NewDecoder(r.Body).Decode(&batch)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		results := make([]replicate.Result, 0, len(batch.Changes))
+		for _, c := range batch.Changes {
+			res := applyChange(r, c)
+			if res.Status == "error" {
+				log.Println("ERR replicate:", c.Title, res.Error)
+			}
+			results = append(results, res)
+		}
+		resp = results
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("ERR", err)
+	}
+}
+
+// applyChange applies an incoming change the way putTiddler and remove
+// write: it is refused if the tiddler is locked by another user, and the
+// other writes of the tiddler wait until it is applied and recorded.
+func applyChange(r *http.Request, c replicate.Change) replicate.Result {
+	defer holdLocks()()
+	if holder := lockedBy(c.Title, nil, username(r)); holder != "" {
+		return replicate.Result{Title: c.Title, Status: "locked", Error: "locked by " + holder}
+	}
+
+	defer holdTitles(c.Title)()
+	oldRev := currentRevision(r.Context(), c.Title)
+	res := replicate.Apply(r.Context(), Store, Attachments, c)
+	if res.Status == "ok" {
+		if c.Deleted {
+			record(r, "delete", c.Title, oldRev, 0)
+		} else {
+			record(r, "put", c.Title, oldRev, res.Revision)
+		}
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/opennota/widdly/store"
+)
+
+func init() {
+	http.HandleFunc("/tags", withLoggingAndAuth(tags))
+	http.HandleFunc("/tags/", withLoggingAndAuth(tagged))
+}
+
+// tags serves all the tags along with the number of tiddlers tagged with each.
+func tags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tags, err := store.Tags(r.Context(), Store)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, tags)
+}
+
+// tagged serves the titles of the tiddlers tagged with a tag (/tags/{tag}/tiddlers).
+func tagged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/tags/")
+	tag := strings.TrimSuffix(path, "/tiddlers")
+	if tag == path || tag == "" {
+		http.NotFound(w, r)
+		return
+	}
+	titles, err := store.Tagged(r.Context(), Store, tag)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, titles)
+}
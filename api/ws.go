@@ -0,0 +1,400 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/opennota/widdly/store"
+)
+
+// wsMessage is a message exchanged over the WebSocket sync endpoint.
+//
+// Clients send:
+//
+//	{"type":"put","id":"1","title":"T","tiddler":{...}}  save a fat tiddler
+//	{"type":"put",...,"revision":2}                      ...based on revision 2
+//	{"type":"delete","id":"2","title":"T"}               delete a tiddler
+//	{"type":"editing","title":"T"}                       start editing T
+//	{"type":"stopped","title":"T"}                       stop editing T
+//	{"type":"lock","id":"3","title":"T"}                 lock T against saves by others
+//	{"type":"unlock","title":"T"}                        release the lock
+//
+// A put may give the revision it is based on in its revision field (not in
+// the tiddler's); if that is older than the current one, the put is merged
+// with the changes made since, and if they conflict, the server replies
+// with "conflict" carrying the merge result and the conflicting fields.
+//
+// Only signed-in users may lock tiddlers, and only if they don't share
+// a name (see SharedUser), as a lock is held against the other users and
+// those can't be told apart over HTTP otherwise.
+//
+// The server replies to the requests with an id with "ok" or "error",
+// and pushes "put" and "delete" change notifications, "presence" (who is
+// editing which tiddler) and "lock"/"unlock" notifications to every client.
+type wsMessage struct {
+	Type     string                 `json:"type"`
+	ID       string                 `json:"id,omitempty"`
+	Title    string                 `json:"title,omitempty"`
+	Tiddler  map[string]interface{} `json:"tiddler,omitempty"`
+	Revision int                    `json:"revision,omitempty"`
+	User     string                 `json:"user,omitempty"`
+	Modifier string                 `json:"modifier,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Editors  map[string][]string    `json:"editors,omitempty"`
+
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// wsClient is a connected WebSocket client.
+type wsClient struct {
+	user    string
+	send    chan wsMessage
+	editing map[string]bool // Guarded by hub.mu
+	gone    chan struct{}   // Closed when the client is dropped for not keeping up
+	drop    sync.Once
+}
+
+// draftLock is a lock held by a client on a tiddler.
+type draftLock struct {
+	client *wsClient
+	user   string
+}
+
+// hub keeps track of the connected clients, what they are editing and the locks they hold.
+var hub = struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+	locks   map[string]draftLock
+
+	// writes is held for reading by the saves and deletes from when they
+	// are checked against the locks until they are done, and for writing
+	// while a lock is taken.
+	writes sync.RWMutex
+}{
+	clients: make(map[*wsClient]struct{}),
+	locks:   make(map[string]draftLock),
+}
+
+var (
+	upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			host := Host
+			if host == "" {
+				host = r.Host
+			}
+			return sameHost(origin, host)
+		},
+	}
+
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+)
+
+func init() {
+	http.HandleFunc("/recipes/all/ws", withLoggingAndAuth(ws))
+}
+
+// holdLocks keeps locks from being taken until the returned function is
+// called. Saves and deletes hold it from their lockedBy checks until they
+// are done.
+func holdLocks() func() {
+	hub.writes.RLock()
+	return hub.writes.RUnlock
+}
+
+// lockedBy returns the user holding the lock on title, or an empty string
+// if the title is not locked or is locked by the client c (nil for HTTP
+// requests) or the user.
+func lockedBy(title string, c *wsClient, user string) string {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	l, ok := hub.locks[title]
+	if !ok || l.client == c || l.user == user {
+		return ""
+	}
+	return l.user
+}
+
+// broadcast sends m to every connected client.
+// Must be called with hub.mu held.
+func broadcast(m wsMessage) {
+	for c := range hub.clients {
+		select {
+		case c.send <- m:
+		default:
+			// The client can't keep up; it would miss the message.
+			delete(hub.clients, c)
+			c.disconnect()
+		}
+	}
+}
+
+// disconnect drops the client; its writer closes the connection.
+func (c *wsClient) disconnect() {
+	c.drop.Do(func() { close(c.gone) })
+}
+
+// presence returns who is editing which tiddler.
+// Must be called with hub.mu held.
+func presence() wsMessage {
+	editors := make(map[string][]string)
+	for c := range hub.clients {
+		for title := range c.editing {
+			editors[title] = append(editors[title], c.user)
+		}
+	}
+	for _, users := range editors {
+		sort.Strings(users)
+	}
+	return wsMessage{Type: "presence", Editors: editors}
+}
+
+// ws serves the WebSocket sync endpoint.
+func ws(w http.ResponseWriter, r *http.Request) {
+	// Subscribe before the upgrade, so that the client, which may fetch
+	// the tiddlers as soon as it is connected, misses no change.
+	var changes <-chan store.Event
+	if Events != nil {
+		_, _, ch, unsubscribe := Events.Subscribe(0)
+		defer unsubscribe()
+		changes = ch
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has replied with an error.
+	}
+	defer conn.Close()
+
+	c := &wsClient{
+		user:    username(r),
+		send:    make(chan wsMessage, 64),
+		editing: make(map[string]bool),
+		gone:    make(chan struct{}),
+	}
+	hub.mu.Lock()
+	hub.clients[c] = struct{}{}
+	c.send <- presence()
+	hub.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go wsWriter(ctx, cancel, conn, c, changes)
+
+	defer func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		delete(hub.clients, c)
+		for title, l := range hub.locks {
+			if l.client == c {
+				delete(hub.locks, title)
+				broadcast(wsMessage{Type: "unlock", Title: title})
+			}
+		}
+		if len(c.editing) > 0 {
+			broadcast(presence())
+		}
+	}()
+
+	conn.SetReadLimit(64 << 20)
+	conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.reply(wsMessage{Type: "error", Error: "bad request"})
+			continue
+		}
+		wsHandle(ctx, r, c, m)
+	}
+}
+
+// wsWriter is the only goroutine writing to the connection. It forwards
+// the messages queued for the client and the store change notifications.
+func wsWriter(ctx context.Context, cancel func(), conn *websocket.Conn, c *wsClient, changes <-chan store.Event) {
+	defer cancel()
+	defer conn.Close() // Unblocks the reader.
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case m := <-c.send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = conn.WriteJSON(m)
+		case e, ok := <-changes:
+			if !ok {
+				return // Fell behind the change feed.
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = conn.WriteJSON(wsMessage{Type: e.Action, Title: e.Title, Revision: e.Revision, Modifier: e.Modifier})
+		case <-ticker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		case <-c.gone:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reply queues m for sending to the client.
+func (c *wsClient) reply(m wsMessage) {
+	select {
+	case c.send <- m:
+	default:
+		log.Println("ERR websocket: client is not reading")
+		c.disconnect()
+	}
+}
+
+// wsHandle handles a message from a client.
+func wsHandle(ctx context.Context, r *http.Request, c *wsClient, m wsMessage) {
+	fail := func(msg string) {
+		c.reply(wsMessage{Type: "error", ID: m.ID, Title: m.Title, Error: msg})
+	}
+	if m.Title == "" {
+		fail("no title")
+		return
+	}
+
+	switch m.Type {
+	case "put":
+		defer holdLocks()()
+		if holder := lockedBy(m.Title, c, c.user); holder != "" {
+			fail("locked by " + holder)
+			return
+		}
+		if m.Tiddler == nil {
+			fail("no tiddler")
+			return
+		}
+		base := popBase(m.Tiddler)
+		if m.Revision != 0 {
+			base = m.Revision
+		}
+		defer holdTitles(m.Title)()
+		js, conflict, err := resolveEdit(ctx, m.Title, base, m.Tiddler)
+		if err != nil {
+			log.Println("ERR", err)
+			fail("internal server error")
+			return
+		}
+		if conflict != nil {
+			c.reply(wsMessage{Type: "conflict", ID: m.ID, Title: m.Title, Revision: conflict.Revision, Tiddler: conflict.Tiddler, Conflicts: conflict.Conflicts})
+			return
+		}
+		t, err := tiddlerFromJSON(m.Title, js)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		oldRev := currentRevision(ctx, m.Title)
+		rev, err := Store.Put(ctx, t)
+		if err != nil {
+			log.Println("ERR", err)
+			fail("internal server error")
+			return
+		}
+		record(r, "put", m.Title, oldRev, rev)
+		c.reply(wsMessage{Type: "ok", ID: m.ID, Title: m.Title, Revision: rev})
+
+	case "delete":
+		defer holdLocks()()
+		if holder := lockedBy(m.Title, c, c.user); holder != "" {
+			fail("locked by " + holder)
+			return
+		}
+		defer holdTitles(m.Title)()
+		oldRev := currentRevision(ctx, m.Title)
+		if err := Store.Delete(ctx, m.Title); err != nil {
+			log.Println("ERR", err)
+			fail("internal server error")
+			return
+		}
+		record(r, "delete", m.Title, oldRev, 0)
+		c.reply(wsMessage{Type: "ok", ID: m.ID, Title: m.Title})
+
+	case "editing", "stopped":
+		hub.mu.Lock()
+		if c.editing[m.Title] != (m.Type == "editing") {
+			if m.Type == "editing" {
+				c.editing[m.Title] = true
+			} else {
+				delete(c.editing, m.Title)
+			}
+			broadcast(presence())
+		}
+		hub.mu.Unlock()
+
+	case "lock":
+		if c.user == "" {
+			fail("sign in to lock tiddlers")
+			return
+		}
+		if SharedUser {
+			fail("tiddlers can't be locked when everybody signs in as " + c.user)
+			return
+		}
+		hub.writes.Lock()
+		hub.mu.Lock()
+		l, ok := hub.locks[m.Title]
+		if !ok {
+			hub.locks[m.Title] = draftLock{c, c.user}
+			broadcast(wsMessage{Type: "lock", Title: m.Title, User: c.user})
+		}
+		hub.mu.Unlock()
+		hub.writes.Unlock()
+		if ok && l.client != c {
+			fail("locked by " + l.user)
+			return
+		}
+		c.reply(wsMessage{Type: "ok", ID: m.ID, Title: m.Title})
+
+	case "unlock":
+		hub.mu.Lock()
+		if l, ok := hub.locks[m.Title]; ok && l.client == c {
+			delete(hub.locks, m.Title)
+			broadcast(wsMessage{Type: "unlock", Title: m.Title})
+		}
+		hub.mu.Unlock()
+
+	default:
+		fail("unknown message type")
+	}
+}
@@ -0,0 +1,122 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package attach implements a content-addressed store of files, used for
+// the binary attachments of tiddlers.
+package attach
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir is a content-addressed store of files in a directory. Every file is
+// stored under the hex-encoded SHA-256 hash of its content, in a
+// subdirectory named after the first two digits of the hash, so that
+// storing the same content twice takes the space once.
+type Dir string
+
+// ValidHash returns true iff s is a hash Put could have returned.
+func ValidHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash returns the hash under which Put stores data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// URIHash returns the hash of the attachment a _canonical_uri of the form
+// /files/{hash}, optionally followed by an extension, points to, or an
+// empty string if the URI points elsewhere.
+func URIHash(uri string) string {
+	if !strings.HasPrefix(uri, "/files/") {
+		return ""
+	}
+	hash := uri[len("/files/"):]
+	if i := strings.IndexByte(hash, '.'); i >= 0 {
+		if strings.ContainsAny(hash[i:], `/\`) {
+			return ""
+		}
+		hash = hash[:i]
+	}
+	if !ValidHash(hash) {
+		return ""
+	}
+	return hash
+}
+
+// path returns the path to the file with the given hash.
+func (d Dir) path(hash string) string {
+	return filepath.Join(string(d), hash[:2], hash)
+}
+
+// Put stores the content read from r and returns its hash.
+func (d Dir) Put(r io.Reader) (string, error) {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(string(d), "upload")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(f, io.TeeReader(r, h))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	path := d.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(f.Name(), path)
+}
+
+// Open opens the file with the given hash. If there is no such file, the
+// error satisfies os.IsNotExist.
+func (d Dir) Open(hash string) (*os.File, error) {
+	if !ValidHash(hash) {
+		return nil, &os.PathError{Op: "open", Path: hash, Err: os.ErrNotExist}
+	}
+	return os.Open(d.path(hash))
+}
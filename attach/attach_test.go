@@ -0,0 +1,80 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package attach
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	d := Dir(filepath.Join(tmp, "files"))
+
+	hash, err := d.Put(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; hash != want {
+		t.Errorf("want hash %s, got %s", want, hash)
+	}
+	if h := Hash([]byte("hello")); h != hash {
+		t.Errorf("want Hash to agree with Put, got %s", h)
+	}
+	again, err := d.Put(strings.NewReader("hello"))
+	if err != nil || again != hash {
+		t.Errorf("want the same hash again, got %s %v", again, err)
+	}
+
+	f, err := d.Open(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "hello" {
+		t.Errorf("want hello, got %q", data)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(string(d), "*", "*"))
+	if len(files) != 1 {
+		t.Errorf("want one stored file, got %v", files)
+	}
+	for uri, want := range map[string]string{
+		"/files/" + hash:              hash,
+		"/files/" + hash + ".png":     hash,
+		"/files/" + hash + "./../x":   "",
+		"/files/" + hash[1:] + ".png": "",
+		"https://example.com/" + hash: "",
+		"/files/" + hash + "/x.png":   "",
+	} {
+		if got := URIHash(uri); got != want {
+			t.Errorf("URIHash(%q): want %q, got %q", uri, want, got)
+		}
+	}
+
+	if _, err := d.Open("../../etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("want a not-exist error for a bad hash, got %v", err)
+	}
+	if _, err := d.Open(strings.Repeat("0", 64)); !os.IsNotExist(err) {
+		t.Errorf("want a not-exist error for a missing file, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	t0 := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Entry{
+		{Time: t0, User: "alice", IP: "192.0.2.1", Action: "put", Title: "A", NewRevision: 1},
+		{Time: t0.Add(time.Hour), User: "bob", IP: "192.0.2.2", Action: "put", Title: "A", OldRevision: 1, NewRevision: 2},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"time":"2026-10-16T12:00:00Z","user":"alice","ip":"192.0.2.1","action":"put","title":"A","new_revision":1}` + "\n"; !strings.HasPrefix(string(data), want) {
+		t.Errorf("want the first line %q, got %q", want, data)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("want the log readable by its owner only, got %v %v", fi.Mode(), err)
+	}
+
+	// Reopening appends, and a torn line left by a crash is skipped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2026-10-16T14:00:00Z","us` + "\n")
+	f.Close()
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Record(Entry{Time: t0.Add(3 * time.Hour), User: "alice", Action: "delete", Title: "A", OldRevision: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		f    Filter
+		want string
+	}{
+		{Filter{}, "put A alice,put A bob,delete A alice"},
+		{Filter{User: "alice"}, "put A alice,delete A alice"},
+		{Filter{Since: t0.Add(time.Hour)}, "put A bob,delete A alice"},
+		{Filter{Until: t0.Add(time.Hour)}, "put A alice"},
+		{Filter{User: "carol"}, ""},
+	} {
+		entries, err := l.Query(tc.f)
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Action+" "+e.Title+" "+e.User)
+		}
+		if err != nil || strings.Join(got, ",") != tc.want {
+			t.Errorf("%+v: want %q, got %q %v", tc.f, tc.want, got, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/opennota/widdly/backup"
+)
+
+// backupStore implements the backup command, which writes a backup of the
+// store and the attachments as a gzipped tar archive.
+func backupStore(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	db := fs.String("db", "widdly.db", "Database file")
+	attachments := fs.String("attachments", "", "Directory of the binary attachments (by default next to the database, with .files appended)")
+	out := fs.String("out", "", "File to write the backup to (by default widdly-<date>.tar.gz)")
+	fs.Parse(args)
+
+	if *attachments == "" {
+		*attachments = *db + ".files"
+	}
+	if *out == "" {
+		*out = backup.FileName(time.Now())
+	}
+	if err := backup.WriteFile(context.Background(), openStore(*db), *attachments, *out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// restoreStore implements the restore command, which puts the store and the
+// attachments from a backup in place.
+func restoreStore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("in", "", "Backup file to restore")
+	db := fs.String("db", "widdly.db", "Database file to restore to; must not exist")
+	attachments := fs.String("attachments", "", "Directory to restore the binary attachments to (by default next to the database, with .files appended); must not exist")
+	fs.Parse(args)
+
+	if *in == "" {
+		log.Fatal("-in is required")
+	}
+	if *attachments == "" {
+		*attachments = *db + ".files"
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := backup.Restore(f, *db, *attachments); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,259 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package backup writes and restores backups of a wiki: gzipped tar
+// archives holding a consistent snapshot of the store (under db) and the
+// attachments (under attachments/).
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opennota/widdly/store"
+)
+
+const (
+	dbEntry          = "db"
+	attachmentsEntry = "attachments"
+)
+
+// Write writes a backup of the store s and of the attachments directory,
+// if it is given and exists, to w.
+func Write(ctx context.Context, s store.TiddlerStore, attachments string, w io.Writer) error {
+	sn, ok := s.(store.Snapshotter)
+	if !ok {
+		return errors.New("the storage engine cannot take snapshots")
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := sn.Snapshot(ctx, tw, dbEntry); err != nil {
+		return err
+	}
+	if attachments != "" {
+		if _, err := os.Stat(attachments); err == nil {
+			// The attachments never change, so they need no snapshot.
+			if err := store.TarDir(tw, attachmentsEntry, attachments); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// WriteFile writes a backup to the file at path, which appears only once
+// the backup is complete.
+func WriteFile(ctx context.Context, s store.TiddlerStore, attachments, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = Write(ctx, s, attachments, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Restore extracts the backup read from r, putting the store at dataSource
+// and the attachments, if any, in the directory attachments (unless it is
+// empty). Neither of them may exist; nothing is put in place unless the
+// whole backup is read.
+func Restore(r io.Reader, dataSource, attachments string) error {
+	for _, p := range []string{dataSource, attachments} {
+		if _, err := os.Lstat(p); err == nil {
+			return fmt.Errorf("%s already exists", p)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dataSource), ".widdly-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := extract(r, tmp); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(filepath.Join(tmp, dbEntry)); err != nil {
+		return errors.New("the backup holds no store")
+	}
+	if _, err := os.Lstat(filepath.Join(tmp, attachmentsEntry)); err == nil && attachments != "" {
+		if err := os.Rename(filepath.Join(tmp, attachmentsEntry), attachments); err != nil {
+			return err
+		}
+	}
+	return os.Rename(filepath.Join(tmp, dbEntry), dataSource)
+}
+
+// extract extracts the gzipped tar archive read from r to the directory dir.
+func extract(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		top := strings.SplitN(name, "/", 2)[0]
+		if top != dbEntry && top != attachmentsEntry {
+			return fmt.Errorf("unexpected file in the backup: %s", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeReg:
+			err = extractFile(tr, p, os.FileMode(hdr.Mode).Perm())
+		default:
+			err = fmt.Errorf("unexpected file in the backup: %s", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractFile writes the content read from r to a new file at p.
+func extractFile(r io.Reader, p string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Options controls the scheduled backups.
+type Options struct {
+	Dir    string        // The directory to write the backups to
+	Every  time.Duration // The interval between the backups
+	Keep   int           // The number of backups to keep; 0 means no limit
+	MaxAge time.Duration // The age of the backups to remove; 0 means no limit
+}
+
+// FileName returns the name of the scheduled backup taken at t.
+func FileName(t time.Time) string {
+	return "widdly-" + t.UTC().Format("2006-01-02T150405Z") + ".tar.gz"
+}
+
+// Rotate removes the scheduled backups in the directory dir beyond the
+// keep newest ones and those older than maxAge, but never the newest one.
+// It returns the names of the removed backups.
+func Rotate(dir string, keep int, maxAge time.Duration, now time.Time) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []os.FileInfo
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), "widdly-") && strings.HasSuffix(fi.Name(), ".tar.gz") {
+			backups = append(backups, fi)
+		}
+	}
+	// The names sort in the order the backups were taken.
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name() > backups[j].Name() })
+
+	var removed []string
+	for i, fi := range backups {
+		if i == 0 {
+			continue
+		}
+		if (keep > 0 && i >= keep) || (maxAge > 0 && now.Sub(fi.ModTime()) > maxAge) {
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+				return removed, err
+			}
+			removed = append(removed, fi.Name())
+		}
+	}
+	return removed, nil
+}
+
+// Take takes a backup of the store s and the attachments to opts.Dir,
+// named after now, and rotates the backups. It returns the path to the
+// backup. Failures to rotate are only logged.
+func Take(ctx context.Context, s store.TiddlerStore, attachments string, opts Options, now time.Time) (string, error) {
+	name := filepath.Join(opts.Dir, FileName(now))
+	if err := WriteFile(ctx, s, attachments, name); err != nil {
+		return "", err
+	}
+	log.Println("BACKUP", name)
+	removed, err := Rotate(opts.Dir, opts.Keep, opts.MaxAge, now)
+	if err != nil {
+		log.Println("ERR backup rotation:", err)
+	}
+	for _, name := range removed {
+		log.Println("BACKUP removed", name)
+	}
+	return name, nil
+}
+
+// Run takes a backup of the store s and the attachments to opts.Dir right
+// away and then every opts.Every, until ctx is done. Failures are logged.
+func Run(ctx context.Context, s store.TiddlerStore, attachments string, opts Options) {
+	ticker := time.NewTicker(opts.Every)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		if _, err := Take(ctx, s, attachments, opts, now); err != nil {
+			log.Println("ERR backup:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
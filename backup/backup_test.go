@@ -0,0 +1,175 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opennota/widdly/store"
+)
+
+// dirStore is a store of the files in a directory, which it snapshots.
+type dirStore struct {
+	store.TiddlerStore
+	dir string
+}
+
+func (s dirStore) Snapshot(_ context.Context, tw *tar.Writer, name string) error {
+	return store.TarDir(tw, name, s.dir)
+}
+
+func writeFiles(t *testing.T, files map[string]string) {
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "widdly-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	db := filepath.Join(tmp, "widdly.db")
+	files := filepath.Join(tmp, "widdly.db.files")
+	writeFiles(t, map[string]string{
+		filepath.Join(db, "tiddlers", "a.tid"): "text of a",
+		filepath.Join(db, "changes"):           "log",
+		filepath.Join(files, "0123abcd"):       "attachment",
+	})
+
+	var buf bytes.Buffer
+	if err := Write(context.Background(), dirStore{dir: db}, files, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(context.Background(), nil, files, &buf); err == nil {
+		t.Error("want an error for a store which cannot take snapshots")
+	}
+
+	restored := filepath.Join(tmp, "restored.db")
+	restoredFiles := filepath.Join(tmp, "restored.files")
+	if err := Restore(bytes.NewReader(buf.Bytes()), restored, restoredFiles); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		filepath.Join(restored, "tiddlers", "a.tid"): "text of a",
+		filepath.Join(restored, "changes"):           "log",
+		filepath.Join(restoredFiles, "0123abcd"):     "attachment",
+	} {
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != want {
+			t.Errorf("%s: want %q, got %q %v", name, want, got, err)
+		}
+	}
+	if err := Restore(bytes.NewReader(buf.Bytes()), restored, filepath.Join(tmp, "other.files")); err == nil {
+		t.Error("want an error restoring over an existing store")
+	}
+	if err := Restore(strings.NewReader("not a backup"), filepath.Join(tmp, "bad.db"), ""); err == nil {
+		t.Error("want an error restoring garbage")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "bad.db")); !os.IsNotExist(err) {
+		t.Errorf("want nothing put in place after a failed restore, got %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "widdly-run-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	db := filepath.Join(tmp, "widdly.db")
+	writeFiles(t, map[string]string{filepath.Join(db, "changes"): "log"})
+	dir := filepath.Join(tmp, "backups")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, dirStore{dir: db}, "", Options{Dir: dir, Every: time.Hour})
+		close(done)
+	}()
+	defer func() { cancel(); <-done }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if names, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz")); len(names) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want a backup taken at startup, not after -backup-every")
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-rotate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for days := 0; days < 5; days++ {
+		taken := now.AddDate(0, 0, -days)
+		name := filepath.Join(dir, FileName(taken))
+		writeFiles(t, map[string]string{name: "backup"})
+		if err := os.Chtimes(name, taken, taken); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, map[string]string{filepath.Join(dir, "wiki-2020-01-01.tar.gz"): "manual"})
+
+	list := func() []string {
+		fis, _ := ioutil.ReadDir(dir)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	removed, err := Rotate(dir, 4, 0, now)
+	if err != nil || len(removed) != 1 || removed[0] != FileName(now.AddDate(0, 0, -4)) {
+		t.Errorf("want the oldest backup removed, got %v %v", removed, err)
+	}
+	removed, err = Rotate(dir, 0, 36*time.Hour, now)
+	if err != nil || len(removed) != 2 {
+		t.Errorf("want the backups older than 36h removed, got %v %v", removed, err)
+	}
+	want := []string{FileName(now.AddDate(0, 0, -1)), FileName(now), "wiki-2020-01-01.tar.gz"}
+	if got := list(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("want %v left, got %v", want, got)
+	}
+
+	if _, err := Rotate(dir, 0, time.Hour, now.AddDate(1, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(); len(got) != 2 || got[0] != FileName(now) {
+		t.Errorf("want the newest backup kept whatever its age, got %v", got)
+	}
+}
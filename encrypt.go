@@ -0,0 +1,74 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/store"
+	"github.com/opennota/widdly/store/crypt"
+)
+
+// passphraseEnv is the environment variable that may hold the passphrase
+// the store is encrypted with.
+const passphraseEnv = "WIDDLY_PASSPHRASE"
+
+// encryptStore returns the store s opened from dataSource, encrypting the
+// tiddlers if the -key-file file or the WIDDLY_PASSPHRASE environment
+// variable gives a secret; a store already encrypted cannot be used without one.
+func encryptStore(s store.TiddlerStore, dataSource, keyFile string) store.TiddlerStore {
+	var secret []byte
+	switch {
+	case keyFile != "":
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret = bytes.TrimRight(data, "\r\n")
+	case os.Getenv(passphraseEnv) != "":
+		secret = []byte(os.Getenv(passphraseEnv))
+	}
+
+	ctx := context.Background()
+	if secret == nil {
+		encrypted, err := crypt.IsEncrypted(ctx, s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if encrypted {
+			log.Fatalf("%s is encrypted: give -key-file or set %s", dataSource, passphraseEnv)
+		}
+		return s
+	}
+	c, err := crypt.Open(ctx, s, secret)
+	if err != nil {
+		log.Fatalf("%s: %v", dataSource, err)
+	}
+	return c
+}
+
+// attachments returns the directory to store the binary attachments of the
+// tiddlers of s in, or an empty one if s is encrypted: the attachments
+// would not be, so the binary tiddlers keep their content in the sealed text.
+func attachments(s store.TiddlerStore, dir string) attach.Dir {
+	if _, ok := s.(*crypt.Store); ok {
+		return ""
+	}
+	return attach.Dir(dir)
+}
@@ -0,0 +1,497 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package filter evaluates a subset of TiddlyWiki filters over the fields
+// of tiddlers.
+//
+// Supported are runs of steps in square brackets, titles (bare, quoted or
+// in double square brackets), the run prefixes + (and), - (except),
+// ~ (else) and = (keep duplicates), and the operators
+//
+//	title, tag, field:<name> (or just <name>), prefix, search[:<fields>],
+//	has, is[system], is[tiddler], days[:<field>], sort, limit,
+//
+// each of which can be negated with !. Parameters must be literal;
+// text references ({...}) and variables (<...>) are not supported.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tiddler holds the fields of a tiddler, as in TiddlyWeb JSON.
+type Tiddler map[string]interface{}
+
+// Title returns the title of t.
+func (t Tiddler) Title() string {
+	return t.Get("title")
+}
+
+// Get returns the value of the field as a string; lists (like tags) are
+// formatted as TiddlyWiki lists.
+func (t Tiddler) Get(field string) string {
+	switch v := t[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return formatList(items)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Tags returns the tags of t.
+func (t Tiddler) Tags() []string {
+	switch v := t["tags"].(type) {
+	case []interface{}:
+		tags := make([]string, len(v))
+		for i, tag := range v {
+			tags[i] = fmt.Sprint(tag)
+		}
+		return tags
+	case string:
+		return parseList(v)
+	}
+	return nil
+}
+
+// parseList splits a TiddlyWiki list, e.g. "a [[b c]] d".
+func parseList(s string) []string {
+	var items []string
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return items
+		}
+		if strings.HasPrefix(s, "[[") {
+			end := strings.Index(s, "]]")
+			if end < 0 {
+				return append(items, s[2:])
+			}
+			items = append(items, s[2:end])
+			s = s[end+2:]
+			continue
+		}
+		end := strings.IndexAny(s, " \t\n")
+		if end < 0 {
+			return append(items, s)
+		}
+		items = append(items, s[:end])
+		s = s[end:]
+	}
+}
+
+// formatList formats items as a TiddlyWiki list.
+func formatList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		if strings.ContainsAny(item, " \t\n") {
+			item = "[[" + item + "]]"
+		}
+		quoted[i] = item
+	}
+	return strings.Join(quoted, " ")
+}
+
+type step struct {
+	op     string
+	suffix string
+	param  string
+	negate bool
+}
+
+type run struct {
+	prefix byte // 0 (or), '+' (and), '-' (except), '~' (else) or '=' (keep duplicates)
+	steps  []step
+}
+
+// Filter is a parsed filter.
+type Filter struct {
+	runs []run
+}
+
+// Parse parses a filter.
+func Parse(s string) (*Filter, error) {
+	f := &Filter{}
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return f, nil
+		}
+
+		var r run
+		switch {
+		case strings.HasPrefix(s, ":and"), strings.HasPrefix(s, ":except"),
+			strings.HasPrefix(s, ":else"), strings.HasPrefix(s, ":or"):
+			end := strings.IndexAny(s, "[\"' ")
+			if end < 0 {
+				end = len(s)
+			}
+			r.prefix = map[string]byte{":and": '+', ":except": '-', ":else": '~', ":or": 0}[s[:end]]
+			s = s[end:]
+		case s[0] == '+' || s[0] == '-' || s[0] == '~' || s[0] == '=':
+			r.prefix = s[0]
+			s = s[1:]
+		}
+
+		var err error
+		switch {
+		case s == "":
+			return nil, errors.New("filter: missing run after prefix")
+		case strings.HasPrefix(s, "[["):
+			end := strings.Index(s, "]]")
+			if end < 0 {
+				return nil, errors.New("filter: missing ]]")
+			}
+			r.steps = []step{{op: "title", param: s[2:end]}}
+			s = s[end+2:]
+		case s[0] == '[':
+			r.steps, s, err = parseSteps(s[1:])
+			if err != nil {
+				return nil, err
+			}
+		case s[0] == '"' || s[0] == '\'':
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, fmt.Errorf("filter: missing %c", s[0])
+			}
+			r.steps = []step{{op: "title", param: s[1 : end+1]}}
+			s = s[end+2:]
+		default:
+			end := strings.IndexAny(s, " \t\n")
+			if end < 0 {
+				end = len(s)
+			}
+			r.steps = []step{{op: "title", param: s[:end]}}
+			s = s[end:]
+		}
+		f.runs = append(f.runs, r)
+	}
+}
+
+// parseSteps parses the steps of a run up to the closing bracket
+// and returns the rest of s.
+func parseSteps(s string) ([]step, string, error) {
+	var steps []step
+	for {
+		if s == "" {
+			return nil, "", errors.New("filter: missing ]")
+		}
+		if s[0] == ']' {
+			return steps, s[1:], nil
+		}
+
+		var st step
+		if s[0] == '!' {
+			st.negate = true
+			s = s[1:]
+		}
+		end := strings.IndexAny(s, "[{<")
+		if end < 0 {
+			return nil, "", errors.New("filter: missing operand")
+		}
+		st.op = s[:end]
+		if i := strings.IndexByte(st.op, ':'); i >= 0 {
+			st.op, st.suffix = st.op[:i], st.op[i+1:]
+		}
+		if st.op == "" {
+			st.op = "title"
+		}
+		if s[end] != '[' {
+			return nil, "", fmt.Errorf("filter: %s: only literal operands are supported", st.op)
+		}
+		s = s[end+1:]
+		end = strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, "", errors.New("filter: missing ]")
+		}
+		st.param = s[:end]
+		s = s[end+1:]
+
+		if err := st.check(); err != nil {
+			return nil, "", err
+		}
+		steps = append(steps, st)
+	}
+}
+
+// check reports the errors in the operands of a step.
+func (st step) check() error {
+	switch st.op {
+	case "is":
+		if st.param != "system" && st.param != "tiddler" {
+			return fmt.Errorf("filter: is[%s] is not supported", st.param)
+		}
+	case "limit", "days":
+		if _, err := strconv.Atoi(st.param); err != nil && st.param != "" {
+			return fmt.Errorf("filter: %s: bad number %q", st.op, st.param)
+		}
+	}
+	return nil
+}
+
+// NeedsText returns true iff evaluating f requires the text of the tiddlers.
+func (f *Filter) NeedsText() bool {
+	for _, r := range f.runs {
+		for _, st := range r.steps {
+			switch st.op {
+			case "search":
+				if st.suffix == "" || strings.Contains(st.suffix, "text") {
+					return true
+				}
+			case "field", "has", "sort":
+				if st.suffix == "text" || st.param == "text" {
+					return true
+				}
+			case "text":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run evaluates f over the tiddlers and returns the indices of the selected
+// tiddlers, in order. now is the time the days operator counts from.
+func (f *Filter) Run(tiddlers []Tiddler, now time.Time) []int {
+	all := make([]int, len(tiddlers))
+	for i := range all {
+		all[i] = i
+	}
+	byTitle := make(map[string]int, len(tiddlers))
+	for i, t := range tiddlers {
+		byTitle[t.Title()] = i
+	}
+	e := &evaluator{tiddlers: tiddlers, byTitle: byTitle, now: now}
+
+	var result []int
+	for _, r := range f.runs {
+		input := all
+		if r.prefix == '+' {
+			input = result
+		}
+		out := input
+		for _, st := range r.steps {
+			out = e.step(st, out)
+		}
+
+		switch r.prefix {
+		case 0:
+			result = union(result, out)
+		case '=':
+			result = append(append([]int(nil), result...), out...)
+		case '+':
+			result = out
+		case '-':
+			result = except(result, out)
+		case '~':
+			if len(result) == 0 {
+				result = out
+			}
+		}
+	}
+	if result == nil {
+		result = []int{}
+	}
+	return result
+}
+
+func union(a, b []int) []int {
+	out := append([]int(nil), a...)
+	seen := make(map[int]bool, len(a))
+	for _, i := range a {
+		seen[i] = true
+	}
+	for _, i := range b {
+		if !seen[i] {
+			seen[i] = true
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func except(a, b []int) []int {
+	remove := make(map[int]bool, len(b))
+	for _, i := range b {
+		remove[i] = true
+	}
+	var out []int
+	for _, i := range a {
+		if !remove[i] {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+type evaluator struct {
+	tiddlers []Tiddler
+	byTitle  map[string]int
+	now      time.Time
+}
+
+// selectIf returns the input tiddlers for which match returns true,
+// or false if the step is negated.
+func (e *evaluator) selectIf(st step, input []int, match func(Tiddler) bool) []int {
+	out := []int{}
+	for _, i := range input {
+		if match(e.tiddlers[i]) != st.negate {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func (e *evaluator) step(st step, input []int) []int {
+	switch st.op {
+	case "title":
+		if st.negate {
+			return e.selectIf(st, input, func(t Tiddler) bool { return t.Title() == st.param })
+		}
+		// title is a constructor: it ignores its input.
+		if i, ok := e.byTitle[st.param]; ok {
+			return []int{i}
+		}
+		return []int{}
+
+	case "tag":
+		return e.selectIf(st, input, func(t Tiddler) bool {
+			for _, tag := range t.Tags() {
+				if tag == st.param {
+					return true
+				}
+			}
+			return false
+		})
+
+	case "field":
+		return e.selectIf(st, input, func(t Tiddler) bool { return t.Get(st.suffix) == st.param })
+
+	case "prefix":
+		return e.selectIf(st, input, func(t Tiddler) bool { return strings.HasPrefix(t.Title(), st.param) })
+
+	case "search":
+		fields := []string{"title", "tags", "text"}
+		if st.suffix != "" {
+			fields = strings.Split(st.suffix, ",")
+		}
+		words := strings.Fields(strings.ToLower(st.param))
+		return e.selectIf(st, input, func(t Tiddler) bool {
+			for _, w := range words {
+				found := false
+				for _, f := range fields {
+					if strings.Contains(strings.ToLower(t.Get(f)), w) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+			return true
+		})
+
+	case "has":
+		return e.selectIf(st, input, func(t Tiddler) bool { return t.Get(st.param) != "" })
+
+	case "is":
+		return e.selectIf(st, input, func(t Tiddler) bool {
+			if st.param == "system" {
+				return strings.HasPrefix(t.Title(), "$:/")
+			}
+			return true // is[tiddler]: all the tiddlers are stored ones.
+		})
+
+	case "days":
+		field := st.suffix
+		if field == "" {
+			field = "modified"
+		}
+		n, _ := strconv.Atoi(st.param)
+		y, m, d := e.now.Date()
+		today := time.Date(y, m, d, 0, 0, 0, 0, e.now.Location())
+		return e.selectIf(st, input, func(t Tiddler) bool {
+			date, ok := parseDate(t.Get(field))
+			if !ok {
+				return false
+			}
+			if n <= 0 {
+				// Within the last -n days (and today).
+				return !date.Before(today.AddDate(0, 0, n))
+			}
+			// Within today and the next n days.
+			return !date.Before(today) && date.Before(today.AddDate(0, 0, n+1))
+		})
+
+	case "sort":
+		field := st.param
+		if field == "" {
+			field = "title"
+		}
+		out := append([]int(nil), input...)
+		sort.SliceStable(out, func(i, j int) bool {
+			a := strings.ToLower(e.tiddlers[out[i]].Get(field))
+			b := strings.ToLower(e.tiddlers[out[j]].Get(field))
+			if st.negate {
+				return a > b
+			}
+			return a < b
+		})
+		return out
+
+	case "limit":
+		n, _ := strconv.Atoi(st.param)
+		if n < 0 {
+			n = 0
+		}
+		if n >= len(input) {
+			return input
+		}
+		if st.negate {
+			return input[len(input)-n:]
+		}
+		return input[:n]
+
+	default:
+		// An unknown operator is the name of a field: [modifier[joe]].
+		return e.selectIf(st, input, func(t Tiddler) bool { return t.Get(st.op) == st.param })
+	}
+}
+
+// parseDate parses a TiddlyWiki date (YYYYMMDDhhmmssXXX, UTC).
+func parseDate(s string) (time.Time, bool) {
+	if len(s) < 8 {
+		return time.Time{}, false
+	}
+	layout := "20060102150405"
+	if len(s) < len(layout) {
+		layout = layout[:len(s)]
+	} else {
+		s = s[:len(layout)]
+	}
+	t, err := time.ParseInLocation(layout, s, time.UTC)
+	return t, err == nil
+}
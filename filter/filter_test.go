@@ -0,0 +1,107 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var tiddlers = []Tiddler{
+	{"title": "Alpha", "tags": []interface{}{"Project", "Go"}, "modified": "20201010120000000", "modifier": "ann", "text": "the quick brown fox"},
+	{"title": "Beta", "tags": "Project [[Long tag]]", "modified": "20201012120000000", "modifier": "bob", "text": "lazy dog"},
+	{"title": "$:/config/Thing", "tags": []interface{}{"Project"}, "modified": "20201011120000000"},
+	{"title": "Gamma", "modified": "20200101000000000", "caption": "G"},
+	{"title": "Alphabet", "modified": "20201012000000000"},
+}
+
+func titles(f *Filter, now time.Time) string {
+	var out []string
+	for _, i := range f.Run(tiddlers, now) {
+		out = append(out, tiddlers[i].Title())
+	}
+	return strings.Join(out, ",")
+}
+
+func TestRun(t *testing.T) {
+	now := time.Date(2020, 10, 12, 15, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		filter, want string
+	}{
+		{"[tag[Project]]", "Alpha,Beta,$:/config/Thing"},
+		{"[tag[Project]!is[system]sort[modified]limit[1]]", "Alpha"},
+		{"[tag[Project]!is[system]!sort[modified]]", "Beta,Alpha"},
+		{"[tag[Long tag]]", "Beta"},
+		{"[!tag[Project]]", "Gamma,Alphabet"},
+		{"[prefix[Alpha]]", "Alpha,Alphabet"},
+		{"[search[quick fox]]", "Alpha"},
+		{"[search:title[alpha]]", "Alpha,Alphabet"},
+		{"[has[caption]]", "Gamma"},
+		{"[field:modifier[bob]]", "Beta"},
+		{"[modifier[ann]]", "Alpha"},
+		{"[days[0]]", "Beta,Alphabet"},
+		{"[days[-1]]", "Beta,$:/config/Thing,Alphabet"},
+		{"[days[-2]!is[system]sort[]]", "Alpha,Alphabet,Beta"},
+		{"[is[system]]", "$:/config/Thing"},
+		{"Gamma [[Alpha]] 'Missing'", "Gamma,Alpha"},
+		{"[prefix[Alpha]] +[limit[1]]", "Alpha"},
+		{"[prefix[Alpha]] -Alpha", "Alphabet"},
+		{"[tag[None]] ~Gamma", "Gamma"},
+		{"Gamma :else[[Alpha]]", "Gamma"},
+		{"Gamma Gamma", "Gamma"},
+		{"Gamma =Gamma", "Gamma,Gamma"},
+		{"[sort[title]!limit[2]]", "Beta,Gamma"},
+	} {
+		f, err := Parse(tc.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+			continue
+		}
+		if got := titles(f, now); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.filter, tc.want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"[tag[x]", "[tag{x}]", "[is[orphan]]", "[limit[x]]", "[[x", "+"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%s: want an error", s)
+		}
+	}
+}
+
+func TestNeedsText(t *testing.T) {
+	for s, want := range map[string]bool{
+		"[tag[x]]":            false,
+		"[search[x]]":         true,
+		"[search:title[x]]":   false,
+		"[has[text]]":         true,
+		"[!is[system]sort[]]": false,
+	} {
+		f, _ := Parse(s)
+		if f.NeedsText() != want {
+			t.Errorf("%s: want %v", s, want)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	got := Tiddler{"tags": "a [[b c]]  d"}.Tags()
+	if want := []string{"a", "b c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
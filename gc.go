@@ -0,0 +1,59 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/opennota/widdly/store"
+)
+
+// openStore opens the store at dataSource, exiting with the error
+// MustOpen panics with if it can't, e.g. if the store is in use.
+func openStore(dataSource string) (s store.TiddlerStore) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return store.MustOpen(dataSource)
+}
+
+// collectGarbage implements the gc command, which reclaims the space taken
+// by the revision texts no longer referenced.
+func collectGarbage(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	db := fs.String("db", "widdly.db", "Database file")
+	compress := fs.String("compress", "", "Optional compression of the migrated revision texts (deflate)")
+	fs.Parse(args)
+
+	if err := store.CheckCompression(*compress); err != nil {
+		log.Fatal(err)
+	}
+	store.Compression = *compress
+
+	c, ok := openStore(*db).(store.Collector)
+	if !ok {
+		log.Fatal("the storage engine does not keep revision texts as blobs")
+	}
+	stats, err := c.GC(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("migrated %d revisions, kept %d blobs, removed %d (%d bytes)\n",
+		stats.Migrated, stats.Blobs, stats.Removed, stats.Freed)
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/subtle"
 	"flag"
 	"io/ioutil"
@@ -35,6 +36,9 @@ import (
 	"github.com/kardianos/osext"
 
 	"github.com/opennota/widdly/api"
+	"github.com/opennota/widdly/audit"
+	"github.com/opennota/widdly/backup"
+	"github.com/opennota/widdly/oidc"
 	"github.com/opennota/widdly/store"
 	_ "./store/sqlite"
 	//_ "github.com/opennota/widdly/store/bolt"
@@ -43,17 +47,115 @@ import (
 var (
 	addr       = flag.String("http", "127.0.0.1:8080", "HTTP service address")
 	password   = flag.String("p", "", "Optional password to protect the wiki (the username is widdly)")
+	passwdFile = flag.String("passwd-file", "", "Optional file containing a bcrypt hash of the password (see widdly hash-password)")
 	dataSource = flag.String("db", "widdly.db", "Database file")
+	host       = flag.String("host", "", "Public host name (and port) of the wiki, checked against Origin and Referer of writes (by default the Host header)")
+	issuer     = flag.String("oidc-issuer", "", "Optional OpenID Connect issuer URL to log in with instead of a password")
+	clientID   = flag.String("oidc-client-id", "", "OpenID Connect client ID (the client secret is read from WIDDLY_OIDC_CLIENT_SECRET)")
+	redirect   = flag.String("oidc-redirect-url", "", "OpenID Connect redirect URL, e.g. https://wiki.example.com/oidc/callback")
+	domains    = flag.String("oidc-domains", "", "Comma-separated email domains allowed to log in with OpenID Connect (by default any)")
+	auditFile  = flag.String("audit", "", "Optional file to record an audit log of all changes to")
+	admins     = flag.String("admins", "", "Comma-separated users allowed to query the audit log, collect garbage and take backups (by default nobody)")
+	attachDir  = flag.String("attachments", "", "Directory to store binary attachments in (by default next to the database, with .files appended; not used with encryption)")
+	filesDir   = flag.String("files", "", "Optional directory of static files to serve under /files/")
+	keyFile    = flag.String("key-file", "", "Optional file holding the secret to encrypt the tiddlers with (or set WIDDLY_PASSPHRASE)")
+	compress   = flag.String("compress", "", "Optional compression of the stored texts of tiddlers and revisions (deflate)")
+	proxies    = flag.String("trusted-proxies", "", "Comma-separated IP addresses or CIDR networks of reverse proxies whose X-Forwarded-For to trust")
+
+	backupDir    = flag.String("backup-dir", "", "Optional directory to write scheduled backups to")
+	backupEvery  = flag.Duration("backup-every", 24*time.Hour, "Interval between the scheduled backups")
+	backupKeep   = flag.Int("backup-keep", 7, "Number of the scheduled backups to keep (0 means all)")
+	backupMaxAge = flag.Duration("backup-max-age", 0, "Age of the scheduled backups to remove, e.g. 720h (0 means never)")
 
 	hashKey      = securecookie.GenerateRandomKey(64)
 	secureCookie = securecookie.New(hashKey, nil)
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-password":
+			hashPassword(os.Args[2:])
+			return
+		case "sync":
+			syncRemote(os.Args[2:])
+			return
+		case "static":
+			generateSite(os.Args[2:])
+			return
+		case "gc":
+			collectGarbage(os.Args[2:])
+			return
+		case "backup":
+			backupStore(os.Args[2:])
+			return
+		case "restore":
+			restoreStore(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
+	api.Host = *host
+	if err := store.CheckCompression(*compress); err != nil {
+		log.Fatal(err)
+	}
+	store.Compression = *compress
+	if *proxies != "" {
+		nets, err := api.ParseTrustedProxies(*proxies)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.TrustedProxies = nets
+	}
+
 	// Open the data store and tell HTTP handlers to use it.
-	api.Store = store.MustOpen(*dataSource)
+	// All writes go through the broadcaster, which feeds the change feed.
+	db := store.MustOpen(*dataSource)
+	s := encryptStore(db, *dataSource, *keyFile)
+	events := store.NewBroadcaster(s)
+	api.Store = events
+	api.Events = events
+	if c, ok := db.(store.Collector); ok {
+		api.Collector = c
+	}
+
+	// Store the content of binary tiddlers as files, unless it is encrypted.
+	if *attachDir == "" {
+		*attachDir = *dataSource + ".files"
+	}
+	api.Attachments = attachments(s, *attachDir)
+
+	// Optionally back up the store and the attachments on schedule and on demand.
+	if *backupDir != "" {
+		if *backupEvery <= 0 {
+			log.Fatal("-backup-every must be positive")
+		}
+		opts := backup.Options{
+			Dir:    *backupDir,
+			Every:  *backupEvery,
+			Keep:   *backupKeep,
+			MaxAge: *backupMaxAge,
+		}
+		go backup.Run(context.Background(), db, *attachDir, opts)
+		api.Backup = func(ctx context.Context) (string, error) {
+			return backup.Take(ctx, db, *attachDir, opts, time.Now())
+		}
+	}
+	if *filesDir != "" {
+		api.Files = http.Dir(*filesDir)
+	}
+
+	// Optionally record all changes to an audit log.
+	if *auditFile != "" {
+		l, err := audit.Open(*auditFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.Audit = l
+	}
+	api.Admins = splitList(*admins)
 
 	// Maybe read index.html from a zip archive appended to the current executable.
 	wikiData := tryReadWikiFromExecutable()
@@ -74,38 +176,79 @@ func main() {
 	}
 
 	// Optionally protect by a password.
-	if *password != "" {
-		// Select an appropriate bcrypt cost.
-		bcryptCost := bcrypt.DefaultCost
-		for cost := bcrypt.MinCost + 1; cost <= bcrypt.MaxCost; cost++ {
-			start := time.Now()
-			if _, err := bcrypt.GenerateFromPassword([]byte("qwerty"), cost); err != nil {
-				log.Fatal(err)
-			}
-			if time.Since(start) > time.Second {
-				bcryptCost = cost - 1
-				break
-			}
-		}
-
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*password), bcryptCost)
-		if err != nil {
-			log.Fatal(err)
+	hashedPassword, err := passwordHash()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *issuer != "" {
+		if hashedPassword != nil {
+			log.Fatal("password and OpenID Connect authentication cannot be used together")
 		}
+		setupOIDC()
+	} else if hashedPassword != nil {
 		// Set api.Authenticate and provide a login handler for simple password authentication.
+		// Failed attempts are tracked per client IP and per username to slow down password guessing.
+		guard := api.NewGuard()
+		api.SharedUser = true // Everybody is widdly.
 		api.Authenticate = func(w http.ResponseWriter, r *http.Request) {
 			user, pass, ok := r.BasicAuth()
-			if !ok || bcrypt.CompareHashAndPassword(hashedPassword, []byte(pass)) != nil ||
+			if !ok {
+				w.Header().Add("Www-Authenticate", `Basic realm="Who are you?"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// Check counts the attempt until Fail or Succeed decides it.
+			ip := api.ClientIP(r)
+			if wait := guard.Check(ip, user); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+				http.Error(w, "too many failed login attempts", http.StatusTooManyRequests)
+				return
+			}
+			if bcrypt.CompareHashAndPassword(hashedPassword, []byte(pass)) != nil ||
 				subtle.ConstantTimeCompare([]byte(user), []byte("widdly")) != 1 { // DON'T use subtle.ConstantTimeCompare like this!
+				guard.Fail(ip, user)
 				w.Header().Add("Www-Authenticate", `Basic realm="Who are you?"`)
 				w.WriteHeader(http.StatusUnauthorized)
+				return
 			}
+			guard.Succeed(ip, user)
 		}
 	}
 
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
+// setupOIDC sets api.Authenticate and api.CurrentUser to log in with an OpenID Connect issuer.
+func setupOIDC() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	p, err := oidc.New(ctx, oidc.Config{
+		Issuer:       *issuer,
+		ClientID:     *clientID,
+		ClientSecret: os.Getenv("WIDDLY_OIDC_CLIENT_SECRET"),
+		RedirectURL:  *redirect,
+		Domains:      splitList(*domains),
+		Cookie:       secureCookie,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle(p.CallbackPath(), p)
+	api.Authenticate = p.Authenticate
+	api.CurrentUser = p.User
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // pathToWiki returns a path that should be checked for index.html.
 // If there is index.html, it should be put next to the executable.
 // If for some reason pathToWiki fails to find the path to the current executable,
@@ -0,0 +1,279 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package merge implements three-way merging of tiddlers.
+package merge
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Conflict markers; the labels follow the opening and closing markers.
+const (
+	markerOurs   = "<<<<<<< "
+	markerSep    = "======="
+	markerTheirs = ">>>>>>> "
+)
+
+// splitLines splits s into lines, keeping the line terminators,
+// so that joining the lines gives s back.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// maxMatchWork bounds the number of line comparisons match makes, as it
+// takes time proportional to the product of the numbers of changed lines.
+const maxMatchWork = 1 << 26
+
+// match returns, for every line of a, the index of the matching line of b
+// in a longest common subsequence of a and b, or -1 if the line is not matched.
+// If too many lines have changed, only the common prefix and suffix are
+// matched, so that the rest is merged as a single chunk.
+func match(a, b []string) []int {
+	// Skip the common prefix and suffix, which are matched anyway,
+	// to keep the work small for the usual case of a small edit.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	m := make([]int, len(a))
+	for i := 0; i < pre; i++ {
+		m[i] = i
+	}
+	for i := 0; i < suf; i++ {
+		m[len(a)-1-i] = len(b) - 1 - i
+	}
+	for i := pre; i < len(a)-suf; i++ {
+		m[i] = -1
+	}
+	if (len(a)-pre-suf)*(len(b)-pre-suf) > maxMatchWork {
+		return m
+	}
+
+	// Number the distinct lines, so that they are compared as integers.
+	ids := make(map[string]int)
+	number := func(lines []string) []int {
+		n := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			n[i] = id
+		}
+		return n
+	}
+	x, y := number(a[pre:len(a)-suf]), number(b[pre:len(b)-suf])
+	hirschberg(x, y, pre, pre, m)
+	return m
+}
+
+// hirschberg sets m[xoff+i] to yoff+j for the lines x[i] and y[j] matched
+// in a longest common subsequence of x and y. It takes time proportional
+// to len(x)*len(y), but only linear space, so that large texts can be merged.
+func hirschberg(x, y []int, xoff, yoff int, m []int) {
+	if len(x) == 0 || len(y) == 0 {
+		return
+	}
+	if len(x) == 1 {
+		for j := range y {
+			if y[j] == x[0] {
+				m[xoff] = yoff + j
+				break
+			}
+		}
+		return
+	}
+
+	// Split x in half and y where an LCS crosses from one half to the other.
+	mid := len(x) / 2
+	fwd := lcsPrefixes(x[:mid], y)
+	bwd := lcsSuffixes(x[mid:], y)
+	k, best := 0, int32(-1)
+	for j := range fwd {
+		if l := fwd[j] + bwd[j]; l > best {
+			k, best = j, l
+		}
+	}
+	hirschberg(x[:mid], y[:k], xoff, yoff, m)
+	hirschberg(x[mid:], y[k:], xoff+mid, yoff+k, m)
+}
+
+// lcsPrefixes returns the lengths of the LCS of x and y[:j] for every j.
+func lcsPrefixes(x, y []int) []int32 {
+	prev, cur := make([]int32, len(y)+1), make([]int32, len(y)+1)
+	for _, xi := range x {
+		for j := 1; j <= len(y); j++ {
+			switch {
+			case xi == y[j-1]:
+				cur[j] = prev[j-1] + 1
+			case prev[j] >= cur[j-1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// lcsSuffixes returns the lengths of the LCS of x and y[j:] for every j.
+func lcsSuffixes(x, y []int) []int32 {
+	prev, cur := make([]int32, len(y)+1), make([]int32, len(y)+1)
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				cur[j] = prev[j+1] + 1
+			case prev[j] >= cur[j+1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j+1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Text merges the changes made to base in ours and in theirs, line by line
+// (diff3). It returns the merged text and whether it is free of conflicts.
+// The conflicting regions are enclosed in conflict markers labelled
+// with oursLabel and theirsLabel.
+func Text(base, ours, theirs, oursLabel, theirsLabel string) (string, bool) {
+	o, a, b := splitLines(base), splitLines(ours), splitLines(theirs)
+	ma, mb := match(o, a), match(o, b)
+
+	var out []string
+	clean := true
+	i, ia, ib := 0, 0, 0
+	for {
+		// Copy the stable lines, unchanged in both.
+		for i < len(o) && ma[i] == ia && mb[i] == ib {
+			out = append(out, o[i])
+			i, ia, ib = i+1, ia+1, ib+1
+		}
+		if i == len(o) && ia == len(a) && ib == len(b) {
+			break
+		}
+
+		// Find the end of the unstable chunk: the next base line matched in both.
+		j := i
+		for j < len(o) && (ma[j] < 0 || mb[j] < 0) {
+			j++
+		}
+		ja, jb := len(a), len(b)
+		if j < len(o) {
+			ja, jb = ma[j], mb[j]
+		}
+
+		co, ca, cb := o[i:j], a[ia:ja], b[ib:jb]
+		switch {
+		case equal(ca, co):
+			out = append(out, cb...)
+		case equal(cb, co), equal(ca, cb):
+			out = append(out, ca...)
+		default:
+			clean = false
+			out = append(out, markerOurs+oursLabel+"\n")
+			out = append(out, terminated(ca)...)
+			out = append(out, markerSep+"\n")
+			out = append(out, terminated(cb)...)
+			out = append(out, markerTheirs+theirsLabel+"\n")
+		}
+		i, ia, ib = j, ja, jb
+	}
+	return strings.Join(out, ""), clean
+}
+
+// terminated returns lines with the last line terminated by a newline,
+// so that a conflict marker following them starts on a line of its own.
+func terminated(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	t := append([]string(nil), lines...)
+	t[len(t)-1] += "\n"
+	return t
+}
+
+// Fields merges the changes made to the base fields in ours and in theirs,
+// field by field. Where both sides changed a field differently, theirs wins
+// and the field is reported as conflicting, unless it is listed in ignore,
+// in which case theirs wins silently.
+func Fields(base, ours, theirs map[string]interface{}, ignore ...string) (map[string]interface{}, []string) {
+	keys := make(map[string]bool)
+	for _, m := range []map[string]interface{}{base, ours, theirs} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	ignored := make(map[string]bool)
+	for _, k := range ignore {
+		ignored[k] = true
+	}
+
+	merged := make(map[string]interface{})
+	var conflicts []string
+	for k := range keys {
+		bv, bok := base[k]
+		ov, ook := ours[k]
+		tv, tok := theirs[k]
+
+		v, ok := tv, tok
+		switch {
+		case ook == tok && reflect.DeepEqual(ov, tv):
+		case ook == bok && reflect.DeepEqual(ov, bv):
+		case tok == bok && reflect.DeepEqual(tv, bv):
+			v, ok = ov, ook
+		case !ignored[k]:
+			conflicts = append(conflicts, k)
+		}
+		if ok {
+			merged[k] = v
+		}
+	}
+	sort.Strings(conflicts)
+	return merged, conflicts
+}
@@ -0,0 +1,132 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package merge
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	for _, tc := range []struct {
+		base, ours, theirs string
+		want               string
+		clean              bool
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", true},
+		{"a\nb\nc\n", "A\nb\nc\n", "a\nb\nC\n", "A\nb\nC\n", true},
+		{"a\nb\nc\n", "a\nb\nc\nd\n", "z\na\nb\nc\n", "z\na\nb\nc\nd\n", true},
+		{"a\nb\nc\n", "a\nc\n", "a\nb\nc\nd", "a\nc\nd", true},
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nX\nc\n", "a\nX\nc\n", true},
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nY\nc\n", "a\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\nc\n", false},
+		{"", "x", "y", "<<<<<<< ours\nx\n=======\ny\n>>>>>>> theirs\n", false},
+		{"", "", "new", "new", true},
+	} {
+		got, clean := Text(tc.base, tc.ours, tc.theirs, "ours", "theirs")
+		if got != tc.want || clean != tc.clean {
+			t.Errorf("Text(%q, %q, %q) = %q, %v; want %q, %v", tc.base, tc.ours, tc.theirs, got, clean, tc.want, tc.clean)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	// lcs is the textbook quadratic-space computation of the LCS length.
+	lcs := func(a, b []string) int {
+		l := make([][]int, len(a)+1)
+		for i := range l {
+			l[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				switch {
+				case a[i] == b[j]:
+					l[i][j] = l[i+1][j+1] + 1
+				case l[i+1][j] > l[i][j+1]:
+					l[i][j] = l[i+1][j]
+				default:
+					l[i][j] = l[i][j+1]
+				}
+			}
+		}
+		return l[0][0]
+	}
+	lines := func(r *rand.Rand) []string {
+		s := make([]string, r.Intn(20))
+		for i := range s {
+			s[i] = strconv.Itoa(r.Intn(4))
+		}
+		return s
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 1000; n++ {
+		a, b := lines(r), lines(r)
+		m := match(a, b)
+		matched, last := 0, -1
+		for i, j := range m {
+			if j < 0 {
+				continue
+			}
+			if j <= last || a[i] != b[j] {
+				t.Fatalf("match(%q, %q) = %v: not a common subsequence", a, b, m)
+			}
+			matched, last = matched+1, j
+		}
+		if want := lcs(a, b); matched != want {
+			t.Fatalf("match(%q, %q) = %v: want %d lines matched, got %d", a, b, m, want, matched)
+		}
+	}
+}
+
+func TestTextLarge(t *testing.T) {
+	// Texts rewritten throughout are merged as a single chunk rather than
+	// compared line by line.
+	var base, ours, theirs []string
+	for i := 0; i < 20000; i++ {
+		base = append(base, "line "+strconv.Itoa(i)+"\n")
+		ours = append(ours, "ours "+strconv.Itoa(i)+"\n")
+		theirs = append(theirs, "line "+strconv.Itoa(i)+"\n")
+	}
+	theirs[0] = "changed\n"
+	if _, clean := Text(strings.Join(base, ""), strings.Join(ours, ""), strings.Join(theirs, ""), "ours", "theirs"); clean {
+		t.Error("want a conflict")
+	}
+	if merged, clean := Text(strings.Join(base, ""), strings.Join(base, ""), strings.Join(ours, ""), "ours", "theirs"); !clean || merged != strings.Join(ours, "") {
+		t.Error("want theirs when ours is unchanged")
+	}
+}
+
+func TestFields(t *testing.T) {
+	base := map[string]interface{}{"tags": "a", "color": "red", "caption": "x", "modified": "1"}
+	ours := map[string]interface{}{"tags": "a b", "color": "red", "caption": "y", "modified": "2"}
+	theirs := map[string]interface{}{"tags": "a", "color": "blue", "caption": "z", "list": "l", "modified": "3"}
+
+	merged, conflicts := Fields(base, ours, theirs, "modified")
+	want := map[string]interface{}{"tags": "a b", "color": "blue", "caption": "z", "list": "l", "modified": "3"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("want %v, got %v", want, merged)
+	}
+	if !reflect.DeepEqual(conflicts, []string{"caption"}) {
+		t.Errorf("want a conflict on caption, got %v", conflicts)
+	}
+
+	// A field deleted on one side and unchanged on the other is deleted.
+	merged, conflicts = Fields(map[string]interface{}{"x": "1"}, map[string]interface{}{}, map[string]interface{}{"x": "1"})
+	if len(merged) != 0 || len(conflicts) != 0 {
+		t.Errorf("want x deleted without conflicts, got %v, %v", merged, conflicts)
+	}
+}
@@ -0,0 +1,508 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package oidc implements OpenID Connect login (the authorization code flow
+// with PKCE) as an alternative to the password authentication.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	sessionCookie = "widdly_session"
+	loginCookie   = "widdly_oidc"
+)
+
+// Config configures a Provider.
+type Config struct {
+	Issuer       string   // The issuer URL, e.g. https://accounts.google.com
+	ClientID     string   // The client ID registered with the issuer
+	ClientSecret string   // The client secret (optional for public clients)
+	RedirectURL  string   // The absolute URL of the callback, e.g. https://wiki.example.com/oidc/callback
+	Domains      []string // Allowed email domains; if empty, any verified email is allowed
+
+	// Cookie encodes and decodes the session cookies.
+	Cookie *securecookie.SecureCookie
+
+	// SessionTTL is how long a login lasts. By default, 12 hours.
+	SessionTTL time.Duration
+
+	// Client is the HTTP client used to talk to the issuer.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Provider authenticates users against an OpenID Connect issuer.
+type Provider struct {
+	cfg          Config
+	callbackPath string
+
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey // by key ID
+	now  func() time.Time
+}
+
+// session is the content of the session cookie.
+type session struct {
+	User    string
+	Expires int64
+}
+
+// pendingLogin is the content of the cookie which binds
+// the callback to the browser that started the login.
+type pendingLogin struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Return   string
+}
+
+// New fetches the issuer's discovery document and returns a Provider.
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: issuer, client ID and redirect URL are required")
+	}
+	if cfg.Cookie == nil {
+		return nil, errors.New("oidc: cookie codec is required")
+	}
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = 12 * time.Hour
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	redirect, err := url.Parse(cfg.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, cfg.Client, wellKnown, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: want %q, got %q", cfg.Issuer, doc.Issuer)
+	}
+
+	return &Provider{
+		cfg:           cfg,
+		callbackPath:  redirect.Path,
+		authEndpoint:  doc.AuthorizationEndpoint,
+		tokenEndpoint: doc.TokenEndpoint,
+		jwksURI:       doc.JWKSURI,
+	}, nil
+}
+
+// CallbackPath returns the path the Provider's ServeHTTP should be registered at.
+func (p *Provider) CallbackPath() string {
+	return p.callbackPath
+}
+
+func (p *Provider) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// User returns the name of the logged in user, or an empty string.
+func (p *Provider) User(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	var s session
+	if err := p.cfg.Cookie.Decode(sessionCookie, c.Value, &s); err != nil {
+		return ""
+	}
+	if p.clock().Unix() >= s.Expires {
+		return ""
+	}
+	return s.User
+}
+
+// Authenticate can be used as api.Authenticate.
+// It lets the requests with a valid session through. Browsers navigating
+// to a page are redirected to the issuer to log in; other requests get
+// 401 Unauthorized.
+func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == p.callbackPath || p.User(r) != "" {
+		return
+	}
+	if r.Method != "GET" || r.Header.Get("X-Requested-With") != "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pl := pendingLogin{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString() + randomString(),
+		Return:   r.URL.RequestURI(),
+	}
+	encoded, err := p.cfg.Cookie.Encode(loginCookie, pl)
+	if err != nil {
+		log.Println("ERR", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    encoded,
+		Path:     p.callbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(pl.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {pl.State},
+		"nonce":                 {pl.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// ServeHTTP handles the redirect back from the issuer: it exchanges
+// the authorization code for an ID token, verifies the token and
+// starts a session.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(loginCookie)
+	if err != nil {
+		http.Error(w, "login session expired", http.StatusBadRequest)
+		return
+	}
+	var pl pendingLogin
+	if err := p.cfg.Cookie.Decode(loginCookie, c.Value, &pl); err != nil {
+		http.Error(w, "login session expired", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: p.callbackPath, MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+	if q.Get("state") == "" || q.Get("state") != pl.State {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	rawToken, err := p.exchange(r.Context(), q.Get("code"), pl.Verifier)
+	if err != nil {
+		log.Println("ERR oidc:", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	user, err := p.verify(r.Context(), rawToken, pl.Nonce)
+	if err != nil {
+		log.Println("ERR oidc:", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+
+	expires := p.clock().Add(p.cfg.SessionTTL)
+	encoded, err := p.cfg.Cookie.Encode(sessionCookie, session{user, expires.Unix()})
+	if err != nil {
+		log.Println("ERR", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    encoded,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Println("LOGIN", user)
+
+	ret := pl.Return
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") {
+		ret = "/"
+	}
+	http.Redirect(w, r, ret, http.StatusFound)
+}
+
+// exchange redeems the authorization code at the token endpoint and returns the raw ID token.
+func (p *Provider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.cfg.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("token endpoint returned %s: %s", resp.Status, body)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("no id_token in the token response")
+	}
+	return tok.IDToken, nil
+}
+
+// claims are the ID token claims widdly cares about.
+type claims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      audience    `json:"aud"`
+	Expires       int64       `json:"exp"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // Some issuers send "true" instead of true.
+}
+
+// audience is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// verify checks the signature and the claims of the ID token and
+// returns the identity of the user.
+func (p *Provider) verify(ctx context.Context, rawToken, nonce string) (string, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", fmt.Errorf("bad ID token signature: %v", err)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return "", err
+	}
+	if c.Issuer != p.cfg.Issuer {
+		return "", fmt.Errorf("ID token issued by %q", c.Issuer)
+	}
+	found := false
+	for _, aud := range c.Audience {
+		found = found || aud == p.cfg.ClientID
+	}
+	if !found {
+		return "", errors.New("ID token issued for another client")
+	}
+	if p.clock().Unix() >= c.Expires {
+		return "", errors.New("ID token expired")
+	}
+	if c.Nonce != nonce {
+		return "", errors.New("ID token nonce mismatch")
+	}
+
+	if c.Email == "" {
+		if len(p.cfg.Domains) > 0 {
+			return "", errors.New("ID token has no email")
+		}
+		return c.Subject, nil
+	}
+	// An issuer which does not say whether the email is verified is trusted,
+	// unless the email is what grants access.
+	if v := fmt.Sprint(c.EmailVerified); v != "true" && (v != "<nil>" || len(p.cfg.Domains) > 0) {
+		return "", fmt.Errorf("email %s is not verified", c.Email)
+	}
+	if !p.allowed(c.Email) {
+		return "", fmt.Errorf("email %s is not in an allowed domain", c.Email)
+	}
+	return c.Email, nil
+}
+
+// allowed returns true iff email belongs to one of the allowed domains.
+func (p *Provider) allowed(email string) bool {
+	if len(p.cfg.Domains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+	for _, d := range p.cfg.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the issuer's public key with the given ID,
+// refetching the key set if the key is unknown (keys get rotated).
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, p.cfg.Client, p.jwksURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// randomString returns a random URL-safe string with 128 bits of entropy.
+func randomString() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
@@ -0,0 +1,231 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// fakeIssuer is a minimal OpenID Connect issuer.
+type fakeIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	email     string
+	verified  interface{} // email_verified claim; nil leaves it out
+	challenge string      // code_challenge of the pending authorization
+	nonce     string      // nonce of the pending authorization
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := &fakeIssuer{key: key, email: "alice@example.com", verified: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fi.URL,
+			"authorization_endpoint": fi.URL + "/authorize",
+			"token_endpoint":         fi.URL + "/token",
+			"jwks_uri":               fi.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != fi.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   fi.URL,
+			"sub":   "1234",
+			"aud":   "widdly",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": fi.nonce,
+			"email": fi.email,
+		}
+		if fi.verified != nil {
+			claims["email_verified"] = fi.verified
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": fi.sign(t, claims)})
+	})
+	fi.Server = httptest.NewServer(mux)
+	return fi
+}
+
+func (fi *fakeIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, fi.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newProvider(t *testing.T, fi *fakeIssuer, domains ...string) *Provider {
+	p, err := New(context.Background(), Config{
+		Issuer:      fi.URL,
+		ClientID:    "widdly",
+		RedirectURL: "http://wiki.example.com/oidc/callback",
+		Domains:     domains,
+		Cookie:      securecookie.New(securecookie.GenerateRandomKey(32), nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// login goes through the whole flow and returns the response to the callback.
+func login(t *testing.T, fi *fakeIssuer, p *Provider) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.Authenticate(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("want 302 Found, got %d", w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("want PKCE with S256, got %q", q.Get("code_challenge_method"))
+	}
+	fi.challenge = q.Get("code_challenge")
+	fi.nonce = q.Get("nonce")
+
+	r := httptest.NewRequest("GET", "/oidc/callback?code=the-code&state="+url.QueryEscape(q.Get("state")), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	fi := newFakeIssuer(t)
+	defer fi.Close()
+	p := newProvider(t, fi, "example.com")
+
+	w := login(t, fi, p)
+	if w.Code != http.StatusFound {
+		t.Fatalf("want 302 Found, got %d: %s", w.Code, w.Body)
+	}
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Errorf("want redirect to /, got %q", loc)
+	}
+
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if user := p.User(r); user != "alice@example.com" {
+		t.Errorf("want alice@example.com, got %q", user)
+	}
+	w = httptest.NewRecorder()
+	p.Authenticate(w, r)
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Errorf("want the request to be let through, got %d", w.Code)
+	}
+}
+
+func TestLoginDomainNotAllowed(t *testing.T) {
+	fi := newFakeIssuer(t)
+	defer fi.Close()
+	fi.email = "mallory@example.org"
+	p := newProvider(t, fi, "example.com")
+
+	if w := login(t, fi, p); w.Code != http.StatusForbidden {
+		t.Errorf("want 403 Forbidden, got %d", w.Code)
+	}
+}
+
+func TestLoginEmailNotVerified(t *testing.T) {
+	fi := newFakeIssuer(t)
+	defer fi.Close()
+
+	fi.verified = false
+	if w := login(t, fi, newProvider(t, fi)); w.Code != http.StatusForbidden {
+		t.Errorf("want 403 Forbidden for an unverified email, got %d", w.Code)
+	}
+
+	fi.verified = nil
+	if w := login(t, fi, newProvider(t, fi, "example.com")); w.Code != http.StatusForbidden {
+		t.Errorf("want 403 Forbidden when the email grants access but is not said to be verified, got %d", w.Code)
+	}
+	if w := login(t, fi, newProvider(t, fi)); w.Code != http.StatusFound {
+		t.Errorf("want 302 Found without domain restrictions, got %d", w.Code)
+	}
+}
+
+func TestLoginBadState(t *testing.T) {
+	fi := newFakeIssuer(t)
+	defer fi.Close()
+	p := newProvider(t, fi)
+
+	w := httptest.NewRecorder()
+	p.Authenticate(w, httptest.NewRequest("GET", "/", nil))
+	r := httptest.NewRequest("GET", "/oidc/callback?code=the-code&state=forged", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400 Bad Request, got %d", w.Code)
+	}
+}
+
+func TestUnauthenticatedXHR(t *testing.T) {
+	fi := newFakeIssuer(t)
+	defer fi.Close()
+	p := newProvider(t, fi)
+
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/x", nil)
+	r.Header.Set("X-Requested-With", "TiddlyWiki")
+	w := httptest.NewRecorder()
+	p.Authenticate(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("want 401 Unauthorized, got %d", w.Code)
+	}
+}
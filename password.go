@@ -0,0 +1,107 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHashEnv is the environment variable that may hold a bcrypt hash of the password.
+const passwordHashEnv = "WIDDLY_PASSWORD_HASH"
+
+// passwordHash returns the bcrypt hash of the password protecting the wiki,
+// or nil if the wiki is not protected by a password.
+// A precomputed hash is taken from the -passwd-file file or from the
+// WIDDLY_PASSWORD_HASH environment variable; failing that, the -p password
+// is hashed.
+func passwordHash() ([]byte, error) {
+	var hash []byte
+	switch {
+	case *passwdFile != "":
+		data, err := ioutil.ReadFile(*passwdFile)
+		if err != nil {
+			return nil, err
+		}
+		hash = bytes.TrimSpace(data)
+	case os.Getenv(passwordHashEnv) != "":
+		hash = []byte(strings.TrimSpace(os.Getenv(passwordHashEnv)))
+	case *password != "":
+		return bcrypt.GenerateFromPassword([]byte(*password), bcryptCost())
+	default:
+		return nil, nil
+	}
+	if *password != "" {
+		return nil, errors.New("-p cannot be used together with a precomputed password hash")
+	}
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return nil, fmt.Errorf("invalid password hash: %v", err)
+	}
+	return hash, nil
+}
+
+// bcryptCost selects an appropriate bcrypt cost, i.e. the highest cost
+// for which hashing takes less than a second on this machine.
+func bcryptCost() int {
+	bcryptCost := bcrypt.DefaultCost
+	for cost := bcrypt.MinCost + 1; cost <= bcrypt.MaxCost; cost++ {
+		start := time.Now()
+		if _, err := bcrypt.GenerateFromPassword([]byte("qwerty"), cost); err != nil {
+			log.Fatal(err)
+		}
+		if time.Since(start) > time.Second {
+			bcryptCost = cost - 1
+			break
+		}
+	}
+	return bcryptCost
+}
+
+// hashPassword implements the hash-password command, which reads a password
+// from the standard input and prints its bcrypt hash, suitable for
+// -passwd-file or WIDDLY_PASSWORD_HASH.
+func hashPassword(args []string) {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	cost := fs.Int("cost", 0, "bcrypt cost (by default the highest cost that takes less than a second)")
+	fs.Parse(args)
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && pass == "" {
+		log.Fatal(err)
+	}
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		log.Fatal("empty password")
+	}
+
+	if *cost == 0 {
+		*cost = bcryptCost()
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), *cost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(hash))
+}
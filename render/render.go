@@ -0,0 +1,615 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package render renders a subset of TiddlyWiki wikitext to HTML.
+//
+// Supported are paragraphs, headings (!), lists (*, #, ; and :), block
+// quotes (>), horizontal rules (---), code blocks (```) and code (`),
+// tables (|...|, with ! header cells and h, f and c rows), links ([[...]],
+// [[caption|target]] and bare URLs), transclusions ({{title}},
+// {{title!!field}}, {{title||template}}) and the formatting
+//
+//	''bold'', //italic//, __underline__, ~~strikethrough~~, ^^sup^^, ,,sub,,
+//
+// Macro calls are dropped, widgets render their content only, and other
+// HTML is escaped.
+package render
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// maxDepth is the maximum depth of nested transclusions.
+const maxDepth = 20
+
+// Renderer renders tiddlers to HTML.
+type Renderer struct {
+	// Lookup returns the fields of the tiddler with the given title, the
+	// text included, or false if there is no such tiddler.
+	Lookup func(title string) (map[string]interface{}, bool)
+
+	// URL returns the address a link to the tiddler with the given title
+	// points at.
+	URL func(title string) string
+
+	// File, if not nil, returns the address of the content of a tiddler
+	// kept elsewhere, at its _canonical_uri uri. If it is nil, uri is used.
+	File func(uri string) string
+}
+
+// Render renders the tiddler with the given title to HTML. It returns false
+// if there is no such tiddler.
+func (r *Renderer) Render(title string) (string, bool) {
+	fields, ok := r.Lookup(title)
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	c := &renderer{Renderer: r, b: &b, current: title, stack: []string{title}}
+	c.tiddler(fields, true)
+	return b.String(), true
+}
+
+// renderer holds the state of rendering a tiddler.
+type renderer struct {
+	*Renderer
+	b       *strings.Builder
+	current string   // the title of the current tiddler
+	stack   []string // the titles of the tiddlers being transcluded
+}
+
+func (c *renderer) write(s string) {
+	c.b.WriteString(s)
+}
+
+func (c *renderer) text(s string) {
+	c.b.WriteString(html.EscapeString(s))
+}
+
+// field returns the value of a field as a string.
+func field(fields map[string]interface{}, name string) string {
+	switch v := fields[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s := fmt.Sprint(item)
+			if strings.ContainsAny(s, " \t\n") {
+				s = "[[" + s + "]]"
+			}
+			items[i] = s
+		}
+		return strings.Join(items, " ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// tiddler renders the text of a tiddler according to its type.
+func (c *renderer) tiddler(fields map[string]interface{}, block bool) {
+	text := field(fields, "text")
+	if uri := field(fields, "_canonical_uri"); uri != "" && text == "" {
+		c.external(fields, uri)
+		return
+	}
+	switch typ := field(fields, "type"); {
+	case typ == "" || typ == "text/vnd.tiddlywiki":
+		if block {
+			c.blocks(text)
+		} else {
+			c.inline(strings.TrimSpace(text))
+		}
+	case typ == "image/svg+xml":
+		c.write(`<img src="data:image/svg+xml,` + html.EscapeString(url.PathEscape(text)) + `">`)
+	case strings.HasPrefix(typ, "image/"):
+		c.write(`<img src="data:` + html.EscapeString(typ) + `;base64,` + html.EscapeString(text) + `">`)
+	default:
+		c.write("<pre><code>")
+		c.text(text)
+		c.write("</code></pre>")
+	}
+}
+
+// external renders a tiddler whose content is kept at the address uri,
+// such as a binary attachment: an image as such, anything else as a link.
+// Only relative and external addresses are rendered, not javascript: ones.
+func (c *renderer) external(fields map[string]interface{}, uri string) {
+	if i := strings.IndexAny(uri, ":/?#"); i >= 0 && uri[i] == ':' && !externalRe.MatchString(uri) {
+		return
+	}
+	if c.File != nil {
+		uri = c.File(uri)
+	}
+	if strings.HasPrefix(field(fields, "type"), "image/") {
+		c.write(`<img src="` + html.EscapeString(uri) + `">`)
+		return
+	}
+	c.write(`<a href="` + html.EscapeString(uri) + `">`)
+	c.text(field(fields, "title"))
+	c.write("</a>")
+}
+
+var (
+	headingRe    = regexp.MustCompile(`^(!{1,6})\s*(.*)$`)
+	ruleRe       = regexp.MustCompile(`^-{3,}\s*$`)
+	listRe       = regexp.MustCompile(`^[*#;:>]+`)
+	blockTransRe = regexp.MustCompile(`^\{\{[^{}]+\}\}$`)
+)
+
+// blockStart returns true iff the line starts a block other than a paragraph.
+func blockStart(line string) bool {
+	return strings.HasPrefix(line, "```") || strings.HasPrefix(line, "|") ||
+		headingRe.MatchString(line) || ruleRe.MatchString(line) || listRe.MatchString(line)
+}
+
+// blocks renders wikitext in the block mode.
+func (c *renderer) blocks(text string) {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	lines = skipPragmas(lines)
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case strings.HasPrefix(line, "```"):
+			lang := strings.TrimSpace(line[3:])
+			j := i + 1
+			for j < len(lines) && strings.TrimRight(lines[j], " \t") != "```" {
+				j++
+			}
+			if lang != "" {
+				c.write(`<pre><code class="language-` + html.EscapeString(lang) + `">`)
+			} else {
+				c.write("<pre><code>")
+			}
+			c.text(strings.Join(lines[i+1:min(j, len(lines))], "\n"))
+			c.write("</code></pre>\n")
+			i = j + 1
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			tag := fmt.Sprintf("h%d", len(m[1]))
+			c.write("<" + tag + ">")
+			c.inline(strings.TrimSpace(m[2]))
+			c.write("</" + tag + ">\n")
+			i++
+		case ruleRe.MatchString(line):
+			c.write("<hr>\n")
+			i++
+		case listRe.MatchString(line):
+			j := i + 1
+			for j < len(lines) && listRe.MatchString(lines[j]) {
+				j++
+			}
+			c.list(lines[i:j])
+			i = j
+		case strings.HasPrefix(line, "|"):
+			j := i + 1
+			for j < len(lines) && strings.HasPrefix(lines[j], "|") {
+				j++
+			}
+			c.table(lines[i:j])
+			i = j
+		case blockTransRe.MatchString(strings.TrimSpace(line)):
+			s := strings.TrimSpace(line)
+			c.transclude(s[2:len(s)-2], true)
+			i++
+		default:
+			j := i + 1
+			for j < len(lines) && strings.TrimSpace(lines[j]) != "" && !blockStart(lines[j]) {
+				j++
+			}
+			c.write("<p>")
+			c.inline(strings.Join(lines[i:j], "\n"))
+			c.write("</p>\n")
+			i = j
+		}
+	}
+}
+
+// skipPragmas skips the pragmas (\define ... \end, \import etc.) at the
+// start of the text.
+func skipPragmas(lines []string) []string {
+	for len(lines) > 0 {
+		line := strings.TrimSpace(lines[0])
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, `\define`) && strings.HasSuffix(line, ")"):
+			// A multi-line macro definition.
+			for len(lines) > 1 && !strings.HasPrefix(strings.TrimSpace(lines[0]), `\end`) {
+				lines = lines[1:]
+			}
+		case strings.HasPrefix(line, `\`):
+		default:
+			return lines
+		}
+		lines = lines[1:]
+	}
+	return lines
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// listTag returns the tag of the list started by the marker.
+func listTag(m byte) string {
+	switch m {
+	case '*':
+		return "ul"
+	case '#':
+		return "ol"
+	case ';', ':':
+		return "dl"
+	}
+	return "blockquote"
+}
+
+// itemTag returns the tag of the list item started by the marker.
+func itemTag(m byte) string {
+	switch m {
+	case ';':
+		return "dt"
+	case ':':
+		return "dd"
+	case '>':
+		return "div"
+	}
+	return "li"
+}
+
+// list renders the lines of a (nested) list.
+func (c *renderer) list(lines []string) {
+	type level struct {
+		tag  string // the tag of the list
+		item string // the tag of the open item, if any
+	}
+	var open []level
+	closeItem := func(l *level) {
+		if l.item != "" {
+			c.write("</" + l.item + ">\n")
+			l.item = ""
+		}
+	}
+	for _, line := range lines {
+		markers := listRe.FindString(line)
+		k := 0
+		for k < len(open) && k < len(markers) && open[k].tag == listTag(markers[k]) {
+			k++
+		}
+		for len(open) > k {
+			l := &open[len(open)-1]
+			closeItem(l)
+			c.write("</" + l.tag + ">\n")
+			open = open[:len(open)-1]
+		}
+		if k == len(markers) {
+			closeItem(&open[k-1])
+		}
+		for ; k < len(markers); k++ {
+			tag := listTag(markers[k])
+			c.write("<" + tag + ">\n")
+			open = append(open, level{tag: tag})
+		}
+		l := &open[len(open)-1]
+		l.item = itemTag(markers[len(markers)-1])
+		c.write("<" + l.item + ">")
+		c.inline(strings.TrimSpace(line[len(markers):]))
+	}
+	for len(open) > 0 {
+		l := &open[len(open)-1]
+		closeItem(l)
+		c.write("</" + l.tag + ">\n")
+		open = open[:len(open)-1]
+	}
+}
+
+var rowTypeRe = regexp.MustCompile(`\|([hfck])\s*$`)
+
+// table renders the lines of a table.
+func (c *renderer) table(lines []string) {
+	var caption string
+	var head, body, foot []string
+	for _, line := range lines {
+		typ := ""
+		if m := rowTypeRe.FindStringSubmatch(line); m != nil {
+			typ = m[1]
+			line = line[:len(line)-len(m[0])+1]
+		}
+		line = strings.TrimRight(line, " \t")
+		line = strings.TrimSuffix(line[1:], "|")
+		switch typ {
+		case "c":
+			caption = line
+		case "h":
+			head = append(head, line)
+		case "f":
+			foot = append(foot, line)
+		case "k":
+		default:
+			body = append(body, line)
+		}
+	}
+
+	c.write("<table>\n")
+	if caption != "" {
+		c.write("<caption>")
+		c.inline(strings.TrimSpace(caption))
+		c.write("</caption>\n")
+	}
+	for _, sect := range []struct {
+		tag  string
+		rows []string
+	}{{"thead", head}, {"tbody", body}, {"tfoot", foot}} {
+		if len(sect.rows) == 0 {
+			continue
+		}
+		c.write("<" + sect.tag + ">\n")
+		for _, row := range sect.rows {
+			c.write("<tr>")
+			for _, cell := range splitCells(row) {
+				tag := "td"
+				if sect.tag == "thead" {
+					tag = "th"
+				}
+				if strings.HasPrefix(cell, "!") {
+					tag, cell = "th", cell[1:]
+				}
+				c.write("<" + tag + align(cell) + ">")
+				c.inline(strings.TrimSpace(cell))
+				c.write("</" + tag + ">")
+			}
+			c.write("</tr>\n")
+		}
+		c.write("</" + sect.tag + ">\n")
+	}
+	c.write("</table>\n")
+}
+
+// align returns the alignment attribute of a table cell, as given by the
+// spaces around its content.
+func align(cell string) string {
+	left := strings.HasPrefix(cell, " ")
+	right := strings.HasSuffix(cell, " ")
+	switch {
+	case left && right:
+		return ` style="text-align:center"`
+	case left:
+		return ` style="text-align:right"`
+	}
+	return ""
+}
+
+// splitCells splits a table row into cells, keeping the links and
+// transclusions whole.
+func splitCells(row string) []string {
+	var cells []string
+	depth, start := 0, 0
+	for i := 0; i < len(row); i++ {
+		switch {
+		case strings.HasPrefix(row[i:], "[[") || strings.HasPrefix(row[i:], "{{"):
+			depth++
+			i++
+		case (strings.HasPrefix(row[i:], "]]") || strings.HasPrefix(row[i:], "}}")) && depth > 0:
+			depth--
+			i++
+		case row[i] == '|' && depth == 0:
+			cells = append(cells, row[start:i])
+			start = i + 1
+		}
+	}
+	return append(cells, row[start:])
+}
+
+var (
+	urlRe      = regexp.MustCompile(`^(?:https?|ftp|mailto):[^\s<>"'\]]*[^\s<>"'\].,;:!?)]`)
+	externalRe = regexp.MustCompile(`^(?:https?|ftp|mailto|file):`)
+	widgetRe   = regexp.MustCompile(`^</?\$[^>]*>`)
+	macroRe    = regexp.MustCompile(`^<<[^>]*>>`)
+)
+
+// formats maps the formatting markers to HTML tags.
+var formats = []struct{ marker, tag string }{
+	{"''", "strong"},
+	{"//", "em"},
+	{"__", "u"},
+	{"~~", "s"},
+	{"^^", "sup"},
+	{",,", "sub"},
+}
+
+// inline renders wikitext in the inline mode.
+func (c *renderer) inline(s string) {
+	start := 0 // the start of the plain text
+	flush := func(i int) {
+		c.text(s[start:i])
+	}
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		n := 0 // the length of the markup at i, if any
+		switch {
+		case strings.HasPrefix(rest, "``"), strings.HasPrefix(rest, "`"):
+			marker := "`"
+			if strings.HasPrefix(rest, "``") {
+				marker = "``"
+			}
+			if end := strings.Index(rest[len(marker):], marker); end >= 0 {
+				flush(i)
+				c.write("<code>")
+				c.text(rest[len(marker) : len(marker)+end])
+				c.write("</code>")
+				n = end + 2*len(marker)
+			}
+		case strings.HasPrefix(rest, "[["):
+			if end := strings.Index(rest, "]]"); end >= 0 {
+				flush(i)
+				c.link(rest[2:end])
+				n = end + 2
+			}
+		case strings.HasPrefix(rest, "{{") && !strings.HasPrefix(rest, "{{{"):
+			if end := strings.Index(rest, "}}"); end >= 0 {
+				flush(i)
+				c.transclude(rest[2:end], false)
+				n = end + 2
+			}
+		case macroRe.MatchString(rest):
+			flush(i)
+			n = len(macroRe.FindString(rest))
+		case widgetRe.MatchString(rest):
+			flush(i)
+			n = len(widgetRe.FindString(rest))
+		case (i == 0 || !isWordChar(s[i-1])) && urlRe.MatchString(rest):
+			flush(i)
+			u := urlRe.FindString(rest)
+			c.write(`<a class="tc-tiddlylink-external" href="` + html.EscapeString(u) + `" rel="noopener noreferrer" target="_blank">`)
+			c.text(u)
+			c.write("</a>")
+			n = len(u)
+		default:
+			for _, f := range formats {
+				if !strings.HasPrefix(rest, f.marker) {
+					continue
+				}
+				if end := strings.Index(rest[2:], f.marker); end > 0 {
+					flush(i)
+					c.write("<" + f.tag + ">")
+					c.inline(rest[2 : 2+end])
+					c.write("</" + f.tag + ">")
+					n = end + 4
+				}
+				break
+			}
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		i += n
+		start = i
+	}
+	flush(len(s))
+}
+
+func isWordChar(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// link renders a link: [[target]] or [[caption|target]].
+func (c *renderer) link(s string) {
+	caption, target := s, s
+	if i := strings.IndexByte(s, '|'); i >= 0 {
+		caption, target = s[:i], s[i+1:]
+	}
+	caption, target = strings.TrimSpace(caption), strings.TrimSpace(target)
+	if externalRe.MatchString(target) {
+		c.write(`<a class="tc-tiddlylink-external" href="` + html.EscapeString(target) + `" rel="noopener noreferrer" target="_blank">`)
+	} else {
+		class := "tc-tiddlylink tc-tiddlylink-resolves"
+		if _, ok := c.Lookup(target); !ok {
+			class = "tc-tiddlylink tc-tiddlylink-missing"
+		}
+		c.write(`<a class="` + class + `" href="` + html.EscapeString(c.URL(target)) + `">`)
+	}
+	c.text(caption)
+	c.write("</a>")
+}
+
+// transclude renders a transclusion: {{title}}, {{title!!field}} or
+// {{title||template}}. An empty title refers to the current tiddler.
+// Missing tiddlers are rendered as nothing.
+func (c *renderer) transclude(s string, block bool) {
+	target, tmpl := s, ""
+	if i := strings.Index(s, "||"); i >= 0 {
+		target, tmpl = s[:i], strings.TrimSpace(s[i+2:])
+	}
+	title, name := target, ""
+	if i := strings.Index(target, "!!"); i >= 0 {
+		title, name = target[:i], strings.TrimSpace(target[i+2:])
+	}
+	if i := strings.Index(title, "##"); i >= 0 {
+		title = title[:i]
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = c.current
+	}
+
+	if tmpl == "" && name != "" && name != "text" {
+		if fields, ok := c.Lookup(title); ok {
+			c.text(field(fields, name))
+		}
+		return
+	}
+	source := title
+	if tmpl != "" {
+		source = tmpl
+	}
+	recursive := len(c.stack) >= maxDepth
+	for _, t := range c.stack {
+		recursive = recursive || t == source
+	}
+	if recursive {
+		c.write(`<span class="tc-error">Recursive transclusion error in transclude widget</span>`)
+		return
+	}
+	fields, ok := c.Lookup(source)
+	if !ok {
+		return
+	}
+	current := c.current
+	c.current, c.stack = title, append(c.stack, source)
+	c.tiddler(fields, block)
+	c.current, c.stack = current, c.stack[:len(c.stack)-1]
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+pre { overflow-x: auto; background: #f4f4f4; padding: .5em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: .2em .5em; }
+.tc-tiddlylink-missing { font-style: italic; }
+.tc-error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{.Body}}
+</body>
+</html>
+`))
+
+// Page writes an HTML page with the given title and body, which must be HTML
+// rendered by a Renderer.
+func Page(w io.Writer, title, body string) error {
+	return page.Execute(w, struct {
+		Title string
+		Body  template.HTML
+	}{title, template.HTML(body)})
+}
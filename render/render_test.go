@@ -0,0 +1,95 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package render
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var tiddlers = map[string]map[string]interface{}{
+	"Other":   {"title": "Other", "text": "Some ''bold'' text", "caption": "The <other>"},
+	"Loop":    {"title": "Loop", "text": "{{Loop}}"},
+	"Tpl":     {"title": "Tpl", "text": "Caption: {{!!caption}}"},
+	"Code":    {"title": "Code", "type": "application/javascript", "text": "a < b"},
+	"Tagged":  {"title": "Tagged", "tags": []interface{}{"a b", "c"}},
+	"Current": {"title": "Current"},
+	"Image":   {"title": "Image", "type": "image/png", "_canonical_uri": "/files/0123.png"},
+	"Paper":   {"title": "Paper", "type": "application/pdf", "_canonical_uri": "/files/4567.pdf"},
+	"Evil":    {"title": "Evil", "type": "application/pdf", "_canonical_uri": "javascript:alert(1)"},
+}
+
+func render(text string) string {
+	tiddlers["Current"]["text"] = text
+	r := &Renderer{
+		Lookup: func(title string) (map[string]interface{}, bool) {
+			fields, ok := tiddlers[title]
+			return fields, ok
+		},
+		URL: func(title string) string { return "/render/" + title },
+	}
+	html, _ := r.Render("Current")
+	return strings.TrimRight(html, "\n")
+}
+
+func TestRender(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"Hello,\nworld", "<p>Hello,\nworld</p>"},
+		{"one\n\ntwo", "<p>one</p>\n<p>two</p>"},
+		{"!! Heading", "<h2>Heading</h2>"},
+		{"''b'' //i// __u__ ~~s~~ ^^sup^^ ,,sub,,", "<p><strong>b</strong> <em>i</em> <u>u</u> <s>s</s> <sup>sup</sup> <sub>sub</sub></p>"},
+		{"''//nested//''", "<p><strong><em>nested</em></strong></p>"},
+		{"a <b> & `c <d>`", "<p>a &lt;b&gt; &amp; <code>c &lt;d&gt;</code></p>"},
+		{"```go\nif a < b {\n}\n```", "<pre><code class=\"language-go\">if a &lt; b {\n}</code></pre>"},
+		{"* a\n* b\n** c\n# d", "<ul>\n<li>a</li>\n<li>b<ul>\n<li>c</li>\n</ul>\n</li>\n</ul>\n<ol>\n<li>d</li>\n</ol>"},
+		{"; term\n: definition", "<dl>\n<dt>term</dt>\n<dd>definition</dd>\n</dl>"},
+		{"> quote", "<blockquote>\n<div>quote</div>\n</blockquote>"},
+		{"---", "<hr>"},
+		{"[[Other]] [[see|Missing]]", `<p><a class="tc-tiddlylink tc-tiddlylink-resolves" href="/render/Other">Other</a> <a class="tc-tiddlylink tc-tiddlylink-missing" href="/render/Missing">see</a></p>`},
+		{"[[site|https://example.com/]] and https://example.com/a.",
+			`<p><a class="tc-tiddlylink-external" href="https://example.com/" rel="noopener noreferrer" target="_blank">site</a> and <a class="tc-tiddlylink-external" href="https://example.com/a" rel="noopener noreferrer" target="_blank">https://example.com/a</a>.</p>`},
+		{"|!A|!B|\n|[[x|Other]]| 2 |", "<table>\n<tbody>\n<tr><th>A</th><th>B</th></tr>\n<tr><td><a class=\"tc-tiddlylink tc-tiddlylink-resolves\" href=\"/render/Other\">x</a></td><td style=\"text-align:center\">2</td></tr>\n</tbody>\n</table>"},
+		{"|Caption|c\n|A|B|h\n|1|2|", "<table>\n<caption>Caption</caption>\n<thead>\n<tr><th>A</th><th>B</th></tr>\n</thead>\n<tbody>\n<tr><td>1</td><td>2</td></tr>\n</tbody>\n</table>"},
+		{"{{Other}}", "<p>Some <strong>bold</strong> text</p>"},
+		{"See {{Other}}.", "<p>See Some <strong>bold</strong> text.</p>"},
+		{"{{Other!!caption}}", "The &lt;other&gt;"},
+		{"{{Other||Tpl}}", "<p>Caption: The &lt;other&gt;</p>"},
+		{"{{Tagged!!tags}}", "[[a b]] c"},
+		{"{{Missing}}", ""},
+		{"{{Loop}}", `<span class="tc-error">Recursive transclusion error in transclude widget</span>`},
+		{"{{Code}}", "<pre><code>a &lt; b</code></pre>"},
+		{"{{Image}}", `<img src="/files/0123.png">`},
+		{"{{Paper}}", `<a href="/files/4567.pdf">Paper</a>`},
+		{"{{Evil}}", ""},
+		{"\\define m()\nx\n\\end\n<<m>> <$link to=\"Other\">text</$link>", "<p> text</p>"},
+	} {
+		if got := render(tc.text); got != tc.want {
+			t.Errorf("%q:\nwant %s\n got %s", tc.text, tc.want, got)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Page(&buf, "A <title>", "<p>body</p>"); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	if !strings.Contains(page, "<title>A &lt;title&gt;</title>") || !strings.Contains(page, "<p>body</p>") {
+		t.Errorf("unexpected page: %s", page)
+	}
+}
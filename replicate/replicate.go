@@ -0,0 +1,555 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package replicate exchanges changes between two widdly instances.
+//
+// The server side is the /replicate endpoint (see package api):
+// GET /replicate?since=<seq> serves a Feed of the changes made after the
+// change <seq>, and POST /replicate applies a Batch of changes and responds
+// with a Result for every change.
+//
+// The client side (Client.Sync) pulls the remote changes, pushes the local
+// ones and merges the tiddlers changed on both sides, remembering where it
+// left off in a checkpoint file.
+//
+// The attachments the tiddlers' _canonical_uri fields point to (see package
+// attach) travel along with the tiddlers, so that every instance can serve
+// them. An instance keeping no attachments, such as an encrypted one, gets
+// their content back in the text of the tiddlers.
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/merge"
+	"github.com/opennota/widdly/store"
+)
+
+// Change is a change exchanged between instances.
+type Change struct {
+	Seq      int64                  `json:"seq,omitempty"`
+	Title    string                 `json:"title"`
+	Deleted  bool                   `json:"deleted,omitempty"`
+	Revision int                    `json:"revision,omitempty"` // The revision on the sending side
+	Base     int                    `json:"base"`               // The revision on the receiving side the change is based on; 0 if none
+	Tiddler  map[string]interface{} `json:"tiddler,omitempty"`  // The fat tiddler, unless deleted
+	File     []byte                 `json:"file,omitempty"`     // The attachment the tiddler's _canonical_uri points to, if any
+}
+
+// Feed is a list of changes served by GET /replicate.
+type Feed struct {
+	Seq     int64    `json:"seq"` // The sequence number of the latest change
+	Changes []Change `json:"changes"`
+}
+
+// Batch is a list of changes sent with POST /replicate.
+type Batch struct {
+	Changes []Change `json:"changes"`
+}
+
+// Result is the outcome of applying a change.
+type Result struct {
+	Title    string `json:"title"`
+	Status   string `json:"status"` // "ok", "stale" (the tiddler has changed since Base), "locked" (by another user) or "error"
+	Revision int    `json:"revision,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Tiddler turns the fields of a fat tiddler into a store.Tiddler.
+func Tiddler(title string, fields map[string]interface{}) (store.Tiddler, error) {
+	js := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		js[k] = v
+	}
+	js["bag"] = "bag"
+	text, _ := js["text"].(string)
+	delete(js, "text")
+	delete(js, "revision")
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{Key: title, Meta: meta, Text: text}, nil
+}
+
+// fileHash returns the hash of the attachment the _canonical_uri of a fat
+// tiddler points to, or an empty string if it has none.
+func fileHash(fields map[string]interface{}) string {
+	uri, _ := fields["_canonical_uri"].(string)
+	return attach.URIHash(uri)
+}
+
+// readFile returns the attachment of a fat tiddler stored in files,
+// or nil if it has none or it is missing.
+func readFile(files attach.Dir, fields map[string]interface{}) ([]byte, error) {
+	hash := fileHash(fields)
+	if files == "" || hash == "" {
+		return nil, nil
+	}
+	f, err := files.Open(hash)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// receiveFile stores the attachment sent along with a change in files, or,
+// if files is empty, puts it back into the text of the tiddler of the change.
+func receiveFile(files attach.Dir, c *Change) error {
+	if c.File == nil {
+		return nil
+	}
+	if hash := fileHash(c.Tiddler); hash == "" || attach.Hash(c.File) != hash {
+		return fmt.Errorf("replicate: the attachment of %q does not match its _canonical_uri", c.Title)
+	}
+	if files == "" {
+		fields := copyFields(c.Tiddler)
+		fields["text"] = base64.StdEncoding.EncodeToString(c.File)
+		delete(fields, "_canonical_uri")
+		c.Tiddler = fields
+		return nil
+	}
+	_, err := files.Put(bytes.NewReader(c.File))
+	return err
+}
+
+// FeedSince collects the changes made to s after the change seq, along
+// with the attachments in files of the changed tiddlers.
+func FeedSince(ctx context.Context, s store.TiddlerStore, files attach.Dir, seq int64) (Feed, error) {
+	changes, last, err := s.Since(ctx, seq)
+	if err != nil {
+		return Feed{}, err
+	}
+	feed := Feed{Seq: last, Changes: []Change{}}
+	for _, c := range changes {
+		ch := Change{Seq: c.Seq, Title: c.Tiddler.Key, Deleted: c.Deleted}
+		if !c.Deleted {
+			t, err := s.Get(ctx, c.Tiddler.Key)
+			if err == store.ErrNotFound {
+				continue // Deleted in the meantime; the deletion is a later change.
+			} else if err != nil {
+				return Feed{}, err
+			}
+			ch.Revision = t.Revision()
+			ch.Tiddler, err = t.Fields()
+			if err != nil {
+				return Feed{}, err
+			}
+			ch.File, err = readFile(files, ch.Tiddler)
+			if err != nil {
+				return Feed{}, err
+			}
+		}
+		feed.Changes = append(feed.Changes, ch)
+	}
+	return feed, nil
+}
+
+// Apply applies a change to s, unless the tiddler has changed since the
+// revision the change is based on. The attachment sent along is stored in
+// files before the tiddler pointing to it (see receiveFile).
+func Apply(ctx context.Context, s store.TiddlerStore, files attach.Dir, c Change) Result {
+	res := Result{Title: c.Title, Status: "ok"}
+	current := 0
+	t, err := s.Get(ctx, c.Title)
+	if err == nil {
+		current = t.Revision()
+	} else if err != store.ErrNotFound {
+		return Result{Title: c.Title, Status: "error", Error: err.Error()}
+	}
+	if current != c.Base {
+		res.Status = "stale"
+		res.Revision = current
+		return res
+	}
+
+	if c.Deleted {
+		if current != 0 {
+			err = s.Delete(ctx, c.Title)
+		}
+	} else {
+		err = receiveFile(files, &c)
+		if err == nil {
+			t, err = Tiddler(c.Title, c.Tiddler)
+		}
+		if err == nil {
+			res.Revision, err = s.Put(ctx, t)
+		}
+	}
+	if err != nil {
+		return Result{Title: c.Title, Status: "error", Error: err.Error()}
+	}
+	return res
+}
+
+// Checkpoint records how far the replication has got.
+type Checkpoint struct {
+	Remote    string `json:"remote"`
+	LocalSeq  int64  `json:"local_seq"`  // The local changes up to this one have been pushed
+	RemoteSeq int64  `json:"remote_seq"` // The remote changes up to this one have been pulled
+	// Synced maps titles to the pairs of the local and the remote revision
+	// which were the same tiddler when last synced. A deleted side has revision 0.
+	Synced map[string][2]int `json:"synced"`
+}
+
+// Stats summarizes a sync.
+type Stats struct {
+	Pulled, Pushed, Merged, Conflicts, Stale int
+}
+
+// Client syncs a local store with a remote instance.
+type Client struct {
+	Remote     *url.URL // The base URL of the remote instance; user info is used for basic authentication
+	Store      store.TiddlerStore
+	Checkpoint string // The path of the checkpoint file
+	HTTP       *http.Client
+
+	// Attachments is the local store of the attachments of tiddlers.
+	// If empty, the pulled attachments are kept in the text of the tiddlers.
+	Attachments attach.Dir
+}
+
+func (c *Client) endpoint() string {
+	u := *c.Remote
+	u.User = nil
+	u.Path = "/replicate"
+	u.RawQuery = ""
+	return u.String()
+}
+
+func (c *Client) do(ctx context.Context, method, url string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Requested-With", "TiddlyWiki")
+	if u := c.Remote.User; u != nil {
+		pass, _ := u.Password()
+		req.SetBasicAuth(u.Username(), pass)
+	}
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) loadCheckpoint() (*Checkpoint, error) {
+	cp := &Checkpoint{Remote: c.endpoint(), Synced: make(map[string][2]int)}
+	data, err := ioutil.ReadFile(c.Checkpoint)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Remote != c.endpoint() {
+		return nil, fmt.Errorf("checkpoint %s is for %s", c.Checkpoint, cp.Remote)
+	}
+	if cp.Synced == nil {
+		cp.Synced = make(map[string][2]int)
+	}
+	return cp, nil
+}
+
+// saveCheckpoint writes the checkpoint atomically.
+func (c *Client) saveCheckpoint(cp *Checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.Checkpoint + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Checkpoint)
+}
+
+// local is the local side of a change.
+type local struct {
+	deleted  bool
+	revision int
+	fields   map[string]interface{}
+}
+
+func (c *Client) localState(ctx context.Context, title string) (local, error) {
+	t, err := c.Store.Get(ctx, title)
+	if err == store.ErrNotFound {
+		return local{deleted: true}, nil
+	} else if err != nil {
+		return local{}, err
+	}
+	fields, err := t.Fields()
+	if err != nil {
+		return local{}, err
+	}
+	return local{revision: t.Revision(), fields: fields}, nil
+}
+
+// putLocal saves the fields locally and returns the new local revision.
+func (c *Client) putLocal(ctx context.Context, title string, fields map[string]interface{}) (int, error) {
+	t, err := Tiddler(title, fields)
+	if err != nil {
+		return 0, err
+	}
+	return c.Store.Put(ctx, t)
+}
+
+// Sync pulls the remote changes, pushes the local ones and merges the
+// tiddlers changed on both sides since the last sync. A tiddler changed on
+// one side and deleted on the other is kept. Where the changes to a tiddler
+// overlap, the text gets conflict markers and the fields of the side
+// modified later win.
+func (c *Client) Sync(ctx context.Context) (Stats, error) {
+	var stats Stats
+	cp, err := c.loadCheckpoint()
+	if err != nil {
+		return stats, err
+	}
+
+	var feed Feed
+	err = c.do(ctx, "GET", c.endpoint()+"?since="+strconv.FormatInt(cp.RemoteSeq, 10), nil, &feed)
+	if err != nil {
+		return stats, err
+	}
+	remote := make(map[string]Change)
+	for _, ch := range feed.Changes {
+		if cp.Synced[ch.Title][1] != ch.Revision {
+			remote[ch.Title] = ch
+		}
+	}
+	// Store the pulled attachments first, so that no tiddler saved
+	// locally points to a missing one.
+	for title, ch := range remote {
+		if err := receiveFile(c.Attachments, &ch); err != nil {
+			return stats, err
+		}
+		remote[title] = ch
+	}
+
+	localChanges, localSeq, err := c.Store.Since(ctx, cp.LocalSeq)
+	if err != nil {
+		return stats, err
+	}
+
+	// Pull the remote changes and merge the tiddlers changed on both sides.
+	var push []Change
+	pushed := make(map[string]bool)
+	for _, lc := range localChanges {
+		title := lc.Tiddler.Key
+		l, err := c.localState(ctx, title)
+		if err != nil {
+			return stats, err
+		}
+		synced, known := cp.Synced[title]
+		if known && synced[0] == l.revision {
+			continue // Already synced, e.g. pulled during the previous sync.
+		}
+		if !known && l.deleted {
+			continue // Created and deleted locally in between syncs.
+		}
+		rc, both := remote[title]
+		if !both {
+			push = append(push, Change{Title: title, Deleted: l.deleted, Revision: l.revision, Base: synced[1], Tiddler: l.fields})
+			pushed[title] = true
+			continue
+		}
+		delete(remote, title)
+
+		switch {
+		case l.deleted && rc.Deleted:
+			cp.Synced[title] = [2]int{0, 0}
+		case l.deleted: // Changed remotely, deleted locally: keep the remote one.
+			rev, err := c.putLocal(ctx, title, rc.Tiddler)
+			if err != nil {
+				return stats, err
+			}
+			cp.Synced[title] = [2]int{rev, rc.Revision}
+			stats.Pulled++
+		case rc.Deleted: // Changed locally, deleted remotely: keep the local one.
+			push = append(push, Change{Title: title, Revision: l.revision, Base: 0, Tiddler: l.fields})
+			pushed[title] = true
+		case reflect.DeepEqual(l.fields, rc.Tiddler):
+			cp.Synced[title] = [2]int{l.revision, rc.Revision}
+		default:
+			merged, clean, err := c.merge(ctx, title, synced[0], l, rc)
+			if err != nil {
+				return stats, err
+			}
+			rev, err := c.putLocal(ctx, title, merged)
+			if err != nil {
+				return stats, err
+			}
+			stats.Merged++
+			if !clean {
+				stats.Conflicts++
+			}
+			push = append(push, Change{Title: title, Revision: rev, Base: rc.Revision, Tiddler: merged})
+			pushed[title] = true
+		}
+	}
+	for title, rc := range remote {
+		var rev int
+		if rc.Deleted {
+			l, err := c.localState(ctx, title)
+			if err != nil {
+				return stats, err
+			}
+			if !l.deleted {
+				err = c.Store.Delete(ctx, title)
+				if err != nil {
+					return stats, err
+				}
+			}
+		} else {
+			rev, err = c.putLocal(ctx, title, rc.Tiddler)
+			if err != nil {
+				return stats, err
+			}
+		}
+		cp.Synced[title] = [2]int{rev, rc.Revision}
+		stats.Pulled++
+	}
+	cp.RemoteSeq = feed.Seq
+	err = c.saveCheckpoint(cp)
+	if err != nil {
+		return stats, err
+	}
+
+	// Push the local changes along with their attachments.
+	for i := range push {
+		push[i].File, err = readFile(c.Attachments, push[i].Tiddler)
+		if err != nil {
+			return stats, err
+		}
+	}
+	if len(push) > 0 {
+		var results []Result
+		err = c.do(ctx, "POST", c.endpoint(), Batch{Changes: push}, &results)
+		if err != nil {
+			return stats, err
+		}
+		if len(results) != len(push) {
+			return stats, errors.New("replicate: the number of results does not match the number of changes")
+		}
+		for i, res := range results {
+			ch := push[i]
+			switch res.Status {
+			case "ok":
+				localRev := ch.Revision
+				if ch.Deleted {
+					localRev = 0
+				}
+				cp.Synced[ch.Title] = [2]int{localRev, res.Revision}
+				stats.Pushed++
+			case "stale", "locked":
+				// Changed remotely since the pull, or being edited there;
+				// it will be tried again during the next sync.
+				stats.Stale++
+			default:
+				return stats, fmt.Errorf("replicate: pushing %q: %s", ch.Title, res.Error)
+			}
+		}
+	}
+	if stats.Stale == 0 {
+		cp.LocalSeq = localSeq
+	}
+	return stats, c.saveCheckpoint(cp)
+}
+
+// merge merges the local and the remote changes to a tiddler, using the
+// locally stored revision base as the common ancestor.
+func (c *Client) merge(ctx context.Context, title string, base int, l local, rc Change) (map[string]interface{}, bool, error) {
+	baseFields := map[string]interface{}{}
+	if base > 0 {
+		t, err := c.Store.Revision(ctx, title, base)
+		if err == nil {
+			baseFields, err = t.Fields()
+			if err != nil {
+				return nil, false, err
+			}
+		} else if err != store.ErrNotFound {
+			return nil, false, err
+		}
+	}
+	ours, theirs := copyFields(l.fields), copyFields(rc.Tiddler)
+
+	text, clean := merge.Text(
+		fmt.Sprint(baseFields["text"]),
+		fmt.Sprint(ours["text"]),
+		fmt.Sprint(theirs["text"]),
+		"local",
+		c.Remote.Host,
+	)
+	delete(baseFields, "text")
+	delete(ours, "text")
+	delete(theirs, "text")
+
+	// Where both sides changed a field, the side modified later wins.
+	first, second := ours, theirs
+	if fmt.Sprint(ours["modified"]) > fmt.Sprint(theirs["modified"]) {
+		first, second = theirs, ours
+	}
+	merged, _ := merge.Fields(baseFields, first, second)
+	merged["text"] = text
+	return merged, clean, nil
+}
+
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		c[k] = v
+	}
+	if _, ok := c["text"]; !ok {
+		c["text"] = ""
+	}
+	return c
+}
@@ -0,0 +1,307 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package replicate_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opennota/widdly/api"
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/replicate"
+	"github.com/opennota/widdly/store"
+)
+
+// memStore is an in-memory TiddlerStore keeping the full history.
+type memStore struct {
+	history map[string][]store.Tiddler
+	deleted map[string]bool
+	changes map[string]store.Change
+	seq     int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		history: make(map[string][]store.Tiddler),
+		deleted: make(map[string]bool),
+		changes: make(map[string]store.Change),
+	}
+}
+
+func (s *memStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+	h := s.history[key]
+	if len(h) == 0 || s.deleted[key] {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return h[len(h)-1], nil
+}
+
+func (s *memStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	var all []store.Tiddler
+	for key := range s.history {
+		if t, err := s.Get(ctx, key); err == nil {
+			all = append(all, t)
+		}
+	}
+	return all, nil
+}
+
+func (s *memStore) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
+	all, _ := s.All(ctx)
+	for _, t := range all {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Put(_ context.Context, t store.Tiddler) (int, error) {
+	rev := len(s.history[t.Key]) + 1
+	var js map[string]interface{}
+	if err := json.Unmarshal(t.Meta, &js); err != nil {
+		return 0, err
+	}
+	js["revision"] = rev
+	t.Meta, _ = json.Marshal(js)
+	s.history[t.Key] = append(s.history[t.Key], t)
+	delete(s.deleted, t.Key)
+	s.seq++
+	s.changes[t.Key] = store.Change{Seq: s.seq, Tiddler: t}
+	return rev, nil
+}
+
+func (s *memStore) Revision(_ context.Context, key string, rev int) (store.Tiddler, error) {
+	h := s.history[key]
+	if rev < 1 || rev > len(h) {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return h[rev-1], nil
+}
+
+func (s *memStore) Delete(_ context.Context, key string) error {
+	s.deleted[key] = true
+	s.seq++
+	s.changes[key] = store.Change{Seq: s.seq, Tiddler: store.Tiddler{Key: key}, Deleted: true}
+	return nil
+}
+
+func (s *memStore) Since(_ context.Context, seq int64) ([]store.Change, int64, error) {
+	var changes []store.Change
+	for _, c := range s.changes {
+		if c.Seq > seq {
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Seq < changes[j].Seq })
+	return changes, s.seq, nil
+}
+
+func (s *memStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	revs := make([]int, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			s.Delete(ctx, op.Tiddler.Key)
+		} else {
+			revs[i], _ = s.Put(ctx, op.Tiddler)
+		}
+	}
+	return revs, nil
+}
+
+func (s *memStore) Links(context.Context, store.LinkQuery) ([]store.Link, error) {
+	return nil, nil
+}
+
+func put(t *testing.T, s *memStore, title, text string, fields ...string) {
+	js := map[string]interface{}{"title": title, "text": text}
+	for i := 0; i+1 < len(fields); i += 2 {
+		js[fields[i]] = fields[i+1]
+	}
+	tiddler, err := replicate.Tiddler(title, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(context.Background(), tiddler); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func text(s *memStore, title string) (string, bool) {
+	tiddler, err := s.Get(context.Background(), title)
+	if err != nil {
+		return "", false
+	}
+	return tiddler.Text, true
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, laptop := newMemStore(), newMemStore()
+	api.Store = server
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	c := replicate.Client{Remote: u, Store: laptop, Checkpoint: filepath.Join(dir, "checkpoint")}
+	sync := func() replicate.Stats {
+		t.Helper()
+		stats, err := c.Sync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	put(t, server, "Shared", "a\nb\nc\n")
+	put(t, server, "Doomed", "x")
+	put(t, laptop, "Notes", "offline")
+	if stats := sync(); stats.Pulled != 2 || stats.Pushed != 1 {
+		t.Fatalf("first sync: %+v", stats)
+	}
+	if got, _ := text(server, "Notes"); got != "offline" {
+		t.Errorf("server Notes = %q", got)
+	}
+	if got, _ := text(laptop, "Shared"); got != "a\nb\nc\n" {
+		t.Errorf("laptop Shared = %q", got)
+	}
+
+	// Nothing has changed, nothing is exchanged.
+	if stats := sync(); stats != (replicate.Stats{}) {
+		t.Fatalf("idle sync: %+v", stats)
+	}
+
+	// Both sides edit Shared in different places; the server deletes Doomed.
+	put(t, server, "Shared", "A\nb\nc\n")
+	put(t, laptop, "Shared", "a\nb\nC\n")
+	server.Delete(context.Background(), "Doomed")
+	if stats := sync(); stats.Merged != 1 || stats.Conflicts != 0 {
+		t.Fatalf("merging sync: %+v", stats)
+	}
+	for _, s := range []*memStore{server, laptop} {
+		if got, _ := text(s, "Shared"); got != "A\nb\nC\n" {
+			t.Errorf("Shared = %q, want the merge", got)
+		}
+	}
+	if _, ok := text(laptop, "Doomed"); ok {
+		t.Error("Doomed was not deleted on the laptop")
+	}
+
+	// Overlapping edits get conflict markers on both sides.
+	put(t, server, "Notes", "server")
+	put(t, laptop, "Notes", "laptop")
+	if stats := sync(); stats.Conflicts != 1 {
+		t.Fatalf("conflicting sync: %+v", stats)
+	}
+	got, _ := text(server, "Notes")
+	if !strings.Contains(got, "<<<<<<< local\nlaptop\n=======\nserver\n>>>>>>> ") {
+		t.Errorf("server Notes = %q, want conflict markers", got)
+	}
+	if got2, _ := text(laptop, "Notes"); got2 != got {
+		t.Errorf("laptop Notes = %q, server Notes = %q", got2, got)
+	}
+
+	// The sides have converged.
+	if stats := sync(); stats != (replicate.Stats{}) {
+		t.Fatalf("final sync: %+v", stats)
+	}
+}
+
+func TestSyncAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverFiles, laptopFiles := attach.Dir(filepath.Join(dir, "server")), attach.Dir(filepath.Join(dir, "laptop"))
+	server, laptop := newMemStore(), newMemStore()
+	api.Store, api.Attachments = server, serverFiles
+	defer func() { api.Attachments = "" }()
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	c := replicate.Client{Remote: u, Store: laptop, Checkpoint: filepath.Join(dir, "checkpoint"), Attachments: laptopFiles}
+
+	photo, err := serverFiles.Put(strings.NewReader("photo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan, err := laptopFiles.Put(strings.NewReader("scan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, server, "Photo", "", "type", "image/jpeg", "_canonical_uri", "/files/"+photo+".jpg")
+	put(t, laptop, "Scan", "", "type", "application/pdf", "_canonical_uri", "/files/"+scan+".pdf")
+	if stats, err := c.Sync(context.Background()); err != nil || stats.Pulled != 1 || stats.Pushed != 1 {
+		t.Fatalf("sync: %+v %v", stats, err)
+	}
+
+	for _, f := range []struct {
+		files attach.Dir
+		hash  string
+		want  string
+	}{
+		{laptopFiles, photo, "photo"},
+		{serverFiles, scan, "scan"},
+	} {
+		r, err := f.files.Open(f.hash)
+		if err != nil {
+			t.Errorf("want %s in %s: %v", f.want, f.files, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != f.want {
+			t.Errorf("want %s, got %q", f.want, data)
+		}
+	}
+
+	// An attachment not matching the _canonical_uri is refused.
+	res := replicate.Apply(context.Background(), server, serverFiles, replicate.Change{
+		Title:   "Forged",
+		Tiddler: map[string]interface{}{"title": "Forged", "_canonical_uri": "/files/" + photo + ".jpg"},
+		File:    []byte("forged"),
+	})
+	if res.Status != "error" {
+		t.Errorf("want a forged attachment refused, got %+v", res)
+	}
+	if _, ok := text(server, "Forged"); ok {
+		t.Error("want the tiddler of a forged attachment not saved")
+	}
+
+	// A side keeping no attachments gets them in the text.
+	res = replicate.Apply(context.Background(), server, "", replicate.Change{
+		Title:   "Inline",
+		Tiddler: map[string]interface{}{"title": "Inline", "type": "image/jpeg", "_canonical_uri": "/files/" + photo + ".jpg"},
+		File:    []byte("photo"),
+	})
+	inline, err := server.Get(context.Background(), "Inline")
+	if res.Status != "ok" || err != nil || inline.Text != "cGhvdG8=" || strings.Contains(string(inline.Meta), "_canonical_uri") {
+		t.Errorf("want the attachment inlined, got %+v %v %q %s", res, err, inline.Text, inline.Meta)
+	}
+}
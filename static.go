@@ -0,0 +1,49 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/static"
+	"github.com/opennota/widdly/store"
+)
+
+// generateSite implements the static command, which writes the tiddlers
+// as a static HTML site.
+func generateSite(args []string) {
+	fs := flag.NewFlagSet("static", flag.ExitOnError)
+	out := fs.String("out", "site", "Directory to write the site to")
+	db := fs.String("db", "widdly.db", "Database file")
+	filter := fs.String("filter", "", "TiddlyWiki filter selecting the tiddlers to publish (by default all the non-system ones)")
+	keyFile := fs.String("key-file", "", "Optional file holding the secret the tiddlers are encrypted with (or set WIDDLY_PASSPHRASE)")
+	base := fs.String("base", "", "URL the site will be published at, for the sitemap, e.g. https://docs.example.com/")
+	attachDir := fs.String("attachments", "", "Directory the binary attachments are stored in (by default next to the database, with .files appended)")
+	fs.Parse(args)
+	if *attachDir == "" {
+		*attachDir = *db + ".files"
+	}
+
+	err := static.Generate(context.Background(), encryptStore(store.MustOpen(*db), *db, *keyFile), *out, static.Options{
+		Filter:      *filter,
+		BaseURL:     *base,
+		Attachments: attach.Dir(*attachDir),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
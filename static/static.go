@@ -0,0 +1,393 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package static generates a static HTML site from the tiddlers in a store:
+// a page per tiddler, rendered by the render package, a page per tag, an
+// index page and a sitemap. The attachments the published tiddlers refer to
+// are copied to the files directory of the site.
+package static
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/filter"
+	"github.com/opennota/widdly/render"
+	"github.com/opennota/widdly/store"
+)
+
+// Options controls what is published and how.
+type Options struct {
+	// Filter selects the tiddlers to publish (a TiddlyWiki filter; all of
+	// them by default). System tiddlers and drafts are never published.
+	Filter string
+
+	// BaseURL is the URL the site is published at, which the sitemap
+	// needs for absolute URLs. If empty, the sitemap holds relative ones.
+	BaseURL string
+
+	// Attachments is where the content of binary tiddlers is stored
+	// (see the api package). If empty, the tiddlers keep linking to /files/.
+	Attachments attach.Dir
+}
+
+// site holds the state of generating a site.
+type site struct {
+	ctx     context.Context
+	s       store.TiddlerStore
+	dir     string
+	opts    Options
+	fields  map[string]map[string]interface{} // the fields of the loaded tiddlers, by title
+	pages   map[string]string                 // the file names of the published tiddlers, by title
+	titles  []string                          // the titles of the published tiddlers, sorted
+	tagged  map[string][]string               // the titles of the published tiddlers, by tag
+	tagPage map[string]string                 // the file names of the tag pages, by tag
+	copied  map[string]bool                   // the attachments copied to the files directory, by file name
+	err     error                             // the first error of loading a tiddler or copying an attachment
+}
+
+// Generate writes the site generated from the tiddlers in s to the directory dir.
+func Generate(ctx context.Context, s store.TiddlerStore, dir string, opts Options) error {
+	if opts.Filter == "" {
+		opts.Filter = "[!is[system]]"
+	}
+	if opts.BaseURL != "" && !strings.HasSuffix(opts.BaseURL, "/") {
+		opts.BaseURL += "/"
+	}
+	f, err := filter.Parse(opts.Filter)
+	if err != nil {
+		return err
+	}
+
+	var all []filter.Tiddler
+	err = s.Walk(ctx, func(t store.Tiddler) error {
+		var js filter.Tiddler
+		if err := json.Unmarshal(t.Meta, &js); err != nil {
+			return err
+		}
+		all = append(all, js)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	st := &site{
+		ctx:     ctx,
+		s:       s,
+		dir:     dir,
+		opts:    opts,
+		fields:  make(map[string]map[string]interface{}),
+		pages:   make(map[string]string),
+		tagged:  make(map[string][]string),
+		tagPage: make(map[string]string),
+		copied:  make(map[string]bool),
+	}
+	if f.NeedsText() {
+		for _, t := range all {
+			fields, ok := st.lookup(t.Title())
+			if ok {
+				t["text"] = fields["text"]
+			}
+		}
+		if st.err != nil {
+			return st.err
+		}
+	}
+	for _, i := range f.Run(all, time.Now()) {
+		t := all[i]
+		title := t.Title()
+		if strings.HasPrefix(title, "$:/") || t["draft.of"] != nil {
+			continue
+		}
+		st.titles = append(st.titles, title)
+		for _, tag := range t.Tags() {
+			st.tagged[tag] = append(st.tagged[tag], title)
+		}
+	}
+	sort.Strings(st.titles)
+	taken := map[string]bool{"index": true}
+	for _, title := range st.titles {
+		st.pages[title] = fileName(title, taken)
+	}
+	tags := make([]string, 0, len(st.tagged))
+	for tag := range st.tagged {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	taken = make(map[string]bool)
+	for _, tag := range tags {
+		st.tagPage[tag] = "tags/" + fileName(tag, taken)
+		sort.Strings(st.tagged[tag])
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "tags"), 0755); err != nil {
+		return err
+	}
+	for _, title := range st.titles {
+		if err := st.tiddlerPage(title); err != nil {
+			return err
+		}
+	}
+	for _, tag := range tags {
+		if err := st.tagIndex(tag); err != nil {
+			return err
+		}
+	}
+	if err := st.index(tags); err != nil {
+		return err
+	}
+	return st.sitemap()
+}
+
+// fileName returns a file name for the page of the tiddler with the given
+// title, made of its letters and digits, which is not taken yet (ignoring
+// the case), and marks it taken.
+func fileName(title string, taken map[string]bool) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range title {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	name := b.String()
+	if name == "" {
+		name = "tiddler"
+	}
+	unique := name
+	for n := 2; taken[strings.ToLower(unique)]; n++ {
+		unique = name + "-" + strconv.Itoa(n)
+	}
+	taken[strings.ToLower(unique)] = true
+	return unique + ".html"
+}
+
+// href returns the link to the file name, relative to the directory dir
+// of the site ("" or "tags/").
+func href(dir, name string) string {
+	if dir != "" && strings.HasPrefix(name, dir) {
+		name = strings.TrimPrefix(name, dir)
+	} else if dir != "" {
+		name = "../" + name
+	}
+	return (&url.URL{Path: name}).String()
+}
+
+// lookup returns the fields of the tiddler with the given title,
+// loading it from the store the first time.
+func (st *site) lookup(title string) (map[string]interface{}, bool) {
+	if fields, ok := st.fields[title]; ok {
+		return fields, fields != nil
+	}
+	t, err := st.s.Get(st.ctx, title)
+	if err == nil {
+		var fields map[string]interface{}
+		fields, err = t.Fields()
+		if err == nil {
+			st.fields[title] = fields
+			return fields, true
+		}
+	}
+	if err != store.ErrNotFound && st.err == nil {
+		st.err = err
+	}
+	st.fields[title] = nil
+	return nil, false
+}
+
+// file copies the attachment at the _canonical_uri uri, if it is one,
+// to the files directory and returns the link to the copy.
+func (st *site) file(uri string) string {
+	hash := attach.URIHash(uri)
+	if st.opts.Attachments == "" || hash == "" {
+		return uri
+	}
+	name := strings.TrimPrefix(uri, "/files/")
+	if !st.copied[name] {
+		if err := st.copyAttachment(hash, name); err != nil {
+			if st.err == nil {
+				st.err = err
+			}
+			return uri
+		}
+		st.copied[name] = true
+	}
+	return href("", "files/"+name)
+}
+
+// copyAttachment copies the attachment with the given hash to the files
+// directory as name.
+func (st *site) copyAttachment(hash, name string) error {
+	src, err := st.opts.Attachments.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(filepath.Join(st.dir, "files"), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(filepath.Join(st.dir, "files", name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write writes a page to the file name.
+func (st *site) write(name, title, body string) error {
+	var buf bytes.Buffer
+	if err := render.Page(&buf, title, body); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(st.dir, filepath.FromSlash(name)), buf.Bytes(), 0644)
+}
+
+// tiddlerPage writes the page of the tiddler with the given title.
+func (st *site) tiddlerPage(title string) error {
+	r := &render.Renderer{
+		Lookup: st.lookup,
+		URL: func(title string) string {
+			if name, ok := st.pages[title]; ok {
+				return href("", name)
+			}
+			return "#"
+		},
+		File: st.file,
+	}
+	body, _ := r.Render(title)
+	if st.err != nil {
+		return st.err
+	}
+
+	var b strings.Builder
+	b.WriteString(body)
+	fields, _ := st.lookup(title)
+	if tags := filter.Tiddler(fields).Tags(); len(tags) > 0 {
+		b.WriteString(`<p class="tc-tags">Tags:`)
+		for _, tag := range tags {
+			fmt.Fprintf(&b, ` <a href="%s">%s</a>`, html.EscapeString(href("", st.tagPage[tag])), html.EscapeString(tag))
+		}
+		b.WriteString("</p>\n")
+	}
+	b.WriteString(`<p><a href="index.html">Index</a></p>` + "\n")
+	return st.write(st.pages[title], title, b.String())
+}
+
+// tagIndex writes the page listing the tiddlers tagged with the tag.
+func (st *site) tagIndex(tag string) error {
+	var b strings.Builder
+	if name, ok := st.pages[tag]; ok {
+		fmt.Fprintf(&b, `<p><a href="%s">%s</a></p>`+"\n", html.EscapeString(href("tags/", name)), html.EscapeString(tag))
+	}
+	st.list(&b, "tags/", st.tagged[tag])
+	b.WriteString(`<p><a href="../index.html">Index</a></p>` + "\n")
+	return st.write(st.tagPage[tag], "Tagged "+tag, b.String())
+}
+
+// list writes a list of links to the pages of the tiddlers.
+func (st *site) list(b *strings.Builder, dir string, titles []string) {
+	b.WriteString("<ul>\n")
+	for _, title := range titles {
+		fmt.Fprintf(b, `<li><a href="%s">%s</a></li>`+"\n", html.EscapeString(href(dir, st.pages[title])), html.EscapeString(title))
+	}
+	b.WriteString("</ul>\n")
+}
+
+// index writes the index page, listing all the tiddlers and tags.
+func (st *site) index(tags []string) error {
+	title := "Index"
+	if fields, ok := st.lookup("$:/SiteTitle"); ok {
+		if text, _ := fields["text"].(string); strings.TrimSpace(text) != "" {
+			title = strings.TrimSpace(text)
+		}
+	}
+	if st.err != nil {
+		return st.err
+	}
+
+	var b strings.Builder
+	st.list(&b, "", st.titles)
+	if len(tags) > 0 {
+		b.WriteString("<h2>Tags</h2>\n<ul>\n")
+		for _, tag := range tags {
+			fmt.Fprintf(&b, `<li><a href="%s">%s</a> (%d)</li>`+"\n", html.EscapeString(href("", st.tagPage[tag])), html.EscapeString(tag), len(st.tagged[tag]))
+		}
+		b.WriteString("</ul>\n")
+	}
+	return st.write("index.html", title, b.String())
+}
+
+// sitemap writes sitemap.xml, listing the index and the tiddler pages.
+func (st *site) sitemap() error {
+	type entry struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod,omitempty"`
+	}
+	urls := []entry{{Loc: st.opts.BaseURL}}
+	if urls[0].Loc == "" {
+		urls[0].Loc = "index.html"
+	}
+	for _, title := range st.titles {
+		var lastmod string
+		if t, err := time.Parse("20060102150405", tiddlyDate(st.fields[title])); err == nil {
+			lastmod = t.Format("2006-01-02")
+		}
+		urls = append(urls, entry{st.opts.BaseURL + href("", st.pages[title]), lastmod})
+	}
+	data, err := xml.MarshalIndent(struct {
+		XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+		URLs    []entry  `xml:"url"`
+	}{URLs: urls}, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	return ioutil.WriteFile(filepath.Join(st.dir, "sitemap.xml"), data, 0644)
+}
+
+// tiddlyDate returns the modified date of the tiddler, or its created date,
+// without the milliseconds.
+func tiddlyDate(fields map[string]interface{}) string {
+	for _, name := range []string{"modified", "created"} {
+		if s, _ := fields[name].(string); len(s) >= 14 {
+			return s[:14]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package static
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opennota/widdly/attach"
+	"github.com/opennota/widdly/store"
+)
+
+// walkStore is a store which can only be walked and read from.
+type walkStore struct {
+	store.TiddlerStore
+	tiddlers map[string]store.Tiddler
+}
+
+func (s walkStore) Walk(_ context.Context, fn func(store.Tiddler) error) error {
+	for _, t := range s.tiddlers {
+		t.WithText = false
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s walkStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+	t, ok := s.tiddlers[key]
+	if !ok {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return t, nil
+}
+
+func TestGenerate(t *testing.T) {
+	attachments, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(attachments)
+	hash, err := attach.Dir(attachments).Put(strings.NewReader("PNG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := walkStore{tiddlers: make(map[string]store.Tiddler)}
+	for _, meta := range []string{
+		`{"title":"Hello World","tags":"Docs","modified":"20201010120000000"}`,
+		`{"title":"Hello, world!","tags":["Docs","To do"]}`,
+		`{"title":"Docs"}`,
+		`{"title":"Secret","tags":"Private"}`,
+		`{"title":"$:/SiteTitle"}`,
+		`{"title":"Draft of 'Docs'","draft.of":"Docs"}`,
+		`{"title":"Picture","type":"image/png","_canonical_uri":"/files/` + hash + `.png"}`,
+	} {
+		tiddler := store.Tiddler{Meta: []byte(meta), WithText: true}
+		tiddler.Key = strings.Split(meta, `"`)[3]
+		switch tiddler.Key {
+		case "Hello World":
+			tiddler.Text = "See [[Docs]], [[Secret]] and [[Hello, world!]]\n\n{{Picture}}"
+		case "$:/SiteTitle":
+			tiddler.Text = "My docs"
+		}
+		s.tiddlers[tiddler.Key] = tiddler
+	}
+
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = Generate(context.Background(), s, dir, Options{
+		Filter:      "[!tag[Private]]",
+		BaseURL:     "https://docs.example.com",
+		Attachments: attach.Dir(attachments),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		}
+		return string(data)
+	}
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if want := "Docs.html,Hello-World.html,Hello-world-2.html,Picture.html,files/" + hash + ".png,index.html,sitemap.xml,tags/Docs.html,tags/To-do.html"; strings.Join(files, ",") != want {
+		t.Errorf("want files %s, got %s", want, strings.Join(files, ","))
+	}
+
+	page := read("Hello-World.html")
+	for _, want := range []string{
+		`<h1>Hello World</h1>`,
+		`<a class="tc-tiddlylink tc-tiddlylink-resolves" href="Docs.html">Docs</a>`,
+		`<a class="tc-tiddlylink tc-tiddlylink-resolves" href="#">Secret</a>`,
+		`<a class="tc-tiddlylink tc-tiddlylink-resolves" href="Hello-world-2.html">Hello, world!</a>`,
+		`Tags: <a href="tags/Docs.html">Docs</a>`,
+		`<img src="files/` + hash + `.png"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("want the page to contain %s, got %s", want, page)
+		}
+	}
+	if data := read("files/" + hash + ".png"); data != "PNG" {
+		t.Errorf("want the attachment copied, got %q", data)
+	}
+	if page := read("tags/Docs.html"); !strings.Contains(page, `<p><a href="../Docs.html">Docs</a></p>`) ||
+		!strings.Contains(page, `<li><a href="../Hello-World.html">Hello World</a></li>`+"\n"+`<li><a href="../Hello-world-2.html">Hello, world!</a></li>`) {
+		t.Errorf("unexpected tag page: %s", page)
+	}
+	if page := read("index.html"); !strings.Contains(page, "<title>My docs</title>") ||
+		!strings.Contains(page, `<li><a href="tags/Docs.html">Docs</a> (2)</li>`) {
+		t.Errorf("unexpected index: %s", page)
+	}
+	if sitemap := read("sitemap.xml"); !strings.Contains(sitemap, "<loc>https://docs.example.com/</loc>") ||
+		!strings.Contains(sitemap, "<loc>https://docs.example.com/Hello-World.html</loc>\n    <lastmod>2020-10-10</lastmod>") {
+		t.Errorf("unexpected sitemap: %s", sitemap)
+	}
+}
@@ -15,16 +15,24 @@
 package bolt
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 
 	"github.com/opennota/widdly/store"
 )
 
+// openTimeout is how long MustOpen waits for another process, such as
+// a running widdly, to release the database file.
+var openTimeout = 5 * time.Second
+
 // boltStore is a BoltDB store for tiddlers.
 type boltStore struct {
 	db *bolt.DB
@@ -41,7 +49,10 @@ func init() {
 // creates the necessary buckets and returns a TiddlerStore.
 // MustOpen panics if there is an error.
 func MustOpen(dataSource string) store.TiddlerStore {
-	db, err := bolt.Open(dataSource, 0600, nil)
+	db, err := bolt.Open(dataSource, 0600, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		panic(fmt.Errorf("%s is in use by another process (is widdly running?)", dataSource))
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -54,6 +65,34 @@ func MustOpen(dataSource string) store.TiddlerStore {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists([]byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("blob_ref"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("change"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("change_seq"))
+		if err != nil {
+			return err
+		}
+		err = backfillChanges(tx)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket([]byte("title")) == nil {
+			if err := indexTitles(tx); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket([]byte("link_from")) == nil {
+			return reindexLinks(tx)
+		}
 		return nil
 	})
 	if err != nil {
@@ -68,13 +107,14 @@ func (s *boltStore) Get(_ context.Context, key string) (store.Tiddler, error) {
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("tiddler"))
 		meta := b.Get([]byte(key + "|1"))
-		if meta == nil {
+		if len(meta) == 0 { // Deleted tiddlers are kept as empty values.
 			return store.ErrNotFound
 		}
 		t.Meta = make([]byte, len(meta))
 		copy(t.Meta, meta)
-		t.Text = string(b.Get([]byte(key + "|2")))
-		return nil
+		var err error
+		t.Text, err = store.DecodeText(b.Get([]byte(key + "|2")))
+		return err
 	})
 	if err != nil {
 		return store.Tiddler{}, err
@@ -90,21 +130,148 @@ func copyOf(p []byte) []byte {
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
 // Special tiddlers (like global macros) are returned fat.
-func (s *boltStore) All(_ context.Context) ([]store.Tiddler, error) {
+func (s *boltStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	tiddlers := []store.Tiddler{}
+	err := s.Walk(ctx, func(t store.Tiddler) error {
+		tiddlers = append(tiddlers, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlers, nil
+}
+
+// walkChunk is the number of tiddlers Walk reads in a read transaction.
+const walkChunk = 256
+
+// Walk calls fn for every tiddler (mostly skinny). The tiddlers are read in
+// chunks, each in a read transaction of its own, so that a slow fn does not
+// keep a transaction open; a tiddler written during the walk may be passed
+// as of before or after the write.
+func (s *boltStore) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
+	var after []byte // The last key read
+	for {
+		var chunk []store.Tiddler
+		done := false
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket([]byte("tiddler")).Cursor()
+			k, meta := c.First()
+			if after != nil {
+				k, meta = c.Seek(after)
+				if bytes.Equal(k, after) {
+					k, meta = c.Next()
+				}
+			}
+			for n := 0; n < walkChunk; n++ {
+				if k == nil {
+					done = true
+					return nil
+				}
+				after = copyOf(k)
+				if len(meta) == 0 { // Deleted
+					if k, _ = c.Next(); k != nil {
+						after = copyOf(k)
+					}
+					k, meta = c.Next()
+					continue
+				}
+				t := store.Tiddler{Meta: copyOf(meta)}
+				var text []byte
+				if k, text = c.Next(); k != nil {
+					after = copyOf(k)
+				}
+				if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
+					var err error
+					t.Text, err = store.DecodeText(text)
+					if err != nil {
+						return err
+					}
+					t.WithText = true
+				}
+				chunk = append(chunk, t)
+				k, meta = c.Next()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range chunk {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+		if done {
+			return ctx.Err()
+		}
+	}
+}
+
+// List retrieves a page of the tiddlers (mostly skinny). Pages sorted by
+// title are read with cursor seeks on the title bucket; other sort orders
+// need all the tiddlers to be read and sorted.
+func (s *boltStore) List(ctx context.Context, opts store.ListOptions) ([]store.Tiddler, error) {
+	field, desc := opts.Field()
+	if field != "title" {
+		all, err := s.All(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return store.Page(all, opts), nil
+	}
+
 	tiddlers := []store.Tiddler{}
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("tiddler"))
-		c := b.Cursor()
-		for k, meta := c.First(); k != nil; k, meta = c.Next() {
+		c := tx.Bucket([]byte("title")).Cursor()
+		var k []byte
+		switch {
+		case opts.After != nil && desc:
+			k, _ = c.Seek([]byte(opts.After.Title))
+			if k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		case opts.After != nil:
+			k, _ = c.Seek([]byte(opts.After.Title))
+			if k != nil && string(k) == opts.After.Title {
+				k, _ = c.Next()
+			}
+		case desc:
+			k, _ = c.Last()
+		default:
+			k, _ = c.First()
+		}
+		next := c.Next
+		if desc {
+			next = c.Prev
+		}
+
+		skip := opts.Offset
+		for ; k != nil; k, _ = next() {
+			meta := b.Get([]byte(string(k) + "|1"))
 			if len(meta) == 0 {
-				c.Next()
 				continue
 			}
-			var t store.Tiddler
-			t.Meta = copyOf(meta)
-			_, text := c.Next()
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if opts.Limit > 0 && len(tiddlers) == opts.Limit {
+				break
+			}
+			t := store.Tiddler{Meta: copyOf(meta)}
 			if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
-				t.Text = string(text)
+				var err error
+				t.Text, err = store.DecodeText(b.Get([]byte(string(k) + "|2")))
+				if err != nil {
+					return err
+				}
 				t.WithText = true
 			}
 			tiddlers = append(tiddlers, t)
@@ -129,78 +296,543 @@ func getLastRevision(b *bolt.Bucket, mkey []byte) int {
 // Put saves tiddler to the store, incrementing and returning revision.
 // The tiddler is also written to the tiddler_history bucket.
 func (s *boltStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	var rev int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		rev, err = put(tx, tiddler)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+func put(tx *bolt.Tx, tiddler store.Tiddler) (int, error) {
 	var js map[string]interface{}
 	err := json.Unmarshal(tiddler.Meta, &js)
 	if err != nil {
 		return 0, err
 	}
-	var rev int
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		mkey := []byte(tiddler.Key + "|1")
+	b := tx.Bucket([]byte("tiddler"))
+	mkey := []byte(tiddler.Key + "|1")
 
-		rev = getLastRevision(b, mkey)
-		js["revision"] = rev
-		data, err := json.Marshal(js)
-		if err != nil {
+	rev := getLastRevision(b, mkey)
+	js["revision"] = rev
+	data, err := json.Marshal(js)
+	if err != nil {
+		return 0, err
+	}
+
+	err = b.Put(mkey, data)
+	if err != nil {
+		return 0, err
+	}
+	text, err := store.EncodeText(tiddler.Text)
+	if err != nil {
+		return 0, err
+	}
+	err = b.Put([]byte(tiddler.Key+"|2"), text)
+	if err != nil {
+		return 0, err
+	}
+
+	hash, err := putBlob(tx, tiddler.Text)
+	if err != nil {
+		return 0, err
+	}
+	err = putHistory(tx, []byte(fmt.Sprintf("%s#%d", tiddler.Key, rev)), store.EncodeRevision(hash, data))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Bucket([]byte("title")).Put([]byte(tiddler.Key), nil)
+	if err != nil {
+		return 0, err
+	}
+	err = logChange(tx, tiddler.Key)
+	if err != nil {
+		return 0, err
+	}
+	return rev, indexLinks(tx, tiddler)
+}
+
+// Revision retrieves the given revision of a tiddler from the tiddler_history bucket.
+func (s *boltStore) Revision(_ context.Context, key string, rev int) (store.Tiddler, error) {
+	var data []byte
+	var text string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket([]byte("tiddler_history"))
+		data = copyOf(history.Get([]byte(fmt.Sprintf("%s#%d", key, rev))))
+		if hash, _, ok := store.DecodeRevision(data); ok {
+			var err error
+			text, err = store.DecodeText(tx.Bucket([]byte("blob")).Get([]byte(hash)))
 			return err
 		}
+		return nil
+	})
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	if len(data) == 0 {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	if _, meta, ok := store.DecodeRevision(data); ok {
+		return store.Tiddler{Key: key, Meta: meta, Text: text, WithText: true}, nil
+	}
+	var t store.Tiddler
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	t.Key = key
+	t.WithText = true
+	return t, nil
+}
 
-		err = b.Put(mkey, data)
+// putBlob stores text in the blob bucket, unless it is there already,
+// and counts a reference to it. It returns the hash of the text.
+func putBlob(tx *bolt.Tx, text string) (string, error) {
+	hash := store.BlobHash(text)
+	blobs := tx.Bucket([]byte("blob"))
+	if blobs.Get([]byte(hash)) == nil {
+		data, err := store.EncodeText(text)
 		if err != nil {
-			return err
+			return "", err
+		}
+		err = blobs.Put([]byte(hash), data)
+		if err != nil {
+			return "", err
 		}
-		err = b.Put([]byte(tiddler.Key+"|2"), []byte(tiddler.Text))
+	}
+	return hash, addRef(tx, hash, 1)
+}
+
+// addRef adds n to the reference count of the blob with the given hash.
+func addRef(tx *bolt.Tx, hash string, n int64) error {
+	refs := tx.Bucket([]byte("blob_ref"))
+	var count int64
+	if v := refs.Get([]byte(hash)); len(v) == 8 {
+		count = int64(binary.BigEndian.Uint64(v))
+	}
+	count += n
+	if count < 0 {
+		count = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(count))
+	return refs.Put([]byte(hash), v)
+}
+
+// putHistory writes a revision to the tiddler_history bucket, dropping the
+// reference to the text of the revision it replaces, if any. (A tiddler
+// recreated after being deleted starts over from revision 1.)
+func putHistory(tx *bolt.Tx, key, data []byte) error {
+	history := tx.Bucket([]byte("tiddler_history"))
+	if hash, _, ok := store.DecodeRevision(history.Get(key)); ok {
+		err := addRef(tx, hash, -1)
 		if err != nil {
 			return err
 		}
+	}
+	return history.Put(key, data)
+}
+
+// Delete deletes a tiddler with the given key (title) from the store.
+func (s *boltStore) Delete(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return del(tx, key)
+	})
+}
 
-		js["text"] = tiddler.Text
-		data, err = json.Marshal(js)
+func del(tx *bolt.Tx, key string) error {
+	b := tx.Bucket([]byte("tiddler"))
+	mkey := []byte(key + "|1")
+
+	rev := getLastRevision(b, mkey)
+
+	err := b.Put(mkey, nil)
+	if err != nil {
+		return err
+	}
+	err = b.Put([]byte(key+"|2"), nil)
+	if err != nil {
+		return err
+	}
+
+	err = putHistory(tx, []byte(fmt.Sprintf("%s#%d", key, rev)), nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte("title")).Delete([]byte(key))
+	if err != nil {
+		return err
+	}
+	err = unindexLinks(tx, key)
+	if err != nil {
+		return err
+	}
+	return logChange(tx, key)
+}
+
+// Batch applies the operations in a single transaction.
+func (s *boltStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	revs := make([]int, len(ops))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tiddler"))
+		for i, op := range ops {
+			var err error
+			if !op.Delete {
+				revs[i], err = put(tx, op.Tiddler)
+			} else if len(b.Get([]byte(op.Tiddler.Key+"|1"))) == 0 {
+				err = store.ErrNotFound
+			} else {
+				err = del(tx, op.Tiddler.Key)
+			}
+			if err != nil {
+				return &store.BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// logChange records a change to the tiddler with the given key in the change bucket
+// under the next sequence number, replacing the previous change to the same tiddler.
+// The change_seq bucket maps keys to the sequence numbers of their latest changes.
+func logChange(tx *bolt.Tx, key string) error {
+	changes := tx.Bucket([]byte("change"))
+	seqs := tx.Bucket([]byte("change_seq"))
+
+	seq, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	if prev := seqs.Get([]byte(key)); prev != nil {
+		err = changes.Delete(copyOf(prev))
 		if err != nil {
 			return err
 		}
-		history := tx.Bucket([]byte("tiddler_history"))
-		err = history.Put([]byte(fmt.Sprintf("%s#%d", tiddler.Key, rev)), data)
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	err = changes.Put(k, []byte(key))
+	if err != nil {
+		return err
+	}
+	return seqs.Put([]byte(key), k)
+}
+
+// indexTitles creates the title bucket, which holds the titles of the
+// existing tiddlers as keys, so that they can be listed in title order
+// (the keys of the tiddler bucket, "<title>|1" and "<title>|2", are not:
+// "A B|1" sorts before "A|1").
+func indexTitles(tx *bolt.Tx) error {
+	titles, err := tx.CreateBucket([]byte("title"))
+	if err != nil {
+		return err
+	}
+	c := tx.Bucket([]byte("tiddler")).Cursor()
+	for k, meta := c.First(); k != nil; k, meta = c.Next() {
+		if len(meta) != 0 && bytes.HasSuffix(k, []byte("|1")) {
+			if err := titles.Put(copyOf(k[:len(k)-2]), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backfillChanges logs the existing tiddlers as changes
+// if the database was created before the change log was introduced.
+func backfillChanges(tx *bolt.Tx) error {
+	if tx.Bucket([]byte("change")).Sequence() != 0 {
+		return nil
+	}
+	var keys []string
+	c := tx.Bucket([]byte("tiddler")).Cursor()
+	for k, meta := c.First(); k != nil; k, meta = c.Next() {
+		if len(meta) != 0 && bytes.HasSuffix(k, []byte("|1")) {
+			keys = append(keys, string(k[:len(k)-2]))
+		}
+	}
+	for _, key := range keys {
+		err := logChange(tx, key)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
+// Since returns the latest changes made after the change with the sequence number seq.
+func (s *boltStore) Since(_ context.Context, seq int64) ([]store.Change, int64, error) {
+	changes := []store.Change{}
+	var last int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tiddler"))
+		log := tx.Bucket([]byte("change"))
+		last = int64(log.Sequence())
+
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, uint64(seq+1))
+		c := log.Cursor()
+		for k, key := c.Seek(start); k != nil; k, key = c.Next() {
+			ch := store.Change{
+				Seq:     int64(binary.BigEndian.Uint64(k)),
+				Tiddler: store.Tiddler{Key: string(key)},
+			}
+			meta := b.Get([]byte(string(key) + "|1"))
+			if len(meta) == 0 {
+				ch.Deleted = true
+			} else {
+				ch.Tiddler.Meta = copyOf(meta)
+				if bytes.Contains(meta, []byte(`"$:/tags/Macro"`)) {
+					text, err := store.DecodeText(b.Get([]byte(string(key) + "|2")))
+					if err != nil {
+						return err
+					}
+					ch.Tiddler.Text = text
+					ch.Tiddler.WithText = true
+				}
+			}
+			changes = append(changes, ch)
+		}
 		return nil
 	})
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
-	return rev, nil
+	return changes, last, nil
 }
 
-// Delete deletes a tiddler with the given key (title) from the store.
-func (s *boltStore) Delete(ctx context.Context, key string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		mkey := []byte(key + "|1")
+// The link index consists of two buckets: link_from, with the keys
+// "<from>\x00<to>\x00<kind>", and link_to, with the keys "<to>\x00<from>\x00<kind>".
+
+func linkKey(a, b, kind string) []byte {
+	return []byte(a + "\x00" + b + "\x00" + kind)
+}
 
-		rev := getLastRevision(b, mkey)
+// reindexLinks creates the link index of the existing tiddlers.
+func reindexLinks(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte("link_from"))
+	if err != nil {
+		return err
+	}
+	_, err = tx.CreateBucketIfNotExists([]byte("link_to"))
+	if err != nil {
+		return err
+	}
+	var tiddlers []store.Tiddler
+	b := tx.Bucket([]byte("tiddler"))
+	c := b.Cursor()
+	for k, meta := c.First(); k != nil; k, meta = c.Next() {
+		if len(meta) != 0 && bytes.HasSuffix(k, []byte("|1")) {
+			key := string(k[:len(k)-2])
+			text, err := store.DecodeText(b.Get([]byte(key + "|2")))
+			if err != nil {
+				return err
+			}
+			tiddlers = append(tiddlers, store.Tiddler{
+				Key:  key,
+				Meta: copyOf(meta),
+				Text: text,
+			})
+		}
+	}
+	for _, t := range tiddlers {
+		if err := indexLinks(tx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		err := b.Put(mkey, nil)
+// indexLinks replaces the links from the tiddler in the link index.
+func indexLinks(tx *bolt.Tx, t store.Tiddler) error {
+	err := unindexLinks(tx, t.Key)
+	if err != nil {
+		return err
+	}
+	from, to := tx.Bucket([]byte("link_from")), tx.Bucket([]byte("link_to"))
+	for _, l := range store.ParseLinks(t) {
+		err = from.Put(linkKey(l.From, l.To, l.Kind), nil)
 		if err != nil {
 			return err
 		}
-		err = b.Put([]byte(key+"|2"), nil)
+		err = to.Put(linkKey(l.To, l.From, l.Kind), nil)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		history := tx.Bucket([]byte("tiddler_history"))
-		err = history.Put([]byte(fmt.Sprintf("%s#%d", key, rev)), nil)
+// unindexLinks removes the links from the tiddler with the given key from the link index.
+func unindexLinks(tx *bolt.Tx, key string) error {
+	from, to := tx.Bucket([]byte("link_from")), tx.Bucket([]byte("link_to"))
+	var links []store.Link
+	prefix := []byte(key + "\x00")
+	c := from.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		links = append(links, parseLinkKey(k, false))
+	}
+	for _, l := range links {
+		err := from.Delete(linkKey(l.From, l.To, l.Kind))
 		if err != nil {
 			return err
 		}
+		err = to.Delete(linkKey(l.To, l.From, l.Kind))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLinkKey parses a key of the link_from bucket or, if reverse is true, of the link_to bucket.
+func parseLinkKey(k []byte, reverse bool) store.Link {
+	parts := strings.SplitN(string(k), "\x00", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	if reverse {
+		return store.Link{From: parts[1], To: parts[0], Kind: parts[2]}
+	}
+	return store.Link{From: parts[0], To: parts[1], Kind: parts[2]}
+}
+
+// Links returns the links selected by the query, using the link_to bucket for backlinks.
+func (s *boltStore) Links(ctx context.Context, q store.LinkQuery) ([]store.Link, error) {
+	links := []store.Link{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket, prefix, reverse := "link_from", []byte(nil), false
+		switch {
+		case q.From != "":
+			prefix = []byte(q.From + "\x00")
+		case q.To != "":
+			bucket, prefix, reverse = "link_to", []byte(q.To+"\x00"), true
+		}
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if l := parseLinkKey(k, reverse); q.Match(l) {
+				links = append(links, l)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.SortLinks(links)
+	return links, nil
+}
+
+// GC moves the texts of the revisions saved before the blob bucket existed
+// to blobs, recounts the references and removes the unreferenced blobs.
+// The space is reused by BoltDB, but the file does not shrink.
+func (s *boltStore) GC(ctx context.Context) (store.GCStats, error) {
+	var stats store.GCStats
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		history, blobs := tx.Bucket([]byte("tiddler_history")), tx.Bucket([]byte("blob"))
+		counts := make(map[string]int64)
+		type entry struct{ key, data []byte }
+		var migrated []entry
+		c := history.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if len(v) == 0 {
+				continue
+			}
+			hash, _, ok := store.DecodeRevision(v)
+			if !ok {
+				var t store.Tiddler
+				err := json.Unmarshal(v, &t)
+				if err != nil {
+					return err
+				}
+				hash = store.BlobHash(t.Text)
+				if blobs.Get([]byte(hash)) == nil {
+					data, err := store.EncodeText(t.Text)
+					if err != nil {
+						return err
+					}
+					err = blobs.Put([]byte(hash), data)
+					if err != nil {
+						return err
+					}
+				}
+				migrated = append(migrated, entry{copyOf(k), store.EncodeRevision(hash, t.Meta)})
+			}
+			counts[hash]++
+		}
+		for _, e := range migrated {
+			err := history.Put(e.key, e.data)
+			if err != nil {
+				return err
+			}
+		}
+		stats.Migrated = len(migrated)
 
+		var unreferenced [][]byte
+		c = blobs.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if counts[string(k)] == 0 {
+				unreferenced = append(unreferenced, copyOf(k))
+				stats.Removed++
+				stats.Freed += int64(len(v))
+			} else {
+				stats.Blobs++
+			}
+		}
+		refs := tx.Bucket([]byte("blob_ref"))
+		for _, k := range unreferenced {
+			if err := blobs.Delete(k); err != nil {
+				return err
+			}
+			if err := refs.Delete(k); err != nil {
+				return err
+			}
+		}
+		for hash, n := range counts {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(n))
+			if err := refs.Put([]byte(hash), v); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return store.GCStats{}, err
 	}
-	return nil
+	return stats, nil
+}
+
+// Snapshot writes the database file, as seen by a read transaction, to tw.
+func (s *boltStore) Snapshot(_ context.Context, tw *tar.Writer, name string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0600,
+			Size:     tx.Size(),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(tw)
+		return err
+	})
 }
@@ -0,0 +1,56 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opennota/widdly/store"
+	"github.com/opennota/widdly/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storetest.Run(t, func(t *testing.T) store.TiddlerStore {
+		return MustOpen(filepath.Join(dir, filepath.Base(t.Name())+".db"))
+	})
+}
+
+func TestOpenInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "widdly.db")
+	MustOpen(path)
+
+	defer func(d time.Duration) { openTimeout = d }(openTimeout)
+	openTimeout = 10 * time.Millisecond
+	defer func() {
+		if err, _ := recover().(error); err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("want MustOpen to fail on a store in use, got %v", err)
+		}
+	}()
+	MustOpen(path)
+}
@@ -0,0 +1,174 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Event describes a change made to the store.
+type Event struct {
+	ID       int64  `json:"id"`
+	Action   string `json:"action"` // "put" or "delete"
+	Title    string `json:"title"`
+	Revision int    `json:"revision,omitempty"`
+	Modifier string `json:"modifier,omitempty"`
+}
+
+// Broadcaster is a TiddlerStore which passes everything through to the
+// underlying store and broadcasts the changes to the subscribers.
+// Writes must go through the Broadcaster for the subscribers to see them.
+// The Broadcaster makes them one at a time, so that the events are
+// published in the order the changes are committed.
+type Broadcaster struct {
+	TiddlerStore
+
+	// Backlog is the number of recent events kept for the subscribers
+	// resuming after a disconnect.
+	Backlog int
+
+	writes sync.Mutex // Held while writing and publishing the changes
+
+	mu     sync.Mutex
+	lastID int64
+	recent []Event
+	subs   map[chan Event]struct{}
+}
+
+// NewBroadcaster returns a Broadcaster wrapping s.
+func NewBroadcaster(s TiddlerStore) *Broadcaster {
+	return &Broadcaster{
+		TiddlerStore: s,
+		Backlog:      1000,
+		// Event IDs keep increasing across restarts, so that a subscriber
+		// resuming with an ID from before a restart notices it has missed events.
+		lastID: time.Now().UnixNano(),
+		subs:   make(map[chan Event]struct{}),
+	}
+}
+
+// Put saves the tiddler to the underlying store and broadcasts the change.
+func (b *Broadcaster) Put(ctx context.Context, tiddler Tiddler) (int, error) {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+
+	rev, err := b.TiddlerStore.Put(ctx, tiddler)
+	if err != nil {
+		return rev, err
+	}
+	var meta struct{ Modifier string }
+	json.Unmarshal(tiddler.Meta, &meta)
+	b.publish(Event{Action: "put", Title: tiddler.Key, Revision: rev, Modifier: meta.Modifier})
+	return rev, nil
+}
+
+// Delete deletes the tiddler from the underlying store and broadcasts the change.
+func (b *Broadcaster) Delete(ctx context.Context, key string) error {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+
+	err := b.TiddlerStore.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	b.publish(Event{Action: "delete", Title: key})
+	return nil
+}
+
+// Batch applies the operations to the underlying store and broadcasts the changes.
+func (b *Broadcaster) Batch(ctx context.Context, ops []Op) ([]int, error) {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+
+	revs, err := b.TiddlerStore.Batch(ctx, ops)
+	if err != nil {
+		return revs, err
+	}
+	for i, op := range ops {
+		if op.Delete {
+			b.publish(Event{Action: "delete", Title: op.Tiddler.Key})
+			continue
+		}
+		var meta struct{ Modifier string }
+		json.Unmarshal(op.Tiddler.Meta, &meta)
+		b.publish(Event{Action: "put", Title: op.Tiddler.Key, Revision: revs[i], Modifier: meta.Modifier})
+	}
+	return revs, nil
+}
+
+// List lists a page of the tiddlers of the underlying store (see List).
+func (b *Broadcaster) List(ctx context.Context, opts ListOptions) ([]Tiddler, error) {
+	return List(ctx, b.TiddlerStore, opts)
+}
+
+func (b *Broadcaster) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	b.recent = append(b.recent, e)
+	if len(b.recent) > b.Backlog {
+		b.recent = b.recent[len(b.recent)-b.Backlog:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// The subscriber can't keep up; drop it. It may resume later
+			// from the last event it has seen.
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on.
+// The channel is closed if the subscriber falls too far behind.
+// cancel must be called when the subscriber is done.
+//
+// If lastID is not zero, Subscribe also returns the events published after
+// the event with that ID. complete is false if some of those events are no
+// longer available, in which case the subscriber should reload everything.
+func (b *Broadcaster) Subscribe(lastID int64) (backlog []Event, complete bool, ch <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete = true
+	if lastID != 0 {
+		switch {
+		case lastID > b.lastID:
+			complete = false // An ID from the future; the server must have restarted.
+		case lastID == b.lastID:
+		case len(b.recent) == 0 || lastID < b.recent[0].ID-1:
+			complete = false
+		default:
+			backlog = append(backlog, b.recent[lastID-b.recent[0].ID+1:]...)
+		}
+	}
+
+	c := make(chan Event, 64)
+	b.subs[c] = struct{}{}
+	return backlog, complete, c, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seqStore numbers the puts in the order they are committed, taking its time
+// to return, so that writes overlapping in time report back out of order.
+type seqStore struct {
+	TiddlerStore
+	mu  sync.Mutex
+	seq int
+}
+
+func (s *seqStore) Put(context.Context, Tiddler) (int, error) {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+	time.Sleep(time.Duration(seq%3) * time.Millisecond)
+	return seq, nil
+}
+
+func TestBroadcasterOrder(t *testing.T) {
+	b := NewBroadcaster(&seqStore{})
+	_, _, ch, cancel := b.Subscribe(0)
+	defer cancel()
+
+	const n = 30
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Put(context.Background(), Tiddler{Key: "a"})
+		}()
+	}
+	wg.Wait()
+
+	var last Event
+	for i := 0; i < n; i++ {
+		e := <-ch
+		if e.Revision != i+1 || e.ID <= last.ID {
+			t.Fatalf("want the events in the order of the commits, got revision %d (id %d) after %d (id %d)", e.Revision, e.ID, last.Revision, last.ID)
+		}
+		last = e
+	}
+}
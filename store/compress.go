@@ -0,0 +1,91 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression is the compression the backends apply to the texts of the
+// tiddlers and revisions they write: "" (none) or "deflate". Texts written
+// with any compression can be read regardless of it.
+var Compression string
+
+// minCompressed is the length of the shortest text worth compressing.
+const minCompressed = 256
+
+// compressedMark starts a compressed text; it is followed by a byte naming
+// the codec. Texts come from JSON and so are valid UTF-8, where 0xff
+// never occurs, which tells them apart from the compressed ones.
+const compressedMark = 0xff
+
+// codecs maps the values of Compression to the codec bytes.
+var codecs = map[string]byte{
+	"deflate": 'd',
+}
+
+// CheckCompression returns an error if c is not a valid Compression.
+func CheckCompression(c string) error {
+	if _, ok := codecs[c]; !ok && c != "" {
+		return fmt.Errorf("unknown compression: %s", c)
+	}
+	return nil
+}
+
+// EncodeText returns text as it should be written by a backend: compressed
+// if Compression is set and that makes the text shorter, as is otherwise.
+func EncodeText(text string) ([]byte, error) {
+	codec, ok := codecs[Compression]
+	if !ok || len(text) < minCompressed {
+		return []byte(text), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(compressedMark)
+	buf.WriteByte(codec)
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(text) {
+		return []byte(text), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeText returns the text written by a backend as data.
+func DecodeText(data []byte) (string, error) {
+	if len(data) < 2 || data[0] != compressedMark {
+		return string(data), nil
+	}
+	switch data[1] {
+	case 'd':
+		r := flate.NewReader(bytes.NewReader(data[2:]))
+		defer r.Close()
+		text, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		return string(text), nil
+	}
+	return "", fmt.Errorf("unknown compression of a text: %q", data[1])
+}
@@ -0,0 +1,50 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeText(t *testing.T) {
+	defer func() { Compression = "" }()
+	long := strings.Repeat("All work and no play makes Jack a dull boy. ", 50)
+	for _, c := range []string{"", "deflate"} {
+		Compression = c
+		for _, text := range []string{"", "short", long, "ünïcödé " + long} {
+			data, err := EncodeText(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := len(data) < len(text); compressed != (c != "" && text != "short" && text != "") {
+				t.Errorf("%s: want it compressed only with compression on and long texts, got %d bytes of %d", c, len(data), len(text))
+			}
+			got, err := DecodeText(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != text {
+				t.Errorf("%s: want the text back, got %q", c, got)
+			}
+		}
+	}
+
+	if _, err := DecodeText([]byte{compressedMark, 'x', 1}); err == nil {
+		t.Error("want an error for an unknown codec")
+	}
+	if CheckCompression("deflate") != nil || CheckCompression("") != nil || CheckCompression("zstd") == nil {
+		t.Error("want deflate and none to be the only compressions")
+	}
+}
@@ -0,0 +1,553 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package crypt provides a TiddlerStore encrypting the tiddlers at rest
+// over any other TiddlerStore.
+//
+// Every tiddler is stored under an HMAC of its title, with its meta and
+// text sealed with AES-GCM; the underlying store sees nothing else but the
+// revision numbers. As sealed data does not compress, the meta and text
+// are compressed before they are sealed (see store.Compression). The keys
+// are derived with scrypt from a secret (a
+// passphrase or the content of a key file) and a random salt, which is
+// kept in the underlying store along with a value to check the secret
+// against.
+package crypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/opennota/widdly/store"
+)
+
+// HeaderKey is the key of the record holding the salt, stored in plain form.
+const HeaderKey = "widdly-encryption"
+
+// gravePrefix starts the keys of the records keeping the sealed titles of
+// the deleted tiddlers, which the tombstones of the underlying store lack.
+const gravePrefix = "deleted-"
+
+// checkText is sealed in the header to tell whether the secret is right.
+const checkText = "widdly"
+
+var (
+	// ErrWrongSecret is returned by Open if the secret does not match the one
+	// the store was encrypted with.
+	ErrWrongSecret = errors.New("wrong passphrase or key file")
+
+	// ErrNotEncrypted is returned by Open if the store already holds
+	// tiddlers which are not encrypted.
+	ErrNotEncrypted = errors.New("the store holds unencrypted tiddlers")
+)
+
+// Store is a TiddlerStore encrypting the tiddlers it stores in another one.
+// The links are indexed in memory, as the underlying store cannot read them.
+type Store struct {
+	s      store.TiddlerStore
+	aead   cipher.AEAD
+	macKey []byte
+
+	mu    sync.Mutex
+	links map[string][]store.Link // the links from the tiddlers, by title
+}
+
+// header is the record holding the salt.
+type header struct {
+	Title string `json:"title"`
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"`
+}
+
+// outer is the meta of a tiddler as stored in the underlying store.
+type outer struct {
+	Title    string `json:"title"`
+	Sealed   []byte `json:"sealed"`
+	Revision int    `json:"revision,omitempty"`
+}
+
+// Open returns a Store encrypting the tiddlers of s with the keys derived
+// from secret. An empty store is set up for encryption.
+func Open(ctx context.Context, s store.TiddlerStore, secret []byte) (*Store, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	var h header
+	t, err := s.Get(ctx, HeaderKey)
+	if err == store.ErrNotFound {
+		h, err = newHeader(ctx, s)
+	} else if err == nil {
+		err = json.Unmarshal(t.Meta, &h)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := scrypt.Key(secret, h.Salt, 1<<15, 8, 1, 64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &Store{s: s, aead: aead, macKey: keys[32:], links: make(map[string][]store.Link)}
+
+	if h.Check == nil {
+		h.Check, err = c.seal([]byte(checkText), HeaderKey)
+		if err == nil {
+			err = putHeader(ctx, s, h)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if check, err := c.open(h.Check, HeaderKey); err != nil || string(check) != checkText {
+		return nil, ErrWrongSecret
+	}
+
+	if err := c.indexLinks(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newHeader returns the header with a new salt for the store s, which must be empty.
+func newHeader(ctx context.Context, s store.TiddlerStore) (header, error) {
+	errNotEmpty := errors.New("not empty")
+	err := s.Walk(ctx, func(store.Tiddler) error { return errNotEmpty })
+	if err == errNotEmpty {
+		return header{}, ErrNotEncrypted
+	} else if err != nil {
+		return header{}, err
+	}
+	h := header{Title: HeaderKey, Salt: make([]byte, 32)}
+	if _, err := rand.Read(h.Salt); err != nil {
+		return header{}, err
+	}
+	return h, nil
+}
+
+// putHeader saves the header to the store s.
+func putHeader(ctx context.Context, s store.TiddlerStore, h header) error {
+	meta, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = s.Put(ctx, store.Tiddler{Key: HeaderKey, Meta: meta})
+	return err
+}
+
+// IsEncrypted returns true iff s has been set up for encryption by Open.
+func IsEncrypted(ctx context.Context, s store.TiddlerStore) (bool, error) {
+	_, err := s.Get(ctx, HeaderKey)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// key returns the key the tiddler with the given title is stored under.
+func (c *Store) key(title string) string {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(title))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// storedKey returns the key of the tiddler t of the underlying store,
+// which may leave t.Key empty.
+func storedKey(t store.Tiddler) string {
+	if t.Key != "" {
+		return t.Key
+	}
+	return store.SortValue(t.Meta, "title")
+}
+
+// isTiddlerKey returns true iff key is the key of a tiddler,
+// not of the header or a grave.
+func isTiddlerKey(key string) bool {
+	return key != HeaderKey && !strings.HasPrefix(key, gravePrefix)
+}
+
+// seal encrypts data, binding it to the given purpose and key.
+func (c *Store) seal(data []byte, ad string) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, []byte(ad)), nil
+}
+
+// open decrypts data sealed by seal with the same purpose and key.
+func (c *Store) open(data []byte, ad string) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("sealed data too short")
+	}
+	return c.aead.Open(nil, data[:n], data[n:], []byte(ad))
+}
+
+// isMacro returns true iff the tiddler with the given meta is one of those
+// All returns fat (see store.TiddlerStore).
+func isMacro(meta []byte) bool {
+	return strings.Contains(string(meta), `"$:/tags/Macro"`)
+}
+
+// encrypt returns the tiddler t as stored in the underlying store.
+// The sealed meta of a macro includes its text, for Walk and Since.
+func (c *Store) encrypt(t store.Tiddler) (store.Tiddler, error) {
+	key := c.key(t.Key)
+	plain := t.Meta
+	if isMacro(t.Meta) {
+		fat := store.Tiddler{Meta: t.Meta, Text: t.Text, WithText: true}
+		var err error
+		if plain, err = fat.MarshalJSON(); err != nil {
+			return store.Tiddler{}, err
+		}
+	}
+	plain, err := store.EncodeText(string(plain))
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	sealed, err := c.seal(plain, "meta:"+key)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	meta, err := json.Marshal(outer{Title: key, Sealed: sealed})
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	text, err := store.EncodeText(t.Text)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	if text, err = c.seal(text, "text:"+key); err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{Key: key, Meta: meta, Text: base64.StdEncoding.EncodeToString(text)}, nil
+}
+
+// decrypt returns the tiddler stored in the underlying store as t,
+// decrypting its text if t has it and withText is true.
+func (c *Store) decrypt(t store.Tiddler, withText bool) (store.Tiddler, error) {
+	var o outer
+	if err := json.Unmarshal(t.Meta, &o); err != nil {
+		return store.Tiddler{}, err
+	}
+	key := storedKey(t)
+	sealed, err := c.open(o.Sealed, "meta:"+key)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	plain, err := store.DecodeText(sealed)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	var d store.Tiddler
+	if err := d.UnmarshalJSON([]byte(plain)); err != nil {
+		return store.Tiddler{}, err
+	}
+	if o.Revision != 0 {
+		var js map[string]interface{}
+		if err := json.Unmarshal(d.Meta, &js); err != nil {
+			return store.Tiddler{}, err
+		}
+		js["revision"] = o.Revision
+		if d.Meta, err = json.Marshal(js); err != nil {
+			return store.Tiddler{}, err
+		}
+	}
+	if withText && t.WithText {
+		sealed, err := base64.StdEncoding.DecodeString(t.Text)
+		if err != nil {
+			return store.Tiddler{}, err
+		}
+		text, err := c.open(sealed, "text:"+key)
+		if err != nil {
+			return store.Tiddler{}, err
+		}
+		if d.Text, err = store.DecodeText(text); err != nil {
+			return store.Tiddler{}, err
+		}
+		d.WithText = true
+	}
+	return d, nil
+}
+
+// grave returns the record keeping the title of the tiddler being deleted.
+func (c *Store) grave(title string) (store.Tiddler, error) {
+	key := c.key(title)
+	sealed, err := c.seal([]byte(title), "title:"+key)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	meta, err := json.Marshal(outer{Title: gravePrefix + key, Sealed: sealed})
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{Key: gravePrefix + key, Meta: meta}, nil
+}
+
+// deletedTitle returns the title of the deleted tiddler stored under key,
+// or "" if it has no grave, i.e. it was never stored.
+func (c *Store) deletedTitle(ctx context.Context, key string) (string, error) {
+	t, err := c.s.Get(ctx, gravePrefix+key)
+	if err == store.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var o outer
+	if err := json.Unmarshal(t.Meta, &o); err != nil {
+		return "", err
+	}
+	title, err := c.open(o.Sealed, "title:"+key)
+	if err != nil {
+		return "", err
+	}
+	return string(title), nil
+}
+
+// indexLinks builds the link index from the tiddlers.
+func (c *Store) indexLinks(ctx context.Context) error {
+	var keys []string
+	err := c.s.Walk(ctx, func(t store.Tiddler) error {
+		if key := storedKey(t); isTiddlerKey(key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		t, err := c.s.Get(ctx, key)
+		if err == store.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		t.Key = key
+		t.WithText = true
+		d, err := c.decrypt(t, true)
+		if err != nil {
+			return err
+		}
+		c.links[d.Key] = store.ParseLinks(d)
+	}
+	return nil
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (c *Store) Get(ctx context.Context, key string) (store.Tiddler, error) {
+	k := c.key(key)
+	t, err := c.s.Get(ctx, k)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	t.Key = k
+	t.WithText = true
+	return c.decrypt(t, true)
+}
+
+// All retrieves all the tiddlers from the store, the way Walk passes them.
+func (c *Store) All(ctx context.Context) ([]store.Tiddler, error) {
+	tiddlers := []store.Tiddler{}
+	err := c.Walk(ctx, func(t store.Tiddler) error {
+		tiddlers = append(tiddlers, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlers, nil
+}
+
+// Walk calls fn for every tiddler in the store. The macros are passed fat,
+// with the text kept in their sealed meta.
+func (c *Store) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
+	return c.s.Walk(ctx, func(t store.Tiddler) error {
+		if !isTiddlerKey(storedKey(t)) {
+			return nil
+		}
+		d, err := c.decrypt(t, false)
+		if err != nil {
+			return err
+		}
+		return fn(d)
+	})
+}
+
+// Put encrypts the tiddler and saves it to the underlying store.
+func (c *Store) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	e, err := c.encrypt(tiddler)
+	if err != nil {
+		return 0, err
+	}
+	rev, err := c.s.Put(ctx, e)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.links[tiddler.Key] = store.ParseLinks(tiddler)
+	c.mu.Unlock()
+	return rev, nil
+}
+
+// Revision retrieves a past revision of a tiddler from the underlying store.
+func (c *Store) Revision(ctx context.Context, key string, rev int) (store.Tiddler, error) {
+	k := c.key(key)
+	t, err := c.s.Revision(ctx, k, rev)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	t.Key = k
+	t.WithText = true
+	return c.decrypt(t, true)
+}
+
+// Delete deletes a tiddler by key (title), keeping its sealed title in a
+// grave for Since to report. Deleting a tiddler which does not exist is
+// left to the underlying store.
+func (c *Store) Delete(ctx context.Context, key string) error {
+	k := c.key(key)
+	if _, err := c.s.Get(ctx, k); err == store.ErrNotFound {
+		return c.s.Delete(ctx, k)
+	} else if err != nil {
+		return err
+	}
+	_, err := c.Batch(ctx, []store.Op{{Tiddler: store.Tiddler{Key: key}, Delete: true}})
+	if be, ok := err.(*store.BatchError); ok {
+		return be.Err
+	}
+	return err
+}
+
+// Since returns the latest changes made after the change with the sequence
+// number seq, decrypted, with the titles of the deleted tiddlers taken
+// from their graves. The deletes of the tiddlers never stored are skipped.
+func (c *Store) Since(ctx context.Context, seq int64) ([]store.Change, int64, error) {
+	changes, last, err := c.s.Since(ctx, seq)
+	if err != nil {
+		return nil, 0, err
+	}
+	decrypted := []store.Change{}
+	for _, ch := range changes {
+		if !isTiddlerKey(ch.Tiddler.Key) {
+			continue
+		}
+		if ch.Deleted {
+			title, err := c.deletedTitle(ctx, ch.Tiddler.Key)
+			if err != nil {
+				return nil, 0, err
+			}
+			if title == "" {
+				continue
+			}
+			ch.Tiddler = store.Tiddler{Key: title}
+		} else {
+			ch.Tiddler, err = c.decrypt(ch.Tiddler, false)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		decrypted = append(decrypted, ch)
+	}
+	return decrypted, last, nil
+}
+
+// Batch encrypts the tiddlers and applies the operations to the underlying
+// store, along with writing the graves of the deleted tiddlers.
+func (c *Store) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	var encrypted []store.Op
+	var index []int // the index of the operation of every encrypted operation
+	for i, op := range ops {
+		if op.Delete {
+			g, err := c.grave(op.Tiddler.Key)
+			if err != nil {
+				return nil, &store.BatchError{Index: i, Err: err}
+			}
+			encrypted = append(encrypted,
+				store.Op{Tiddler: store.Tiddler{Key: c.key(op.Tiddler.Key)}, Delete: true},
+				store.Op{Tiddler: g})
+			index = append(index, i, i)
+			continue
+		}
+		e, err := c.encrypt(op.Tiddler)
+		if err != nil {
+			return nil, &store.BatchError{Index: i, Err: err}
+		}
+		encrypted = append(encrypted, store.Op{Tiddler: e})
+		index = append(index, i)
+	}
+
+	revs, err := c.s.Batch(ctx, encrypted)
+	if err != nil {
+		if be, ok := err.(*store.BatchError); ok && be.Index >= 0 && be.Index < len(index) {
+			return nil, &store.BatchError{Index: index[be.Index], Err: be.Err}
+		}
+		return nil, err
+	}
+	result := make([]int, len(ops))
+	for j, rev := range revs {
+		if !ops[index[j]].Delete {
+			result[index[j]] = rev
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			delete(c.links, op.Tiddler.Key)
+		} else {
+			c.links[op.Tiddler.Key] = store.ParseLinks(op.Tiddler)
+		}
+	}
+	return result, nil
+}
+
+// Links returns the links selected by the query from the link index.
+func (c *Store) Links(_ context.Context, q store.LinkQuery) ([]store.Link, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	links := []store.Link{}
+	for from, ls := range c.links {
+		if q.From != "" && from != q.From {
+			continue
+		}
+		for _, l := range ls {
+			if q.Match(l) {
+				links = append(links, l)
+			}
+		}
+	}
+	store.SortLinks(links)
+	return links, nil
+}
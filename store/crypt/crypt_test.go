@@ -0,0 +1,266 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package crypt
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opennota/widdly/store"
+)
+
+// memStore is an in-memory TiddlerStore keeping the full history.
+type memStore struct {
+	history map[string][]store.Tiddler
+	deleted map[string]bool
+	changes map[string]store.Change
+	seq     int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		history: make(map[string][]store.Tiddler),
+		deleted: make(map[string]bool),
+		changes: make(map[string]store.Change),
+	}
+}
+
+func (s *memStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+	h := s.history[key]
+	if len(h) == 0 || s.deleted[key] {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return h[len(h)-1], nil
+}
+
+func (s *memStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	var all []store.Tiddler
+	for key := range s.history {
+		if t, err := s.Get(ctx, key); err == nil {
+			all = append(all, t)
+		}
+	}
+	return all, nil
+}
+
+func (s *memStore) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
+	all, _ := s.All(ctx)
+	for _, t := range all {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Put(_ context.Context, t store.Tiddler) (int, error) {
+	rev := len(s.history[t.Key]) + 1
+	var js map[string]interface{}
+	if err := json.Unmarshal(t.Meta, &js); err != nil {
+		return 0, err
+	}
+	js["revision"] = rev
+	t.Meta, _ = json.Marshal(js)
+	s.history[t.Key] = append(s.history[t.Key], t)
+	delete(s.deleted, t.Key)
+	s.seq++
+	s.changes[t.Key] = store.Change{Seq: s.seq, Tiddler: t}
+	return rev, nil
+}
+
+func (s *memStore) Revision(_ context.Context, key string, rev int) (store.Tiddler, error) {
+	h := s.history[key]
+	if rev < 1 || rev > len(h) {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return h[rev-1], nil
+}
+
+func (s *memStore) Delete(_ context.Context, key string) error {
+	s.deleted[key] = true
+	s.seq++
+	s.changes[key] = store.Change{Seq: s.seq, Tiddler: store.Tiddler{Key: key}, Deleted: true}
+	return nil
+}
+
+func (s *memStore) Since(_ context.Context, seq int64) ([]store.Change, int64, error) {
+	var changes []store.Change
+	for _, c := range s.changes {
+		if c.Seq > seq {
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Seq < changes[j].Seq })
+	return changes, s.seq, nil
+}
+
+func (s *memStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	revs := make([]int, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			if _, err := s.Get(ctx, op.Tiddler.Key); err != nil {
+				return nil, &store.BatchError{Index: i, Err: err}
+			}
+			s.Delete(ctx, op.Tiddler.Key)
+		} else {
+			revs[i], _ = s.Put(ctx, op.Tiddler)
+		}
+	}
+	return revs, nil
+}
+
+func (s *memStore) Links(context.Context, store.LinkQuery) ([]store.Link, error) {
+	return nil, nil
+}
+
+func tiddler(title, text string, fields ...string) store.Tiddler {
+	js := map[string]string{"title": title}
+	for i := 0; i+1 < len(fields); i += 2 {
+		js[fields[i]] = fields[i+1]
+	}
+	meta, _ := json.Marshal(js)
+	return store.Tiddler{Key: title, Meta: meta, Text: text, WithText: true}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	m := newMemStore()
+	c, err := Open(ctx, m, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, td := range []store.Tiddler{
+		tiddler("Passwords", "root: hunter2, see [[Servers]]", "tags", "Secret"),
+		tiddler("Passwords", "root: hunter3, see [[Servers]]", "tags", "Secret"),
+		tiddler("Macros", `\define secret() hunter2`, "tags", "$:/tags/Macro"),
+		tiddler("Doomed", "bye"),
+	} {
+		if _, err := c.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, h := range m.history {
+		for _, td := range h {
+			raw := key + string(td.Meta) + td.Text
+			for _, plain := range []string{"Passwords", "hunter", "Secret", "Macro", "Doomed"} {
+				if strings.Contains(raw, plain) {
+					t.Errorf("%q is stored in plain form: %s", plain, raw)
+				}
+			}
+		}
+	}
+
+	td, err := c.Get(ctx, "Passwords")
+	if err != nil || td.Key != "Passwords" || td.Text != "root: hunter3, see [[Servers]]" || td.Revision() != 2 {
+		t.Errorf("want the latest revision back, got %v %q %q %d", err, td.Key, td.Text, td.Revision())
+	}
+	if td, err := c.Revision(ctx, "Passwords", 1); err != nil || td.Text != "root: hunter2, see [[Servers]]" || td.Revision() != 1 {
+		t.Errorf("want the first revision back, got %v %q %d", err, td.Text, td.Revision())
+	}
+	if _, err := c.Get(ctx, "Missing"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	if err := c.Delete(ctx, "Doomed"); err != nil {
+		t.Fatal(err)
+	}
+	all, err := c.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, td := range all {
+		titles = append(titles, td.Key)
+		if td.WithText != (td.Key == "Macros") {
+			t.Errorf("%s: want only the macros fat, got WithText %v", td.Key, td.WithText)
+		}
+	}
+	sort.Strings(titles)
+	if strings.Join(titles, ",") != "Macros,Passwords" {
+		t.Errorf("want the tiddlers only, got %v", titles)
+	}
+
+	changes, _, err := c.Since(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ch := range changes {
+		got = append(got, ch.Tiddler.Key)
+		if ch.Deleted != (ch.Tiddler.Key == "Doomed") {
+			t.Errorf("%s: unexpected Deleted %v", ch.Tiddler.Key, ch.Deleted)
+		}
+	}
+	if strings.Join(got, ",") != "Passwords,Macros,Doomed" {
+		t.Errorf("want the changes with their titles, got %v", got)
+	}
+
+	if _, err := c.Batch(ctx, []store.Op{{Tiddler: tiddler("New", "x")}, {Tiddler: store.Tiddler{Key: "Doomed"}, Delete: true}}); err == nil {
+		t.Error("want an error deleting a deleted tiddler")
+	} else if be, ok := err.(*store.BatchError); !ok || be.Index != 1 {
+		t.Errorf("want the error of the second operation, got %v", err)
+	}
+
+	if _, err := Open(ctx, m, []byte("wrong horse")); err != ErrWrongSecret {
+		t.Errorf("want ErrWrongSecret, got %v", err)
+	}
+	c, err = Open(ctx, m, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := c.Links(ctx, store.LinkQuery{To: "Servers"})
+	if err != nil || len(links) != 1 || links[0].From != "Passwords" {
+		t.Errorf("want the link indexed on open, got %v %v", links, err)
+	}
+
+	plain := newMemStore()
+	plain.Put(ctx, tiddler("Plain", "text"))
+	if _, err := Open(ctx, plain, []byte("correct horse")); err != ErrNotEncrypted {
+		t.Errorf("want ErrNotEncrypted, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	defer func(c string) { store.Compression = c }(store.Compression)
+	ctx := context.Background()
+	m := newMemStore()
+	c, err := Open(ctx, m, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A text written before compression is read back as well.
+	text := strings.Repeat("all work and no play makes jack a dull boy\n", 100)
+	store.Compression = ""
+	if _, err := c.Put(ctx, tiddler("Plain", text)); err != nil {
+		t.Fatal(err)
+	}
+	store.Compression = "deflate"
+	if _, err := c.Put(ctx, tiddler("Compressed", text)); err != nil {
+		t.Fatal(err)
+	}
+	plain, compressed := m.history[c.key("Plain")][0], m.history[c.key("Compressed")][0]
+	if len(compressed.Text)*4 > len(plain.Text) {
+		t.Errorf("want the text compressed before it is sealed, got %d bytes sealed against %d", len(compressed.Text), len(plain.Text))
+	}
+	for _, title := range []string{"Plain", "Compressed"} {
+		if td, err := c.Get(ctx, title); err != nil || td.Text != text {
+			t.Errorf("%s: want the text back, got %v %q", title, err, td.Text)
+		}
+	}
+}
@@ -15,25 +15,44 @@
 package flatFile
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
-	"strings"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-    "io/ioutil"
-    "regexp"
-    "strconv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/opennota/widdly/store"
 )
 
 // flatFileStore is a sqliteDB store for tiddlers.
 type flatFileStore struct {
-	storePath string
-	tiddlersPath string
+	storePath          string
+	tiddlersPath       string
 	tiddlerHistoryPath string
+	blobsPath          string
+	changesPath        string
+
+	mu     sync.Mutex              // Guards seq, the change log, latest, links and refs
+	seq    int64                   // The sequence number of the latest change
+	latest map[string]change       // The latest change to each tiddler, by title; built on open
+	links  map[string][]store.Link // The link index, by the title of the linking tiddler; built on open
+	refs   map[string]int          // The reference counts of the blobs, by hash; built on open
+}
+
+// change is a line of the change log.
+type change struct {
+	Seq     int64  `json:"seq"`
+	Title   string `json:"title"`
+	Deleted bool   `json:"deleted,omitempty"`
 }
 
 func init() {
@@ -44,10 +63,14 @@ func init() {
 }
 
 func exists(path string) (bool, error) {
-    _, err := os.Stat(path)
-    if err == nil { return true, nil }
-    if os.IsNotExist(err) { return false, nil }
-    return true, err
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
 }
 
 func checkExt(pathS string, ext string) []string {
@@ -70,29 +93,224 @@ func checkExt(pathS string, ext string) []string {
 func MustOpen(dataSource string) store.TiddlerStore {
 	storePath := filepath.Join(".", dataSource)
 	if _, err := os.Stat(storePath); os.IsNotExist(err) {
-	    os.Mkdir(storePath, os.ModePerm)
+		os.Mkdir(storePath, os.ModePerm)
 	}
 
 	tiddlersPath := filepath.Join(storePath, "tiddlers")
 	if _, err := os.Stat(tiddlersPath); os.IsNotExist(err) {
-	    os.Mkdir(tiddlersPath, os.ModePerm)
+		os.Mkdir(tiddlersPath, os.ModePerm)
 	}
 
 	tiddlerHistoryPath := filepath.Join(storePath, "tiddlerHistory")
 	if _, err := os.Stat(tiddlerHistoryPath); os.IsNotExist(err) {
-	    os.Mkdir(tiddlerHistoryPath, os.ModePerm)
+		os.Mkdir(tiddlerHistoryPath, os.ModePerm)
+	}
+	blobsPath := filepath.Join(storePath, "blobs")
+	if _, err := os.Stat(blobsPath); os.IsNotExist(err) {
+		os.Mkdir(blobsPath, os.ModePerm)
+	}
+	s := &flatFileStore{
+		storePath:          storePath,
+		tiddlersPath:       tiddlersPath,
+		tiddlerHistoryPath: tiddlerHistoryPath,
+		blobsPath:          blobsPath,
+		changesPath:        filepath.Join(storePath, "changes.log"),
+		latest:             make(map[string]change),
+	}
+	if err := s.openChangeLog(); err != nil {
+		panic(err)
+	}
+	if err := s.indexLinks(); err != nil {
+		panic(err)
+	}
+	if err := s.countRefs(); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// readRevisionHash returns the hash of the text of the revision in the
+// history file, or "" if the file holds the text itself.
+func readRevisionHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return "", nil
+	}
+	hash, _, _ := store.DecodeRevision(line)
+	return hash, nil
+}
+
+// historyFiles returns the paths to all the files in the history directory.
+func (s *flatFileStore) historyFiles() ([]string, error) {
+	var files []string
+	err := filepath.Walk(s.tiddlerHistoryPath, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// countRefs counts the references to the blobs from the history.
+func (s *flatFileStore) countRefs() error {
+	s.refs = make(map[string]int)
+	files, err := s.historyFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		hash, err := readRevisionHash(path)
+		if err != nil {
+			return err
+		}
+		if hash != "" {
+			s.refs[hash]++
+		}
+	}
+	return nil
+}
+
+// writeBlob writes text to the blob file named after its hash,
+// unless there is one already.
+func (s *flatFileStore) writeBlob(text string) error {
+	hash := store.BlobHash(text)
+	if s.refs[hash] > 0 {
+		return nil
+	}
+	path := filepath.Join(s.blobsPath, hash)
+	if ok, err := exists(path); err != nil || ok {
+		return err
+	}
+	data, err := store.EncodeText(text)
+	if err != nil {
+		return err
 	}
-	return &flatFileStore{storePath, tiddlersPath, tiddlerHistoryPath}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// indexLinks builds the link index from the tiddlers.
+func (s *flatFileStore) indexLinks() error {
+	s.links = make(map[string][]store.Link)
+	for _, file := range checkExt(s.tiddlersPath, ".meta") {
+		key := strings.TrimSuffix(file, ".meta")
+		t, err := s.Get(context.Background(), key)
+		if err == store.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		t.Key = key
+		s.links[key] = store.ParseLinks(t)
+	}
+	return nil
+}
+
+// readChangeLog reads all the entries of the change log.
+func (s *flatFileStore) readChangeLog() ([]change, error) {
+	f, err := os.Open(s.changesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var changes []change
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var c change
+		if json.Unmarshal(sc.Bytes(), &c) == nil {
+			changes = append(changes, c)
+		}
+	}
+	return changes, sc.Err()
+}
+
+// openChangeLog finds the latest change to every tiddler and the sequence
+// number of the latest change of all. If there is no change log yet, the
+// existing tiddlers are logged as changes.
+func (s *flatFileStore) openChangeLog() error {
+	changes, err := s.readChangeLog()
+	if err == nil {
+		for _, c := range changes {
+			if c.Seq > s.latest[c.Title].Seq {
+				s.latest[c.Title] = c
+			}
+			if c.Seq > s.seq {
+				s.seq = c.Seq
+			}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range checkExt(s.tiddlersPath, ".meta") {
+		if err := s.logChange(strings.TrimSuffix(file, ".meta"), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logChange appends a change to the tiddler with the given key to the change log.
+// Must be called with s.mu held.
+func (s *flatFileStore) logChange(key string, deleted bool) error {
+	return s.logChanges([]change{{Title: key, Deleted: deleted}})
+}
+
+// logChanges appends the changes to the change log in a single write,
+// numbering them. Must be called with s.mu held.
+func (s *flatFileStore) logChanges(changes []change) error {
+	var buf bytes.Buffer
+	numbered := make([]change, len(changes))
+	for i, c := range changes {
+		c.Seq = s.seq + int64(i) + 1
+		numbered[i] = c
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(s.changesPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	s.seq += int64(len(changes))
+	for _, c := range numbered {
+		s.latest[c.Title] = c
+	}
+	return nil
 }
 
 // Get retrieves a tiddler from the store by key (title).
 func (s *flatFileStore) Get(_ context.Context, key string) (store.Tiddler, error) {
 	t := store.Tiddler{WithText: true}
-	tiddlerPath := filepath.Join(s.tiddlersPath, key + ".tid")
-	tiddlerMetaPath := filepath.Join(s.tiddlersPath, key + ".meta")
+	tiddlerPath := filepath.Join(s.tiddlersPath, key+".tid")
+	tiddlerMetaPath := filepath.Join(s.tiddlersPath, key+".meta")
 	if _, err := os.Stat(tiddlerPath); os.IsNotExist(err) {
 		return t, store.ErrNotFound
-	}else {
+	} else {
 		meta, err := ioutil.ReadFile(tiddlerMetaPath)
 		if err != nil {
 			return store.Tiddler{}, err
@@ -103,7 +321,10 @@ func (s *flatFileStore) Get(_ context.Context, key string) (store.Tiddler, error
 		}
 		t.Meta = make([]byte, len(meta))
 		copy(t.Meta, meta)
-		t.Text = string(tiddler)
+		t.Text, err = store.DecodeText(tiddler)
+		if err != nil {
+			return store.Tiddler{}, err
+		}
 	}
 	return t, nil
 }
@@ -116,31 +337,53 @@ func copyOf(p []byte) []byte {
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
 // Special tiddlers (like global macros) are returned fat.
-func (s *flatFileStore) All(_ context.Context) ([]store.Tiddler, error) {
+func (s *flatFileStore) All(ctx context.Context) ([]store.Tiddler, error) {
 	tiddlers := []store.Tiddler{}
+	err := s.Walk(ctx, func(t store.Tiddler) error {
+		tiddlers = append(tiddlers, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlers, nil
+}
+
+// Walk calls fn for every tiddler (mostly skinny), reading the files one by one.
+func (s *flatFileStore) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
 	files := checkExt(s.tiddlersPath, ".meta")
 	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var t store.Tiddler
-		meta, _ := ioutil.ReadFile(filepath.Join(s.tiddlersPath, file))
-		t.Meta = make([]byte, len(meta))
-		copy(t.Meta, meta)
+		meta, err := ioutil.ReadFile(filepath.Join(s.tiddlersPath, file))
+		if os.IsNotExist(err) {
+			continue // Deleted in the meantime.
+		} else if err != nil {
+			return err
+		}
+		t.Meta = meta
 		if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
-			var extension = filepath.Ext(file)
-			var tiddlerPath = file[0:len(file)-len(extension)]
-			tiddler, _ := ioutil.ReadFile(tiddlerPath + ".tid")
-			t.Text = string(tiddler)
+			text, _ := ioutil.ReadFile(filepath.Join(s.tiddlersPath, strings.TrimSuffix(file, ".meta")+".tid"))
+			t.Text, err = store.DecodeText(text)
+			if err != nil {
+				return err
+			}
 			t.WithText = true
 		}
-		tiddlers = append(tiddlers, t)
+		if err := fn(t); err != nil {
+			return err
+		}
 	}
-	return tiddlers, nil
+	return nil
 }
 
 func getLastRevision(s *flatFileStore, key string) int {
 	var files []string
 	filepath.Walk(s.tiddlerHistoryPath, func(path string, f os.FileInfo, _ error) error {
 		if !f.IsDir() {
-			r, err := regexp.MatchString(key + "#\\d+", f.Name())
+			r, err := regexp.MatchString("^"+regexp.QuoteMeta(key)+"#\\d+$", f.Name())
 			if err == nil && r {
 				files = append(files, f.Name())
 			}
@@ -153,7 +396,7 @@ func getLastRevision(s *flatFileStore, key string) int {
 	for _, file := range files {
 		filePart := strings.Split(file, "#")
 		rev, _ := strconv.Atoi(filePart[1])
-		if(rev > highestRev){
+		if rev > highestRev {
 			highestRev = rev
 		}
 	}
@@ -161,33 +404,384 @@ func getLastRevision(s *flatFileStore, key string) int {
 	return highestRev + 1
 }
 
+// encode returns the meta file and the history file of the given revision
+// of tiddler; the history file refers to the text kept as a blob.
+func encode(tiddler store.Tiddler, rev int) (meta, data []byte, err error) {
+	var js map[string]interface{}
+	err = json.Unmarshal(tiddler.Meta, &js)
+	if err != nil {
+		return nil, nil, err
+	}
+	js["revision"] = rev
+	meta, err = json.Marshal(js)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, store.EncodeRevision(store.BlobHash(tiddler.Text), meta), nil
+}
+
 // Put saves tiddler to the store, incrementing and returning revision.
-// The tiddler is also written to the tiddler_history bucket.
+// The tiddler is also written to the history directory.
 func (s *flatFileStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
-	var js map[string]interface{}
-	err := json.Unmarshal(tiddler.Meta, &js)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rev := getLastRevision(s, tiddler.Key)
+	meta, data, err := encode(tiddler, rev)
+	if err != nil {
+		return 0, err
+	}
+	err = s.writeBlob(tiddler.Text)
+	if err != nil {
+		return 0, err
+	}
+	text, err := store.EncodeText(tiddler.Text)
 	if err != nil {
 		return 0, err
 	}
-	rev := getLastRevision(s, tiddler.Key)
-	data, _ := json.Marshal(js)
 
-	err = ioutil.WriteFile(filepath.Join(s.tiddlersPath, tiddler.Key + ".tid"), []byte(tiddler.Text), 0644)
-	err = ioutil.WriteFile(filepath.Join(s.tiddlersPath, tiddler.Key + ".meta"), tiddler.Meta, 0644)
+	err = ioutil.WriteFile(filepath.Join(s.tiddlersPath, tiddler.Key+".tid"), text, 0644)
+	if err != nil {
+		return 0, err
+	}
+	err = ioutil.WriteFile(filepath.Join(s.tiddlersPath, tiddler.Key+".meta"), meta, 0644)
+	if err != nil {
+		return 0, err
+	}
 	err = ioutil.WriteFile(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", tiddler.Key, rev)), data, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	s.refs[store.BlobHash(tiddler.Text)]++
 
+	err = s.logChange(tiddler.Key, false)
+	if err != nil {
+		return 0, err
+	}
+	s.links[tiddler.Key] = store.ParseLinks(tiddler)
 	return rev, nil
 }
 
+// Revision retrieves the given revision of a tiddler from the history directory.
+func (s *flatFileStore) Revision(_ context.Context, key string, rev int) (store.Tiddler, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", key, rev)))
+	if os.IsNotExist(err) {
+		return store.Tiddler{}, store.ErrNotFound
+	} else if err != nil {
+		return store.Tiddler{}, err
+	}
+	if hash, meta, ok := store.DecodeRevision(data); ok {
+		data, err := ioutil.ReadFile(filepath.Join(s.blobsPath, hash))
+		if err != nil {
+			return store.Tiddler{}, err
+		}
+		text, err := store.DecodeText(data)
+		if err != nil {
+			return store.Tiddler{}, err
+		}
+		return store.Tiddler{Key: key, Meta: meta, Text: text, WithText: true}, nil
+	}
+	var t store.Tiddler
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	t.Key = key
+	t.WithText = true
+	return t, nil
+}
+
 // Delete deletes a tiddler with the given key (title) from the store.
 func (s *flatFileStore) Delete(ctx context.Context, key string) error {
-	err := os.Remove(filepath.Join(s.tiddlersPath, key + ".tid"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(filepath.Join(s.tiddlersPath, key+".tid"))
 	if err != nil {
 		return err
 	}
-	err = os.Remove(filepath.Join(s.tiddlersPath, key + ".meta"))
+	err = os.Remove(filepath.Join(s.tiddlersPath, key+".meta"))
 	if err != nil {
 		return err
 	}
-	return nil
+	delete(s.links, key)
+	return s.logChange(key, true)
+}
+
+// rename is a rename of a file made by Batch.
+type rename struct {
+	from, to string
+}
+
+// Batch applies the operations by writing the new files to a staging
+// directory first and then renaming all of them into place; the files of
+// the deleted tiddlers are moved to the staging directory. If a rename
+// fails, the renames made so far are undone.
+func (s *flatFileStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staging, err := ioutil.TempDir(s.storePath, "batch")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	staged := func(i int, name string) string {
+		return filepath.Join(staging, fmt.Sprintf("%d.%s", i, name))
+	}
+
+	revs := make([]int, len(ops))
+	present := make(map[string]bool) // Whether a tiddler exists after the operations staged so far
+	nextRev := make(map[string]int)
+	var renames []rename
+	var changes []change
+	for i, op := range ops {
+		key := op.Tiddler.Key
+		tid := filepath.Join(s.tiddlersPath, key+".tid")
+		meta := filepath.Join(s.tiddlersPath, key+".meta")
+		if _, ok := present[key]; !ok {
+			ok, err := exists(tid)
+			if err != nil {
+				return nil, &store.BatchError{Index: i, Err: err}
+			}
+			present[key] = ok
+		}
+
+		if op.Delete {
+			if !present[key] {
+				return nil, &store.BatchError{Index: i, Err: store.ErrNotFound}
+			}
+			renames = append(renames,
+				rename{tid, staged(i, "old.tid")},
+				rename{meta, staged(i, "old.meta")})
+			present[key] = false
+			changes = append(changes, change{Title: key, Deleted: true})
+			continue
+		}
+
+		rev, ok := nextRev[key]
+		if !ok {
+			rev = getLastRevision(s, key)
+		}
+		nextRev[key] = rev + 1
+		revs[i] = rev
+		metaData, data, err := encode(op.Tiddler, rev)
+		var text []byte
+		if err == nil {
+			text, err = store.EncodeText(op.Tiddler.Text)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(staged(i, "tid"), text, 0644)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(staged(i, "meta"), metaData, 0644)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(staged(i, "history"), data, 0644)
+		}
+		if err == nil {
+			// Blobs are never overwritten, so this needs no undoing;
+			// the blob is left for GC if the batch fails.
+			err = s.writeBlob(op.Tiddler.Text)
+		}
+		if err != nil {
+			return nil, &store.BatchError{Index: i, Err: err}
+		}
+		if present[key] {
+			// Move the current files aside, so that the renames can be undone.
+			renames = append(renames,
+				rename{tid, staged(i, "old.tid")},
+				rename{meta, staged(i, "old.meta")})
+		}
+		renames = append(renames,
+			rename{staged(i, "tid"), tid},
+			rename{staged(i, "meta"), meta},
+			rename{staged(i, "history"), filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", key, rev))})
+		present[key] = true
+		changes = append(changes, change{Title: key})
+	}
+
+	for i, r := range renames {
+		err := os.Rename(r.from, r.to)
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				os.Rename(renames[j].to, renames[j].from)
+			}
+			return nil, err
+		}
+	}
+	for _, op := range ops {
+		if op.Delete {
+			delete(s.links, op.Tiddler.Key)
+		} else {
+			s.links[op.Tiddler.Key] = store.ParseLinks(op.Tiddler)
+			s.refs[store.BlobHash(op.Tiddler.Text)]++
+		}
+	}
+	err = s.logChanges(changes)
+	if err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// Since returns the latest changes made after the change with the sequence number seq.
+func (s *flatFileStore) Since(_ context.Context, seq int64) ([]store.Change, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var recent []change
+	for _, c := range s.latest {
+		if c.Seq > seq {
+			recent = append(recent, c)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i].Seq < recent[j].Seq })
+
+	changes := []store.Change{}
+	for _, c := range recent {
+		ch := store.Change{Seq: c.Seq, Tiddler: store.Tiddler{Key: c.Title}, Deleted: c.Deleted}
+		if !c.Deleted {
+			meta, err := ioutil.ReadFile(filepath.Join(s.tiddlersPath, c.Title+".meta"))
+			if err != nil {
+				return nil, 0, err
+			}
+			ch.Tiddler.Meta = meta
+			if bytes.Contains(meta, []byte(`"$:/tags/Macro"`)) {
+				data, err := ioutil.ReadFile(filepath.Join(s.tiddlersPath, c.Title+".tid"))
+				if err != nil {
+					return nil, 0, err
+				}
+				text, err := store.DecodeText(data)
+				if err != nil {
+					return nil, 0, err
+				}
+				ch.Tiddler.Text = text
+				ch.Tiddler.WithText = true
+			}
+		}
+		changes = append(changes, ch)
+	}
+	return changes, s.seq, nil
+}
+
+// Links returns the links selected by the query from the link index.
+func (s *flatFileStore) Links(_ context.Context, q store.LinkQuery) ([]store.Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	links := []store.Link{}
+	for from, ls := range s.links {
+		if q.From != "" && from != q.From {
+			continue
+		}
+		for _, l := range ls {
+			if q.Match(l) {
+				links = append(links, l)
+			}
+		}
+	}
+	store.SortLinks(links)
+	return links, nil
+}
+
+// compactChangeLog rewrites the change log keeping only the latest change
+// to every tiddler. Must be called with s.mu held.
+func (s *flatFileStore) compactChangeLog() error {
+	var changes []change
+	for _, c := range s.latest {
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Seq < changes[j].Seq })
+	var buf bytes.Buffer
+	for _, c := range changes {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmp := s.changesPath + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.changesPath)
+	}
+	return err
+}
+
+// GC moves the texts of the revisions saved before to blobs, removes the
+// blobs no revision refers to, e.g. those written by failed batches, and
+// compacts the change log.
+func (s *flatFileStore) GC(ctx context.Context) (store.GCStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats store.GCStats
+	if err := s.compactChangeLog(); err != nil {
+		return stats, err
+	}
+	files, err := s.historyFiles()
+	if err != nil {
+		return stats, err
+	}
+	for _, path := range files {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		hash, err := readRevisionHash(path)
+		if err != nil {
+			return stats, err
+		}
+		if hash != "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return stats, err
+		}
+		var t store.Tiddler
+		if err := json.Unmarshal(data, &t); err != nil {
+			return stats, err
+		}
+		if err := s.writeBlob(t.Text); err != nil {
+			return stats, err
+		}
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, store.EncodeRevision(store.BlobHash(t.Text), t.Meta), 0644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			return stats, err
+		}
+		s.refs[store.BlobHash(t.Text)]++
+		stats.Migrated++
+	}
+
+	blobs, err := ioutil.ReadDir(s.blobsPath)
+	if err != nil {
+		return stats, err
+	}
+	for _, fi := range blobs {
+		if s.refs[fi.Name()] > 0 {
+			stats.Blobs++
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.blobsPath, fi.Name())); err != nil {
+			return stats, err
+		}
+		stats.Removed++
+		stats.Freed += fi.Size()
+	}
+	return stats, nil
+}
+
+// Snapshot writes the store directory to tw, holding the lock all the
+// writes take, so that no write is copied halfway.
+func (s *flatFileStore) Snapshot(_ context.Context, tw *tar.Writer, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return store.TarDir(tw, name, s.storePath)
 }
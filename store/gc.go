@@ -0,0 +1,68 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// GCStats reports what a garbage collection has done.
+type GCStats struct {
+	Migrated int   `json:"migrated"` // The number of revisions moved to the blob store
+	Blobs    int   `json:"blobs"`    // The number of blobs kept
+	Removed  int   `json:"removed"`  // The number of unreferenced blobs removed
+	Freed    int64 `json:"freed"`    // The size of the removed blobs, in bytes
+}
+
+// Collector is implemented by the stores which keep the texts of the
+// revisions as blobs addressed by content hash, so that saving the same
+// text again takes no space. GC moves the texts of the revisions saved
+// before to blobs, recounts the references to the blobs and removes the
+// blobs no revision refers to.
+type Collector interface {
+	GC(ctx context.Context) (GCStats, error)
+}
+
+// BlobHash returns the content hash of a text, under which it is kept as a blob.
+func BlobHash(text string) string {
+	h := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(h[:])
+}
+
+// EncodeRevision encodes a revision kept in the history, referring to its
+// text by hash: "#<hash>\n<meta>". The revisions saved before are JSON
+// objects holding the text, so they can be told apart by the first byte.
+func EncodeRevision(hash string, meta []byte) []byte {
+	data := make([]byte, 0, len(hash)+2+len(meta))
+	data = append(data, '#')
+	data = append(data, hash...)
+	data = append(data, '\n')
+	return append(data, meta...)
+}
+
+// DecodeRevision decodes a revision encoded by EncodeRevision. It returns
+// false if data is not such a revision.
+func DecodeRevision(data []byte) (hash string, meta []byte, ok bool) {
+	if len(data) == 0 || data[0] != '#' {
+		return "", nil, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", nil, false
+	}
+	return string(data[1:i]), data[i+1:], true
+}
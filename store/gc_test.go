@@ -0,0 +1,33 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import "testing"
+
+func TestEncodeRevision(t *testing.T) {
+	hash := BlobHash("hello")
+	if hash != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected hash %s", hash)
+	}
+	data := EncodeRevision(hash, []byte(`{"title":"a","revision":2}`))
+	h, meta, ok := DecodeRevision(data)
+	if !ok || h != hash || string(meta) != `{"title":"a","revision":2}` {
+		t.Errorf("want the hash and the meta back, got %v %s %s", ok, h, meta)
+	}
+	for _, data := range []string{``, `{"title":"a","text":"old revision"}`, `#no newline`} {
+		if _, _, ok := DecodeRevision([]byte(data)); ok {
+			t.Errorf("%q: want it not to be decoded", data)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Link is a reference from a tiddler to another one.
+type Link struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"` // "link", "transclusion" or "tag"
+}
+
+// LinkQuery selects links: those from the tiddler From, if set,
+// to the tiddler To, if set, and of the kind Kind, if set.
+// An empty query selects all the links.
+type LinkQuery struct {
+	From string
+	To   string
+	Kind string
+}
+
+// Match returns true iff l is selected by q.
+func (q LinkQuery) Match(l Link) bool {
+	return (q.From == "" || l.From == q.From) && (q.To == "" || l.To == q.To) &&
+		(q.Kind == "" || l.Kind == q.Kind)
+}
+
+// Tag is a tag along with the number of tiddlers tagged with it.
+type Tag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// Tags returns all the tags used in s, sorted, with their counts.
+// The tags are taken from the link index, where tagging a tiddler
+// is a link of the kind "tag" from the tiddler to the tag.
+func Tags(ctx context.Context, s TiddlerStore) ([]Tag, error) {
+	links, err := s.Links(ctx, LinkQuery{Kind: "tag"})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, l := range links {
+		counts[l.To]++
+	}
+	tags := make([]Tag, 0, len(counts))
+	for tag, n := range counts {
+		tags = append(tags, Tag{tag, n})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags, nil
+}
+
+// Tagged returns the titles of the tiddlers tagged with tag, sorted.
+func Tagged(ctx context.Context, s TiddlerStore, tag string) ([]string, error) {
+	links, err := s.Links(ctx, LinkQuery{To: tag, Kind: "tag"})
+	if err != nil {
+		return nil, err
+	}
+	titles := make([]string, len(links))
+	for i, l := range links {
+		titles[i] = l.From
+	}
+	sort.Strings(titles)
+	return titles, nil
+}
+
+var (
+	codeBlockRe  = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+	filteredRe   = regexp.MustCompile(`(?s)\{\{\{.*?\}\}\}`)
+	wikiLinkRe   = regexp.MustCompile(`\[\[(.*?)\]\]`)
+	linkWidgetRe = regexp.MustCompile(`<\$link\b[^>]*?\bto=(?:"""(.*?)"""|"([^"]*)"|'([^']*)'|\[\[(.*?)\]\]|([^\s>"'=]+))`)
+	transcludeRe = regexp.MustCompile(`\{\{([^{}|]*?)(?:\|\|([^{}|]*?))?\}\}`)
+	externalRe   = regexp.MustCompile(`^(?:file|http|https|mailto|ftp|irc|news|data|skype):`)
+)
+
+// ParseLinks returns the links from the tiddler: the wiki links ([[...]] and
+// <$link to=...>), the transclusions ({{...}}, including the templates) in
+// the text, and the tags in the meta. External links and the links in code
+// are skipped. Every link is returned once.
+func ParseLinks(t Tiddler) []Link {
+	title := t.Key
+	if title == "" {
+		title = SortValue(t.Meta, "title")
+	}
+	var links []Link
+	seen := make(map[Link]bool)
+	add := func(to, kind string) {
+		to = strings.TrimSpace(to)
+		l := Link{From: title, To: to, Kind: kind}
+		if to == "" || seen[l] {
+			return
+		}
+		seen[l] = true
+		links = append(links, l)
+	}
+
+	text := codeBlockRe.ReplaceAllString(t.Text, "")
+	text = filteredRe.ReplaceAllString(text, "")
+	for _, m := range wikiLinkRe.FindAllStringSubmatch(text, -1) {
+		to := m[1]
+		if i := strings.IndexByte(to, '|'); i >= 0 {
+			to = to[i+1:]
+		}
+		if !externalRe.MatchString(to) {
+			add(to, "link")
+		}
+	}
+	for _, m := range linkWidgetRe.FindAllStringSubmatch(text, -1) {
+		add(m[1]+m[2]+m[3]+m[4]+m[5], "link")
+	}
+	for _, m := range transcludeRe.FindAllStringSubmatch(text, -1) {
+		to := m[1]
+		if i := strings.Index(to, "!!"); i >= 0 {
+			to = to[:i]
+		}
+		if i := strings.Index(to, "##"); i >= 0 {
+			to = to[:i]
+		}
+		add(to, "transclusion")
+		add(m[2], "transclusion")
+	}
+	for _, tag := range ParseTags(t.Meta) {
+		add(tag, "tag")
+	}
+	return links
+}
+
+// SortLinks sorts links by From, To and Kind.
+func SortLinks(links []Link) {
+	sort.Slice(links, func(i, j int) bool {
+		a, b := links[i], links[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// ParseTags returns the tags in the meta of a tiddler, which can be
+// a JSON array or a TiddlyWiki list ("a [[b c]] d").
+func ParseTags(meta []byte) []string {
+	var js struct {
+		Tags interface{} `json:"tags"`
+	}
+	if json.Unmarshal(meta, &js) != nil {
+		return nil
+	}
+	switch v := js.Tags.(type) {
+	case []interface{}:
+		var tags []string
+		for _, tag := range v {
+			if s, ok := tag.(string); ok && s != "" {
+				tags = append(tags, s)
+			}
+		}
+		return tags
+	case string:
+		return parseList(v)
+	}
+	return nil
+}
+
+// parseList splits a TiddlyWiki list.
+func parseList(s string) []string {
+	var items []string
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return items
+		}
+		var item string
+		if strings.HasPrefix(s, "[[") {
+			end := strings.Index(s, "]]")
+			if end < 0 {
+				end = len(s)
+				s += "]]"
+			}
+			item, s = s[2:end], s[end+2:]
+		} else {
+			end := strings.IndexAny(s, " \t\n")
+			if end < 0 {
+				end = len(s)
+			}
+			item, s = s[:end], s[end:]
+		}
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+}
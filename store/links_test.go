@@ -0,0 +1,58 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLinks(t *testing.T) {
+	tiddler := Tiddler{
+		Key:  "Home",
+		Meta: []byte(`{"title":"Home","tags":"Start [[Getting started]]"}`),
+		Text: "See [[Intro]] and [[the manual|Manual]], not [[site|https://example.com]].\n" +
+			`<$link to="Widget link">x</$link> <$link to=[[Bracketed]]/>` + "\n" +
+			"{{Header}} {{Data!!caption}} {{||Template}} {{{ [tag[x]] }}}\n" +
+			"`[[Code]]` and [[Intro]] again\n" +
+			"```\n[[Block]]\n```\n",
+	}
+	want := []Link{
+		{"Home", "Intro", "link"},
+		{"Home", "Manual", "link"},
+		{"Home", "Bracketed", "link"},
+		{"Home", "Widget link", "link"},
+		{"Home", "Header", "transclusion"},
+		{"Home", "Data", "transclusion"},
+		{"Home", "Template", "transclusion"},
+		{"Home", "Start", "tag"},
+		{"Home", "Getting started", "tag"},
+	}
+	if got := ParseLinks(tiddler); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	for meta, want := range map[string][]string{
+		`{"tags":["a","b c"]}`:      {"a", "b c"},
+		`{"tags":"a [[b c]]  d"}`:   {"a", "b c", "d"},
+		`{"title":"no tags"}`:       nil,
+		`{"tags":"[[unterminated"}`: {"unterminated"},
+	} {
+		if got := ParseTags([]byte(meta)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %q, got %q", meta, want, got)
+		}
+	}
+}
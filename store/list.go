@@ -0,0 +1,158 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ListOptions selects and orders a page of tiddlers.
+type ListOptions struct {
+	// Sort is the field to sort by (title by default), prefixed with "-"
+	// for the descending order. Tiddlers with the same value of the field
+	// are sorted by title.
+	Sort string
+
+	Offset int     // The number of tiddlers to skip
+	Limit  int     // The maximum number of tiddlers to return; 0 means no limit
+	After  *Cursor // If not nil, only the tiddlers following the cursor are listed
+}
+
+// Field returns the field to sort by and whether the order is descending.
+func (o ListOptions) Field() (string, bool) {
+	field, desc := o.Sort, false
+	if strings.HasPrefix(field, "-") {
+		field, desc = field[1:], true
+	}
+	if field == "" {
+		field = "title"
+	}
+	return field, desc
+}
+
+// Cursor is a position in a sorted list of tiddlers: the value of the sort
+// field and the title of the last tiddler of a page.
+type Cursor struct {
+	Value string
+	Title string
+}
+
+// CursorOf returns the cursor pointing at the tiddler t in a list sorted by field.
+func CursorOf(t Tiddler, field string) *Cursor {
+	return &Cursor{Value: SortValue(t.Meta, field), Title: SortValue(t.Meta, "title")}
+}
+
+// Lister is implemented by the stores which can list a page of tiddlers
+// efficiently, e.g. by pushing the sorting down to the database.
+// List should return the tiddlers the way All does.
+type Lister interface {
+	List(ctx context.Context, opts ListOptions) ([]Tiddler, error)
+}
+
+// List returns a page of the tiddlers of s, using s.List if s is a Lister.
+// Otherwise it pages the result of s.All.
+func List(ctx context.Context, s TiddlerStore, opts ListOptions) ([]Tiddler, error) {
+	if l, ok := s.(Lister); ok {
+		return l.List(ctx, opts)
+	}
+	all, err := s.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Page(all, opts), nil
+}
+
+// SortValue returns the value of a field of the tiddler with the given meta,
+// as used for sorting: strings as they are, other values as JSON
+// (booleans as 1 or 0), and "" if there is no such field.
+func SortValue(meta []byte, field string) string {
+	var js map[string]json.RawMessage
+	if json.Unmarshal(meta, &js) != nil {
+		return ""
+	}
+	raw, ok := js[field]
+	if !ok {
+		return ""
+	}
+	var v interface{}
+	if json.Unmarshal(raw, &v) != nil {
+		return ""
+	}
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// Page sorts the tiddlers and returns the page selected by opts.
+// It is meant for the stores which can't do it more efficiently.
+func Page(tiddlers []Tiddler, opts ListOptions) []Tiddler {
+	field, desc := opts.Field()
+	type entry struct {
+		value, title string
+		t            Tiddler
+	}
+	entries := make([]entry, len(tiddlers))
+	for i, t := range tiddlers {
+		entries[i] = entry{SortValue(t.Meta, field), SortValue(t.Meta, "title"), t}
+	}
+	less := func(a, b entry) bool {
+		if a.value != b.value {
+			return a.value < b.value
+		}
+		return a.title < b.title
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+
+	page := []Tiddler{}
+	skip := opts.Offset
+	for _, e := range entries {
+		if c := opts.After; c != nil {
+			at := entry{value: c.Value, title: c.Title}
+			if desc && !less(e, at) || !desc && !less(at, e) {
+				continue
+			}
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if opts.Limit > 0 && len(page) == opts.Limit {
+			break
+		}
+		page = append(page, e.t)
+	}
+	return page
+}
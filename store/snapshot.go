@@ -0,0 +1,82 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Snapshotter is implemented by the stores which can write a consistent
+// snapshot of their files while they are in use.
+type Snapshotter interface {
+	// Snapshot writes the files of the store as of a single point in time
+	// to tw: the database file as name, or the files of the database
+	// directory under name/.
+	Snapshot(ctx context.Context, tw *tar.Writer, name string) error
+}
+
+// TarFile writes the file at path to tw as name.
+func TarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// TarDir writes the directory dir and the regular files and directories
+// under it to tw, under name/.
+func TarDir(tw *tar.Writer, name, dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entry := path.Join(name, filepath.ToSlash(rel))
+		switch {
+		case fi.Mode().IsRegular():
+			return TarFile(tw, entry, p)
+		case fi.IsDir():
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = entry + "/"
+			return tw.WriteHeader(hdr)
+		}
+		return nil
+	})
+}
@@ -15,12 +15,18 @@
 package sqlite
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 
 	"github.com/opennota/widdly/store"
 )
@@ -45,26 +51,151 @@ func MustOpen(dataSource string) store.TiddlerStore {
 	if err != nil {
 		panic(err)
 	}
+	var hasLinks bool
+	err = db.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'link'`).Scan(&hasLinks)
+	if err != nil {
+		panic(err)
+	}
 	initStmt := `
-		CREATE TABLE tiddler (id integer not null primary key AUTOINCREMENT, title text, meta text, content text, revision integer);
+		CREATE TABLE IF NOT EXISTS tiddler (id integer not null primary key AUTOINCREMENT, title text, meta text, content text, revision integer);
+		CREATE TABLE IF NOT EXISTS change (seq integer not null primary key AUTOINCREMENT, title text not null unique, deleted integer not null);
+		CREATE INDEX IF NOT EXISTS tiddler_title ON tiddler(title, id);
+		CREATE TABLE IF NOT EXISTS blob (hash text not null primary key, content blob not null);
+		CREATE TABLE IF NOT EXISTS link (src text not null, dst text not null, kind text not null);
+		CREATE INDEX IF NOT EXISTS link_src ON link(src);
+		CREATE INDEX IF NOT EXISTS link_dst ON link(dst);
+		CREATE INDEX IF NOT EXISTS link_kind ON link(kind, dst);
 	`
 	_, err = db.Exec(initStmt)
-	return &sqliteStore{db}
+	if err != nil {
+		panic(err)
+	}
+	// Refer to the texts of the revisions saved from now on by hash. The texts
+	// of the revisions saved before are kept in the content column, until GC
+	// moves them to blobs; tiddler_text reads the texts from wherever they are.
+	var hasHash bool
+	err = db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info('tiddler') WHERE name = 'hash'`).Scan(&hasHash)
+	if err != nil {
+		panic(err)
+	}
+	if !hasHash {
+		_, err = db.Exec(`ALTER TABLE tiddler ADD COLUMN hash text`)
+		if err != nil {
+			panic(err)
+		}
+	}
+	viewStmt := `
+		CREATE INDEX IF NOT EXISTS tiddler_hash ON tiddler(hash);
+		CREATE VIEW IF NOT EXISTS tiddler_text AS
+		SELECT t.id, t.title, t.meta, t.revision, COALESCE(t.content, b.content) AS content
+		FROM tiddler t LEFT JOIN blob b ON b.hash = t.hash;
+	`
+	_, err = db.Exec(viewStmt)
+	if err != nil {
+		panic(err)
+	}
+	// Log the existing tiddlers as changes if the database was created before the change log was introduced.
+	backfillStmt := `
+		INSERT INTO change(title, deleted)
+		SELECT DISTINCT title, 0 FROM tiddler WHERE NOT EXISTS (SELECT 1 FROM change);
+	`
+	_, err = db.Exec(backfillStmt)
+	if err != nil {
+		panic(err)
+	}
+	s := &sqliteStore{db}
+	if !hasLinks {
+		// Index the links of the existing tiddlers.
+		err = s.reindexLinks()
+		if err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+// reindexLinks rebuilds the link index.
+func (s *sqliteStore) reindexLinks() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT title, meta, content FROM tiddler_text WHERE id IN (SELECT MAX(id) FROM tiddler GROUP BY title)`)
+	if err != nil {
+		return err
+	}
+	var tiddlers []store.Tiddler
+	for rows.Next() {
+		var t store.Tiddler
+		var meta string
+		var content []byte
+		if err := rows.Scan(&t.Key, &meta, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		t.Meta = []byte(meta)
+		if t.Text, err = store.DecodeText(content); err != nil {
+			rows.Close()
+			return err
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, t := range tiddlers {
+		if err := indexLinks(tx, t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// indexLinks replaces the links from the tiddler in the link index.
+func indexLinks(tx *sql.Tx, t store.Tiddler) error {
+	_, err := tx.Exec(`DELETE FROM link WHERE src = ?`, t.Key)
+	if err != nil {
+		return err
+	}
+	for _, l := range store.ParseLinks(t) {
+		_, err = tx.Exec(`INSERT INTO link(src, dst, kind) VALUES (?, ?, ?)`, l.From, l.To, l.Kind)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logChange records a change to the tiddler with the given title under the next sequence number,
+// replacing the previous change to the same tiddler.
+func logChange(tx *sql.Tx, title string, deleted bool) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO change(title, deleted) VALUES (?, ?)`, title, deleted)
+	return err
 }
 
 // Get retrieves a tiddler from the store by key (title).
 func (s *sqliteStore) Get(_ context.Context, key string) (store.Tiddler, error) {
 	t := store.Tiddler{WithText: true}
-	getStmt, err := s.db.Prepare(`SELECT meta, content FROM tiddler WHERE title = ? ORDER BY revision DESC LIMIT 1`)
+	getStmt, err := s.db.Prepare(`SELECT meta, content FROM tiddler_text WHERE title = ? ORDER BY id DESC LIMIT 1`)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
 	var meta string
-	var content string
+	var content []byte
 	err = getStmt.QueryRow(key).Scan(&meta, &content)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		return store.Tiddler{}, store.ErrNotFound
+	} else if err != nil {
 		return store.Tiddler{}, err
 	}
 	t.Meta = make([]byte, len(meta))
 	copy(t.Meta, meta)
-	t.Text = string(content)
+	t.Text, err = store.DecodeText(content)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
 	return t, nil
 }
 
@@ -76,69 +207,481 @@ func copyOf(p []byte) []byte {
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
 // Special tiddlers (like global macros) are returned fat.
-func (s *sqliteStore) All(_ context.Context) ([]store.Tiddler, error) {
+func (s *sqliteStore) All(ctx context.Context) ([]store.Tiddler, error) {
 	tiddlers := []store.Tiddler{}
-	rows, err := s.db.Query(`SELECT meta, content FROM tiddler`)
+	err := s.Walk(ctx, func(t store.Tiddler) error {
+		tiddlers = append(tiddlers, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlers, nil
+}
+
+// walkChunk is the number of tiddlers Walk reads with a query.
+const walkChunk = 256
+
+// Walk calls fn for every tiddler (mostly skinny). The tiddlers are read in
+// chunks of titles following the last one read, so that a slow fn does not
+// keep a read transaction open and block the writers; a tiddler written
+// during the walk may be passed as of before or after the write.
+func (s *sqliteStore) Walk(ctx context.Context, fn func(store.Tiddler) error) error {
+	after := ""
+	for first := true; ; first = false {
+		chunk, last, err := s.walkChunk(ctx, after, first)
+		if err != nil {
+			return err
+		}
+		for _, t := range chunk {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+		if len(chunk) < walkChunk {
+			return ctx.Err()
+		}
+		after = last
+	}
+}
+
+// walkChunk reads the next walkChunk tiddlers in the order of the titles,
+// starting after the title after (or from the first one), and returns them
+// with the last title read.
+func (s *sqliteStore) walkChunk(ctx context.Context, after string, first bool) ([]store.Tiddler, string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT title, meta, content FROM tiddler_text WHERE id IN (
+			SELECT MAX(id) FROM tiddler WHERE ? OR title > ? GROUP BY title ORDER BY title LIMIT ?
+		) ORDER BY title`, first, after, walkChunk)
+	if err != nil {
+		return nil, "", err
+	}
 	defer rows.Close()
+	var chunk []store.Tiddler
+	last := after
 	for rows.Next() {
 		var t store.Tiddler
 		var meta string
-		var content string
-		if err := rows.Scan(&meta, &content); err != nil {
-                return nil, err
-        }
-        t.Meta = []byte(meta)
-        if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
-			t.Text = string(content)
+		var content []byte
+		if err := rows.Scan(&last, &meta, &content); err != nil {
+			return nil, "", err
+		}
+		t.Meta = []byte(meta)
+		if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
+			text, err := store.DecodeText(content)
+			if err != nil {
+				return nil, "", err
+			}
+			t.Text = text
 			t.WithText = true
 		}
-        tiddlers = append(tiddlers, t)
+		chunk = append(chunk, t)
+	}
+	return chunk, last, rows.Err()
+}
+
+// List retrieves a page of the tiddlers (mostly skinny), sorted and paged by the database.
+func (s *sqliteStore) List(_ context.Context, opts store.ListOptions) ([]store.Tiddler, error) {
+	field, desc := opts.Field()
+	value := `title`
+	var args []interface{}
+	if field != "title" {
+		value = `COALESCE(CAST(json_extract(meta, ?) AS TEXT), '')`
+		args = append(args, `$."`+strings.Replace(field, `"`, `\"`, -1)+`"`)
+	}
+	cmp, order := ">", "ASC"
+	if desc {
+		cmp, order = "<", "DESC"
 	}
+	after := ""
+	if c := opts.After; c != nil {
+		after = fmt.Sprintf(`WHERE v %s ? OR (v = ? AND title %s ?)`, cmp, cmp)
+	}
+	query := fmt.Sprintf(`
+		SELECT meta, content FROM (
+			SELECT title, meta, content, %s AS v FROM tiddler_text
+			WHERE id IN (SELECT MAX(id) FROM tiddler GROUP BY title))
+		%s
+		ORDER BY v %s, title %s LIMIT ? OFFSET ?`, value, after, order, order)
+	if c := opts.After; c != nil {
+		args = append(args, c.Value, c.Value, c.Title)
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit, opts.Offset)
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	tiddlers := []store.Tiddler{}
+	for rows.Next() {
+		var t store.Tiddler
+		var meta string
+		var content []byte
+		if err := rows.Scan(&meta, &content); err != nil {
+			return nil, err
+		}
+		t.Meta = []byte(meta)
+		if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
+			t.Text, err = store.DecodeText(content)
+			if err != nil {
+				return nil, err
+			}
+			t.WithText = true
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	return tiddlers, nil
 }
 
-func getLastRevision(db *sql.DB, mkey string) int {
+func getLastRevision(tx *sql.Tx, title string) (int, error) {
 	var revision int
-	getStmt, err := db.Prepare(`SELECT revision FROM tiddler WHERE title = ? ORDER BY revision DESC LIMIT 1`)
-	err = getStmt.QueryRow(mkey).Scan(&revision)
-	if err == nil {
-		return 1
-	}
-	return revision
+	err := tx.QueryRow(`SELECT COALESCE(MAX(revision), 0) FROM tiddler WHERE title = ?`, title).Scan(&revision)
+	return revision, err
 }
 
 // Put saves tiddler to the store, incrementing and returning revision.
-// The tiddler is also written to the tiddler_history bucket.
+// Earlier revisions are kept in the tiddler table.
 func (s *sqliteStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rev, err := put(tx, tiddler)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+func put(tx *sql.Tx, tiddler store.Tiddler) (int, error) {
 	var js map[string]interface{}
 	err := json.Unmarshal(tiddler.Meta, &js)
 	if err != nil {
 		return 0, err
 	}
-	rev := getLastRevision(s.db, tiddler.Key)
-	insertStmt, err := s.db.Prepare(`INSERT INTO tiddler(title, meta, content, revision) VALUES (?, ?, ?, ?)`)
+	rev, err := getLastRevision(tx, tiddler.Key)
+	if err != nil {
+		return 0, err
+	}
+	rev++
+	js["revision"] = rev
+	meta, err := json.Marshal(js)
 	if err != nil {
 		return 0, err
 	}
-	_, err = insertStmt.Exec(tiddler.Key, tiddler.Meta, tiddler.Text, rev+1)
+	hash, err := putBlob(tx, tiddler.Text)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO tiddler(title, meta, hash, revision) VALUES (?, ?, ?, ?)`, tiddler.Key, meta, hash, rev)
+	if err != nil {
+		return 0, err
+	}
+	err = logChange(tx, tiddler.Key, false)
+	if err != nil {
+		return 0, err
+	}
+	err = indexLinks(tx, tiddler)
 	if err != nil {
 		return 0, err
 	}
 	return rev, nil
 }
 
+// putBlob stores text in the blob table, unless it is there already.
+// It returns the hash of the text.
+func putBlob(tx *sql.Tx, text string) (string, error) {
+	hash := store.BlobHash(text)
+	var exists bool
+	err := tx.QueryRow(`SELECT COUNT(*) > 0 FROM blob WHERE hash = ?`, hash).Scan(&exists)
+	if err != nil || exists {
+		return hash, err
+	}
+	content, err := store.EncodeText(text)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`INSERT INTO blob(hash, content) VALUES (?, ?)`, hash, content)
+	return hash, err
+}
+
+// Revision retrieves the given revision of a tiddler.
+func (s *sqliteStore) Revision(_ context.Context, key string, rev int) (store.Tiddler, error) {
+	t := store.Tiddler{Key: key, WithText: true}
+	var meta string
+	var content []byte
+	err := s.db.QueryRow(`SELECT meta, content FROM tiddler_text WHERE title = ? AND revision = ? ORDER BY id DESC LIMIT 1`, key, rev).Scan(&meta, &content)
+	if err == sql.ErrNoRows {
+		return store.Tiddler{}, store.ErrNotFound
+	} else if err != nil {
+		return store.Tiddler{}, err
+	}
+	t.Meta = []byte(meta)
+	t.Text, err = store.DecodeText(content)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	return t, nil
+}
+
 // Delete deletes a tiddler with the given key (title) from the store.
 func (s *sqliteStore) Delete(ctx context.Context, key string) error {
-	deleteStmt, err := s.db.Prepare(`DELETE FROM tiddler WHERE title = ?`)
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = deleteStmt.Exec(key)
+	defer tx.Rollback()
+	err = del(tx, key)
 	if err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
+}
+
+func del(tx *sql.Tx, key string) error {
+	_, err := tx.Exec(`DELETE FROM tiddler WHERE title = ?`, key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM link WHERE src = ?`, key)
+	if err != nil {
+		return err
+	}
+	return logChange(tx, key, true)
+}
+
+// Batch applies the operations in a single transaction.
+func (s *sqliteStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	revs := make([]int, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			var n int
+			err = tx.QueryRow(`SELECT COUNT(*) FROM tiddler WHERE title = ?`, op.Tiddler.Key).Scan(&n)
+			if err == nil && n == 0 {
+				err = store.ErrNotFound
+			}
+			if err == nil {
+				err = del(tx, op.Tiddler.Key)
+			}
+		} else {
+			revs[i], err = put(tx, op.Tiddler)
+		}
+		if err != nil {
+			return nil, &store.BatchError{Index: i, Err: err}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// Since returns the latest changes made after the change with the sequence number seq.
+func (s *sqliteStore) Since(_ context.Context, seq int64) ([]store.Change, int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM change`).Scan(&last)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT c.seq, c.title, c.deleted, COALESCE(t.meta, ''), COALESCE(t.content, '')
+		FROM change c LEFT JOIN tiddler_text t
+		ON t.id = (SELECT MAX(id) FROM tiddler WHERE title = c.title)
+		WHERE c.seq > ? ORDER BY c.seq`, seq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	changes := []store.Change{}
+	for rows.Next() {
+		var ch store.Change
+		var meta string
+		var content []byte
+		if err := rows.Scan(&ch.Seq, &ch.Tiddler.Key, &ch.Deleted, &meta, &content); err != nil {
+			return nil, 0, err
+		}
+		if !ch.Deleted {
+			ch.Tiddler.Meta = []byte(meta)
+			if bytes.Contains(ch.Tiddler.Meta, []byte(`"$:/tags/Macro"`)) {
+				ch.Tiddler.Text, err = store.DecodeText(content)
+				if err != nil {
+					return nil, 0, err
+				}
+				ch.Tiddler.WithText = true
+			}
+		}
+		changes = append(changes, ch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return changes, last, nil
+}
+
+// Links returns the links selected by the query from the link table.
+func (s *sqliteStore) Links(ctx context.Context, q store.LinkQuery) ([]store.Link, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT src, dst, kind FROM link
+		WHERE (? = '' OR src = ?) AND (? = '' OR dst = ?) AND (? = '' OR kind = ?)
+		ORDER BY src, dst, kind`, q.From, q.From, q.To, q.To, q.Kind, q.Kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []store.Link{}
+	for rows.Next() {
+		var l store.Link
+		if err := rows.Scan(&l.From, &l.To, &l.Kind); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// GC moves the texts of the revisions saved before the blob table existed
+// to blobs and removes the blobs no revision refers to. The space is reused
+// by SQLite, but the file does not shrink (see VACUUM).
+func (s *sqliteStore) GC(ctx context.Context) (store.GCStats, error) {
+	var stats store.GCStats
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	type revision struct {
+		id      int64
+		content []byte
+	}
+	var migrated []revision
+	rows, err := tx.QueryContext(ctx, `SELECT id, content FROM tiddler WHERE hash IS NULL`)
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var r revision
+		if err := rows.Scan(&r.id, &r.content); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		migrated = append(migrated, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+	for _, r := range migrated {
+		text, err := store.DecodeText(r.content)
+		if err != nil {
+			return stats, err
+		}
+		hash := store.BlobHash(text)
+		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO blob(hash, content) VALUES (?, ?)`, hash, r.content)
+		if err != nil {
+			return stats, err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE tiddler SET hash = ?, content = NULL WHERE id = ?`, hash, r.id)
+		if err != nil {
+			return stats, err
+		}
+	}
+	stats.Migrated = len(migrated)
+
+	const unreferenced = `FROM blob WHERE NOT EXISTS (SELECT 1 FROM tiddler WHERE tiddler.hash = blob.hash)`
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(LENGTH(content)), 0) `+unreferenced).Scan(&stats.Removed, &stats.Freed)
+	if err != nil {
+		return stats, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE `+unreferenced)
+	if err != nil {
+		return stats, err
+	}
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM blob`).Scan(&stats.Blobs)
+	if err != nil {
+		return stats, err
+	}
+	if err := tx.Commit(); err != nil {
+		return store.GCStats{}, err
+	}
+	return stats, nil
+}
+
+// Snapshot copies the database with the SQLite online backup API to a
+// temporary file and writes that to tw.
+func (s *sqliteStore) Snapshot(ctx context.Context, tw *tar.Writer, name string) error {
+	dir, err := ioutil.TempDir("", "widdly-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.db")
+	if err := s.backup(ctx, path); err != nil {
+		return err
+	}
+	return store.TarFile(tw, name, path)
+}
+
+// backup copies the database to a new database file at path.
+func (s *sqliteStore) backup(ctx context.Context, path string) error {
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// Copy all the pages in a single step, which holds a read lock
+			// on the database, so that the copy is consistent.
+			if _, err := b.Step(-1); err != nil {
+				b.Close()
+				return err
+			}
+			return b.Finish()
+		})
+	})
 }
@@ -0,0 +1,81 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opennota/widdly/store"
+	"github.com/opennota/widdly/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-sqlite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storetest.Run(t, func(t *testing.T) store.TiddlerStore {
+		return MustOpen(filepath.Join(dir, filepath.Base(t.Name())+".db"))
+	})
+}
+
+func TestGCMigrates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-sqlite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "old.db")
+
+	// A database saved by an older version, with the texts in the tiddler table.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE tiddler (id integer not null primary key AUTOINCREMENT, title text, meta text, content text, revision integer);
+		INSERT INTO tiddler(title, meta, content, revision) VALUES ('a', '{"title":"a","revision":1}', 'same', 1);
+		INSERT INTO tiddler(title, meta, content, revision) VALUES ('a', '{"title":"a","revision":2}', 'same', 2);`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := MustOpen(path)
+	if td, err := s.Get(ctx, "a"); err != nil || td.Text != "same" {
+		t.Fatalf("want the old text readable before GC, got %q %v", td.Text, err)
+	}
+	if _, err := s.Put(ctx, store.Tiddler{Key: "b", Meta: []byte(`{"title":"b"}`), Text: "gone"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := s.(store.Collector).GC(ctx)
+	if want := (store.GCStats{Migrated: 2, Blobs: 1, Removed: 1, Freed: 4}); err != nil || stats != want {
+		t.Errorf("want %+v, got %+v %v", want, stats, err)
+	}
+	for rev := 1; rev <= 2; rev++ {
+		if td, err := s.Revision(ctx, "a", rev); err != nil || td.Text != "same" {
+			t.Errorf("a#%d: want the text kept, got %q %v", rev, td.Text, err)
+		}
+	}
+}
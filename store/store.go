@@ -18,8 +18,27 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 )
 
+// Op is an operation of a batch: a put of Tiddler or, if Delete is true,
+// a delete of the tiddler with the key Tiddler.Key.
+type Op struct {
+	Tiddler Tiddler
+	Delete  bool
+}
+
+// BatchError is the error returned by Batch when an operation fails.
+type BatchError struct {
+	Index int // The index of the failed operation
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
 // ErrNotFound is the error returned by the TiddlerStore when no tiddlers with a given key are found.
 var ErrNotFound = errors.New("not found")
 
@@ -48,6 +67,57 @@ func (t *Tiddler) MarshalJSON() ([]byte, error) {
 	return json.Marshal(js)
 }
 
+// UnmarshalJSON implements json.Unmarshaler.
+// It splits a fat tiddler into t.Meta and t.Text; t.Key is set to its title.
+func (t *Tiddler) UnmarshalJSON(data []byte) error {
+	var js map[string]interface{}
+	err := json.Unmarshal(data, &js)
+	if err != nil {
+		return err
+	}
+	text, withText := js["text"].(string)
+	delete(js, "text")
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	title, _ := js["title"].(string)
+	*t = Tiddler{Key: title, Meta: meta, Text: text, WithText: withText}
+	return nil
+}
+
+// Revision returns the revision stored in t.Meta, or 0 if there is none.
+func (t *Tiddler) Revision() int {
+	var js struct{ Revision interface{} }
+	if json.Unmarshal(t.Meta, &js) != nil {
+		return 0
+	}
+	switch rev := js.Revision.(type) {
+	case float64:
+		return int(rev)
+	case string:
+		n, _ := strconv.Atoi(rev)
+		return n
+	}
+	return 0
+}
+
+// Fields returns the fields of t, including the text,
+// without the fields managed by the server (revision and bag).
+func (t *Tiddler) Fields() (map[string]interface{}, error) {
+	js := make(map[string]interface{})
+	if len(t.Meta) > 0 {
+		err := json.Unmarshal(t.Meta, &js)
+		if err != nil {
+			return nil, err
+		}
+	}
+	js["text"] = t.Text
+	delete(js, "revision")
+	delete(js, "bag")
+	return js, nil
+}
+
 // TiddlerStore provides an interface for retrieving, storing and deleting tiddlers.
 type TiddlerStore interface {
 	// Get retrieves a tiddler from the store by key (title).
@@ -61,11 +131,49 @@ type TiddlerStore interface {
 	// All must not return deleted tiddlers.
 	All(ctx context.Context) ([]Tiddler, error)
 
+	// Walk calls fn for every tiddler in the store, passing the tiddlers
+	// the way All returns them, without holding all of them in memory.
+	// If fn returns an error, Walk stops and returns that error;
+	// if ctx is done, Walk stops and returns ctx.Err().
+	// fn may write to the store; a tiddler written during the walk
+	// is passed once at most, as of before or after the write.
+	Walk(ctx context.Context, fn func(Tiddler) error) error
+
 	// Put saves tiddler to the store and returns its revision.
+	// The revision should also be stored in the tiddler's meta (the revision field).
 	Put(ctx context.Context, tiddler Tiddler) (int, error)
 
+	// Revision retrieves a past revision of a tiddler from the store's history.
+	// Revision should return ErrNotFound error when there is no such revision.
+	Revision(ctx context.Context, key string, rev int) (Tiddler, error)
+
 	// Delete deletes a tiddler by key.
 	Delete(ctx context.Context, key string) error
+
+	// Since returns the latest changes made after the change with the
+	// sequence number seq, oldest first, along with the sequence number of
+	// the latest change in the store. Sequence numbers are global to the
+	// store and monotonically increasing. Only the latest change to each
+	// tiddler is returned. Changed tiddlers are returned like All returns
+	// them; deleted tiddlers are returned as tombstones carrying the key only.
+	Since(ctx context.Context, seq int64) ([]Change, int64, error)
+
+	// Batch applies the operations in order, atomically: either all of them
+	// are applied, or none is. It returns the revision of every put (0 for
+	// deletes). Deleting a tiddler which does not exist is an error.
+	// If an operation fails, Batch returns a *BatchError.
+	Batch(ctx context.Context, ops []Op) ([]int, error)
+
+	// Links returns the links selected by the query from the link index,
+	// which the store keeps up to date on every change (see ParseLinks).
+	Links(ctx context.Context, q LinkQuery) ([]Link, error)
+}
+
+// Change is a change made to the store.
+type Change struct {
+	Seq     int64   // The sequence number of the change
+	Tiddler Tiddler // The changed tiddler; only Key is set if the tiddler was deleted
+	Deleted bool    // If the tiddler was deleted
 }
 
 // MustOpen is a function variable assigned by the TiddlerStore implementations.
@@ -0,0 +1,360 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package storetest checks that a TiddlerStore implementation behaves the
+// way the store package documents. Every backend runs it from its tests.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opennota/widdly/store"
+)
+
+// Run runs the conformance tests, calling open for a new, empty store for
+// every one of them.
+func Run(t *testing.T, open func(t *testing.T) store.TiddlerStore) {
+	for _, test := range []struct {
+		name string
+		fn   func(*testing.T, store.TiddlerStore)
+	}{
+		{"PutGet", testPutGet},
+		{"Since", testSince},
+		{"Batch", testBatch},
+		{"Walk", testWalk},
+		{"List", testList},
+		{"Links", testLinks},
+		{"GC", testGC},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) { test.fn(t, open(t)) })
+	}
+}
+
+// tiddler returns a tiddler titled title with the given text and meta fields.
+func tiddler(title, text, fields string) store.Tiddler {
+	meta := `{"title":"` + title + `"`
+	if fields != "" {
+		meta += "," + fields
+	}
+	return store.Tiddler{Key: title, Meta: []byte(meta + "}"), Text: text}
+}
+
+func put(t *testing.T, s store.TiddlerStore, tiddlers ...store.Tiddler) {
+	t.Helper()
+	for _, td := range tiddlers {
+		if _, err := s.Put(context.Background(), td); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// titles returns the titles of the tiddlers, from their meta.
+func titles(tiddlers []store.Tiddler) string {
+	var out []string
+	for _, td := range tiddlers {
+		out = append(out, store.SortValue(td.Meta, "title"))
+	}
+	return strings.Join(out, ",")
+}
+
+func testPutGet(t *testing.T, s store.TiddlerStore) {
+	ctx := context.Background()
+	for want, text := range []string{"first", "second"} {
+		rev, err := s.Put(ctx, tiddler("a", text, `"tags":"x"`))
+		if err != nil || rev != want+1 {
+			t.Fatalf("want revision %d, got %d %v", want+1, rev, err)
+		}
+	}
+	got, err := s.Get(ctx, "a")
+	if err != nil || got.Text != "second" || got.Revision() != 2 || store.SortValue(got.Meta, "tags") != "x" {
+		t.Errorf("want the second revision, got %s %q %v", got.Meta, got.Text, err)
+	}
+	old, err := s.Revision(ctx, "a", 1)
+	if err != nil || old.Text != "first" {
+		t.Errorf("want the first revision, got %q %v", old.Text, err)
+	}
+	if _, err := s.Revision(ctx, "a", 3); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound for a missing revision, got %v", err)
+	}
+
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "a"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound for a deleted tiddler, got %v", err)
+	}
+	if all, err := s.All(ctx); err != nil || len(all) != 0 {
+		t.Errorf("want no tiddlers, got %d %v", len(all), err)
+	}
+}
+
+func testSince(t *testing.T, s store.TiddlerStore) {
+	ctx := context.Background()
+	put(t, s, tiddler("a", "1", ""), tiddler("b", "1", ""), tiddler("a", "2", ""))
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, tiddler("macro", "\\define m() x", `"tags":"$:/tags/Macro"`))
+
+	format := func(changes []store.Change) string {
+		var out []string
+		for _, c := range changes {
+			s := c.Tiddler.Key
+			if c.Deleted {
+				s += " deleted"
+			} else if c.Tiddler.Revision() == 0 {
+				s += " without meta"
+			}
+			out = append(out, s)
+		}
+		return strings.Join(out, ",")
+	}
+	changes, last, err := s.Since(ctx, 0)
+	if err != nil || last != 5 || format(changes) != "a,b deleted,macro" {
+		t.Fatalf("want the latest change to every tiddler, oldest first, got %q %d %v", format(changes), last, err)
+	}
+	for i := 1; i < len(changes); i++ {
+		if changes[i].Seq <= changes[i-1].Seq || changes[i].Seq > last {
+			t.Errorf("want increasing sequence numbers up to %d, got %d after %d", last, changes[i].Seq, changes[i-1].Seq)
+		}
+	}
+	if m := changes[2].Tiddler; !m.WithText || m.Text != "\\define m() x" {
+		t.Errorf("want global macros to be fat, got %+v", m)
+	}
+
+	changes, last, err = s.Since(ctx, changes[1].Seq)
+	if err != nil || last != 5 || format(changes) != "macro" {
+		t.Errorf("want the changes after the delete, got %q %d %v", format(changes), last, err)
+	}
+	changes, _, err = s.Since(ctx, last)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("want no changes, got %q %v", format(changes), err)
+	}
+}
+
+func testBatch(t *testing.T, s store.TiddlerStore) {
+	ctx := context.Background()
+	put(t, s, tiddler("old", "x", ""))
+	_, before, err := s.Since(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Batch(ctx, []store.Op{
+		{Tiddler: tiddler("new", "x", "")},
+		{Tiddler: store.Tiddler{Key: "missing"}, Delete: true},
+	})
+	var be *store.BatchError
+	if !errors.As(err, &be) || be.Index != 1 || be.Err != store.ErrNotFound {
+		t.Fatalf("want a BatchError for the second operation, got %v", err)
+	}
+	if _, err := s.Get(ctx, "new"); err != store.ErrNotFound {
+		t.Errorf("want nothing applied by a failed batch, got %v", err)
+	}
+	if _, last, _ := s.Since(ctx, 0); last != before {
+		t.Errorf("want no change logged by a failed batch, got %d after %d", last, before)
+	}
+
+	revs, err := s.Batch(ctx, []store.Op{
+		{Tiddler: tiddler("new", "one", "")},
+		{Tiddler: tiddler("new", "two", "")},
+		{Tiddler: store.Tiddler{Key: "old"}, Delete: true},
+	})
+	if err != nil || len(revs) != 3 || revs[0] != 1 || revs[1] != 2 || revs[2] != 0 {
+		t.Fatalf("want revisions [1 2 0], got %v %v", revs, err)
+	}
+	if got, err := s.Get(ctx, "new"); err != nil || got.Text != "two" {
+		t.Errorf("want the last put of the batch, got %q %v", got.Text, err)
+	}
+	if _, err := s.Get(ctx, "old"); err != store.ErrNotFound {
+		t.Errorf("want the deleted tiddler gone, got %v", err)
+	}
+}
+
+func testWalk(t *testing.T, s store.TiddlerStore) {
+	ctx := context.Background()
+	put(t, s, tiddler("a", "x", ""), tiddler("b", "x", ""), tiddler("macro", "m", `"tags":"$:/tags/Macro"`))
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked []store.Tiddler
+	err := s.Walk(ctx, func(td store.Tiddler) error {
+		walked = append(walked, td)
+		return nil
+	})
+	sort.Slice(walked, func(i, j int) bool { return titles(walked[i:i+1]) < titles(walked[j:j+1]) })
+	if err != nil || titles(walked) != "a,macro" {
+		t.Fatalf("want every tiddler, got %q %v", titles(walked), err)
+	}
+	if walked[0].WithText || !walked[1].WithText || walked[1].Text != "m" {
+		t.Errorf("want skinny tiddlers and fat global macros, got %+v", walked)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = s.Walk(ctx, func(store.Tiddler) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("want Walk to stop at the first error, got %v after %d", err, n)
+	}
+
+	// Many tiddlers are walked once each, and writing while walking
+	// neither blocks nor makes Walk skip or repeat the others.
+	var ops []store.Op
+	for i := 0; i < 1000; i++ {
+		ops = append(ops, store.Op{Tiddler: tiddler(fmt.Sprintf("t%04d", i), "x", "")})
+	}
+	if _, err := s.Batch(ctx, ops); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	err = s.Walk(ctx, func(td store.Tiddler) error {
+		fields, err := td.Fields()
+		if err != nil {
+			return err
+		}
+		title, _ := fields["title"].(string)
+		seen[title]++
+		if title == "t0500" {
+			if _, err := s.Put(ctx, tiddler("t0100", "y", "")); err != nil {
+				return err
+			}
+			return s.Delete(ctx, "t0999")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 999; i++ {
+		if title := fmt.Sprintf("t%04d", i); seen[title] != 1 {
+			t.Fatalf("want %s walked once, got %d times", title, seen[title])
+		}
+	}
+	if seen["t0999"] > 1 {
+		t.Errorf("want the tiddler deleted during the walk walked once at most, got %d times", seen["t0999"])
+	}
+}
+
+func testList(t *testing.T, s store.TiddlerStore) {
+	ctx := context.Background()
+	for i, title := range []string{"c", "a b", "a", "b", "gone"} {
+		put(t, s, tiddler(title, "x", `"modified":"`+string(rune('5'-i))+`"`))
+	}
+	if err := s.Delete(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		opts store.ListOptions
+		want string
+	}{
+		{store.ListOptions{}, "a,a b,b,c"},
+		{store.ListOptions{Sort: "-title"}, "c,b,a b,a"},
+		{store.ListOptions{Sort: "modified"}, "b,a,a b,c"},
+		{store.ListOptions{Offset: 1, Limit: 2}, "a b,b"},
+		{store.ListOptions{After: &store.Cursor{Value: "a", Title: "a"}}, "a b,b,c"},
+		{store.ListOptions{Sort: "-title", After: &store.Cursor{Value: "b", Title: "b"}}, "a b,a"},
+		{store.ListOptions{Sort: "-modified", Limit: 2, After: &store.Cursor{Value: "4", Title: "a b"}}, "a,b"},
+	} {
+		got, err := store.List(ctx, s, tc.opts)
+		if err != nil || titles(got) != tc.want {
+			t.Errorf("%+v: want %q, got %q %v", tc.opts, tc.want, titles(got), err)
+		}
+	}
+}
+
+func testLinks(t *testing.T, s store.TiddlerStore) {
+	ctx := context.Background()
+	put(t, s,
+		tiddler("Home", "See [[Intro]] and {{Header}}.", `"tags":"Start"`),
+		tiddler("Intro", "Back [[Home]].", ""),
+	)
+
+	format := func(links []store.Link) string {
+		var out []string
+		for _, l := range links {
+			out = append(out, l.From+">"+l.To+":"+l.Kind)
+		}
+		sort.Strings(out)
+		return strings.Join(out, ",")
+	}
+	for _, tc := range []struct {
+		q    store.LinkQuery
+		want string
+	}{
+		{store.LinkQuery{}, "Home>Header:transclusion,Home>Intro:link,Home>Start:tag,Intro>Home:link"},
+		{store.LinkQuery{From: "Home", Kind: "link"}, "Home>Intro:link"},
+		{store.LinkQuery{To: "Home"}, "Intro>Home:link"},
+	} {
+		links, err := s.Links(ctx, tc.q)
+		if err != nil || format(links) != tc.want {
+			t.Errorf("%+v: want %q, got %q %v", tc.q, tc.want, format(links), err)
+		}
+	}
+
+	put(t, s, tiddler("Home", "Nothing.", ""))
+	if err := s.Delete(ctx, "Intro"); err != nil {
+		t.Fatal(err)
+	}
+	if links, err := s.Links(ctx, store.LinkQuery{}); err != nil || len(links) != 0 {
+		t.Errorf("want the links of changed and deleted tiddlers gone, got %q %v", format(links), err)
+	}
+}
+
+func testGC(t *testing.T, s store.TiddlerStore) {
+	c, ok := s.(store.Collector)
+	if !ok {
+		t.Skip("the store keeps no blobs")
+	}
+	ctx := context.Background()
+	put(t, s, tiddler("a", "same", ""), tiddler("a", "same", ""), tiddler("a", "other", ""))
+	put(t, s, tiddler("b", "gone", ""))
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, tiddler("b", "new", ""))
+
+	stats, err := c.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs == 0 {
+		t.Errorf("want the blobs counted, got %+v", stats)
+	}
+	stats, err = c.GC(ctx)
+	if err != nil || stats.Removed != 0 || stats.Migrated != 0 {
+		t.Errorf("want nothing left to collect, got %+v %v", stats, err)
+	}
+	for _, want := range []struct {
+		key  string
+		rev  int
+		text string
+	}{{"a", 1, "same"}, {"a", 2, "same"}, {"a", 3, "other"}} {
+		if td, err := s.Revision(ctx, want.key, want.rev); err != nil || td.Text != want.text {
+			t.Errorf("%s#%d: want %q, got %q %v", want.key, want.rev, want.text, td.Text, err)
+		}
+	}
+	if td, err := s.Get(ctx, "b"); err != nil || td.Text != "new" {
+		t.Errorf("want b kept, got %q %v", td.Text, err)
+	}
+}